@@ -3,17 +3,54 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"log"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/si74/flow-api/internal/flowd"
+	"github.com/si74/flow-api/internal/store"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	backend := flag.String("backend", store.BackendMemory.String(), "flow store backend (memory or bolt)")
+	boltPath := flag.String("bolt-path", "flows.db", "database file of the bolt flow store backend")
+	granularity := flag.Duration("granularity", store.DefaultGranularity, "width of the time buckets flow data is aggregated into, such as 1m, 5m or 1h")
+	flowList := flag.String("flowlist", store.FlowListV1.String(), "flow list implementation used by the flow store (v1, v2 or bucket)")
+	retentionHours := flag.Int("retention-hours", 0, "number of hours of flow data kept by the flow store, 0 keeps flow data forever")
+	retentionMode := flag.String("retention-mode", store.RetentionNewestHour.String(), "whether retention is measured from the newest hour inserted or the wall-clock hour (newest or wallclock)")
+	purgeInterval := flag.Duration("purge-interval", time.Minute, "how often expired flow data is purged from the flow store")
+	sealOpenHours := flag.Int("seal-open-hours", 0, "number of most recent hours left writable before older hours are sealed into compressed blocks, 0 disables sealing")
+	sealInterval := flag.Duration("seal-interval", time.Minute, "how often hours are sealed into compressed blocks")
+	rollupDays := flag.Int("rollup-days", -1, "number of days of daily flow rollups kept, 0 keeps them forever and -1 disables daily rollups")
+	rollupWeeks := flag.Int("rollup-weeks", -1, "number of weeks of weekly flow rollups kept, 0 keeps them forever and -1 disables weekly rollups")
+	shards := flag.Int("shards", 16, "number of lock-striped partitions of the flow store")
+	walDir := flag.String("wal-dir", "", "directory of the flow store write-ahead log, the log is disabled when empty")
+	walSync := flag.String("wal-sync", store.SyncAlways.String(), "when the write-ahead log is fsynced (always, interval or never)")
+	walSyncInterval := flag.Duration("wal-sync-interval", time.Second, "how often the write-ahead log is fsynced with -wal-sync interval")
+	snapshotDir := flag.String("snapshot-dir", "", "directory flow store snapshots are written to, snapshots are disabled when empty")
+	snapshotInterval := flag.Duration("snapshot-interval", time.Hour, "how often a flow store snapshot is taken, 0 only takes snapshots on demand")
+	snapshotRetain := flag.Int("snapshot-retain", 3, "number of most recent flow store snapshots kept")
+	idempotencyWindow := flag.Duration("idempotency-window", flowd.DefaultIdempotencyWindow, "how long write responses are remembered by idempotency key and replayed to retries, 0 disables deduplication")
+	idempotencyEntries := flag.Int("idempotency-entries", flowd.DefaultIdempotencyEntries, "most write responses remembered by idempotency key, the oldest are forgotten first")
+	tenantsFile := flag.String("tenants-file", "", "JSON file of the tenants whose flow data is kept apart, with their limits. Without it every request belongs to the default tenant")
+	apiKeysFile := flag.String("api-keys-file", "", "JSON file of the SHA-256 digests of the bearer API keys accepted, requests are not authenticated without it or -jwks-file")
+	jwksFile := flag.String("jwks-file", "", "JWKS file of the public keys bearer JWTs are verified with, JWTs are not accepted when empty")
+	jwtIssuer := flag.String("jwt-issuer", "", "issuer required of the iss claim of JWTs, any issuer is accepted when empty")
+	jwtAudience := flag.String("jwt-audience", "", "audience required of the aud claim of JWTs, any audience is accepted when empty")
+	tlsCert := flag.String("tls-cert", "", "PEM file of the server TLS certificate, the server serves plain HTTP when empty")
+	tlsKey := flag.String("tls-key", "", "PEM file of the server TLS private key")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM bundle of the CAs client certificates are verified against, client certificates are not requested when empty")
+	tlsRequireClientCert := flag.Bool("tls-require-client-cert", false, "reject connections without a client certificate verified against -tls-client-ca")
+	tlsReloadInterval := flag.Duration("tls-reload-interval", flowd.DefaultTLSReloadInterval, "how often the TLS certificate, key and client CA bundle are reloaded when they change on disk, 0 disables reloading")
+	clientCertsFile := flag.String("client-certs-file", "", "JSON file mapping the names in client certificates to the tenants and VPCs of their holders, required to accept client certificates along with tenants, API keys or JWTs")
+	bindingsFile := flag.String("bindings-file", "", "JSON file of the roles, granting read, write and admin scopes, bound to the identities of callers. Without it every caller is granted every scope")
+	flag.Parse()
+
 	// TODO(sneha): make this configurable via a flag)
 	addr := ":8080"
 
@@ -36,7 +73,57 @@ func main() {
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
 
-	srv, err := flowd.NewServer(addr, reg, ll)
+	storeBackend, err := store.ParseBackend(*backend)
+	if err != nil {
+		log.Fatalf("invalid -backend: %v", err)
+	}
+
+	flowListVersion, err := store.ParseFlowListVersion(*flowList)
+	if err != nil {
+		log.Fatalf("invalid -flowlist: %v", err)
+	}
+
+	mode, err := store.ParseRetentionMode(*retentionMode)
+	if err != nil {
+		log.Fatalf("invalid -retention-mode: %v", err)
+	}
+
+	syncMode, err := store.ParseSyncMode(*walSync)
+	if err != nil {
+		log.Fatalf("invalid -wal-sync: %v", err)
+	}
+
+	opts := []store.Option{
+		store.WithBackend(storeBackend),
+		store.WithBoltPath(*boltPath),
+		store.WithFlowListVersion(flowListVersion),
+		store.WithGranularity(*granularity),
+		store.WithRetention(*retentionHours, mode),
+		store.WithPurgeInterval(*purgeInterval),
+		store.WithSealing(*sealOpenHours, *sealInterval),
+		store.WithShards(*shards),
+		store.WithWAL(*walDir, syncMode, *walSyncInterval),
+		store.WithSnapshots(*snapshotDir, *snapshotInterval, *snapshotRetain),
+	}
+	if *rollupDays >= 0 {
+		opts = append(opts, store.WithRollup(store.ResolutionDay, *rollupDays))
+	}
+	if *rollupWeeks >= 0 {
+		opts = append(opts, store.WithRollup(store.ResolutionWeek, *rollupWeeks))
+	}
+
+	srv, err := flowd.NewServer(addr, reg, ll,
+		flowd.WithStoreOptions(opts...),
+		flowd.WithIdempotencyWindow(*idempotencyWindow),
+		flowd.WithIdempotencyEntries(*idempotencyEntries),
+		flowd.WithTenantsFile(*tenantsFile),
+		flowd.WithAPIKeysFile(*apiKeysFile),
+		flowd.WithJWT(*jwksFile, *jwtIssuer, *jwtAudience),
+		flowd.WithTLS(*tlsCert, *tlsKey, *tlsClientCA, *tlsRequireClientCert),
+		flowd.WithTLSReloadInterval(*tlsReloadInterval),
+		flowd.WithClientCertsFile(*clientCertsFile),
+		flowd.WithBindingsFile(*bindingsFile),
+	)
 	if err != nil {
 		log.Fatalf("unable to create new flow server: %v", err)
 	}
@@ -0,0 +1,92 @@
+package flowd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/si74/flow-api/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+// SnapshotHandler serves the admin endpoint listing flow store snapshots and triggering new ones
+type SnapshotHandler struct {
+	ts *store.TenantStore
+	mm *Metrics
+	ll *logrus.Logger
+}
+
+func NewSnapshotHandler(ts *store.TenantStore, mm *Metrics, ll *logrus.Logger) *SnapshotHandler {
+	return &SnapshotHandler{
+		ts: ts,
+		mm: mm,
+		ll: ll,
+	}
+}
+
+// ServeHTTP lists the snapshots on disk for a GET and takes a new snapshot for a POST
+func (h *SnapshotHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ll := requestLogger(h.ll, r)
+	ll.Debug("incoming snapshot request")
+
+	start := time.Now()
+
+	if err := authorize(r, scopeAdmin); err != nil {
+		ll.Debugf("unauthorized snapshot request: %v", err)
+		h.respond(w, r, start, http.StatusForbidden, newProblem(http.StatusForbidden, err.Error()).body())
+		return
+	}
+
+	fs, err := tenantStore(h.ts, r)
+	if err != nil {
+		ll.Errorf("%v", err)
+		h.respond(w, r, start, http.StatusInternalServerError, newProblem(http.StatusInternalServerError, "unable to find the flow store of the tenant").body())
+		return
+	}
+
+	// Only some flow store backends support snapshots
+	sn, ok := fs.(store.Snapshotter)
+	if !ok {
+		ll.Debug("flow store does not support snapshots")
+		h.respond(w, r, start, http.StatusNotFound, newProblem(http.StatusNotFound, "the flow store does not support snapshots").body())
+		return
+	}
+
+	var out interface{}
+	switch r.Method {
+	case "GET":
+		out, err = sn.Snapshots()
+	case "POST":
+		out, err = sn.Snapshot()
+	default:
+		ll.Debugf("invalid request type %s", r.Method)
+		h.respond(w, r, start, http.StatusBadRequest, newProblem(http.StatusBadRequest, "snapshots are listed with GET and taken with POST").body())
+		return
+	}
+
+	if errors.Is(err, store.ErrNoSnapshots) {
+		ll.Debug("snapshots are not configured")
+		h.respond(w, r, start, http.StatusNotFound, newProblem(http.StatusNotFound, "snapshots are not configured").body())
+		return
+	}
+	if err != nil {
+		ll.Errorf("snapshot request failed: %v", err)
+		h.respond(w, r, start, http.StatusInternalServerError, newProblem(http.StatusInternalServerError, "snapshot request failed").body())
+		return
+	}
+
+	body, err := json.Marshal(out)
+	if err != nil {
+		ll.Debugf("unable to marshal snapshots: %v", err)
+		h.respond(w, r, start, http.StatusInternalServerError, newProblem(http.StatusInternalServerError, "unable to encode snapshots").body())
+		return
+	}
+	h.respond(w, r, start, http.StatusOK, body)
+}
+
+// respond records the request metrics and writes the status code and body
+func (h *SnapshotHandler) respond(w http.ResponseWriter, r *http.Request, start time.Time, status int, body []byte) {
+	h.mm.observe("snapshots", r, start, status)
+	writeBody(w, status, body)
+}
@@ -0,0 +1,87 @@
+package flowd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/si74/flow-api/internal/store"
+)
+
+// apiKeysFile lists the static API keys accepted by a server, read from a JSON file. Keys are only stored as
+// their SHA-256 digests, so the file does not hold the keys themselves.
+type apiKeysFile struct {
+	Keys []apiKeyConfig `json:"keys"`
+}
+
+// apiKeyConfig is an API key of a caller
+type apiKeyConfig struct {
+	// Name identifies the caller in logs and authorization
+	Name string `json:"name"`
+	// SHA256 is the hex encoded SHA-256 digest of the key
+	SHA256 string `json:"sha256"`
+	// Tenant is the tenant of the caller, the default tenant when empty
+	Tenant string `json:"tenant,omitempty"`
+	// VpcIDs restricts the caller to the flows of the VPCs matching any of the IDs or patterns when set
+	VpcIDs []string `json:"vpc_ids,omitempty"`
+}
+
+// apiKeys maps the digests of API keys to the identity of their callers
+type apiKeys map[[sha256.Size]byte]*identity
+
+// loadAPIKeys reads the API keys file at path
+func loadAPIKeys(path string) (apiKeys, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read API keys file: %w", err)
+	}
+	var file apiKeysFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("unable to parse API keys file %s: %w", path, err)
+	}
+
+	keys := apiKeys{}
+	names := map[string]bool{}
+	for _, kc := range file.Keys {
+		if kc.Name == "" {
+			return nil, fmt.Errorf("API keys file %s holds a key without a name", path)
+		}
+		if names[kc.Name] {
+			return nil, fmt.Errorf("API key %q is configured more than once", kc.Name)
+		}
+		names[kc.Name] = true
+
+		b, err := hex.DecodeString(kc.SHA256)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("API key %q does not have a hex encoded SHA-256 digest", kc.Name)
+		}
+		var digest [sha256.Size]byte
+		copy(digest[:], b)
+		if other, ok := keys[digest]; ok {
+			return nil, fmt.Errorf("API keys %q and %q are the same key", strings.TrimPrefix(other.Name, apiKeyIdentity), kc.Name)
+		}
+		id := &identity{Name: apiKeyIdentity + kc.Name, Tenant: kc.Tenant}
+		if kc.VpcIDs != nil {
+			if id.vpcs, err = store.ParseVPCScope(kc.VpcIDs); err != nil {
+				return nil, fmt.Errorf("API key %q: %w", kc.Name, err)
+			}
+		}
+		keys[digest] = id
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("API keys file %s holds no keys", path)
+	}
+	return keys, nil
+}
+
+// lookup returns the identity of the caller of an API key, or false if the key is unknown
+func (k apiKeys) lookup(key string) (*identity, bool) {
+	id, ok := k[sha256.Sum256([]byte(key))]
+	return id, ok
+}
@@ -0,0 +1,63 @@
+package flowd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/si74/flow-api/internal/store"
+)
+
+// keyDigest returns the hex encoded SHA-256 digest of an API key, as written in the API keys file
+func keyDigest(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func Test_LoadAPIKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		invalid bool
+	}{
+		{name: "keys", file: `{"keys":[{"name":"exporter","sha256":"` + keyDigest("secret") + `","tenant":"payments","vpc_ids":["team-a-*"]},{"name":"reader","sha256":"` + keyDigest("other") + `"}]}`},
+		{name: "no keys", file: `{"keys":[]}`, invalid: true},
+		{name: "no name", file: `{"keys":[{"sha256":"` + keyDigest("secret") + `"}]}`, invalid: true},
+		{name: "duplicate name", file: `{"keys":[{"name":"exporter","sha256":"` + keyDigest("secret") + `"},{"name":"exporter","sha256":"` + keyDigest("other") + `"}]}`, invalid: true},
+		{name: "duplicate key", file: `{"keys":[{"name":"exporter","sha256":"` + keyDigest("secret") + `"},{"name":"reader","sha256":"` + keyDigest("secret") + `"}]}`, invalid: true},
+		{name: "short digest", file: `{"keys":[{"name":"exporter","sha256":"abcd"}]}`, invalid: true},
+		{name: "plaintext key", file: `{"keys":[{"name":"exporter","sha256":"secret"}]}`, invalid: true},
+		{name: "empty VPC scope", file: `{"keys":[{"name":"exporter","sha256":"` + keyDigest("secret") + `","vpc_ids":[]}]}`, invalid: true},
+		{name: "unknown field", file: `{"keys":[{"name":"exporter","key":"secret"}]}`, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := loadAPIKeys(writeFile(t, "api_keys.json", tt.file))
+			if tt.invalid {
+				if err == nil {
+					t.Fatal("expected an error loading API keys")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error loading API keys: %v", err)
+			}
+
+			id, ok := keys.lookup("secret")
+			if !ok {
+				t.Fatal("expected the API key to be found")
+			}
+			expected := &identity{Name: "apikey:exporter", Tenant: "payments", vpcs: store.VPCScope{"team-a-*"}}
+			if diff := cmp.Diff(id, expected, cmp.AllowUnexported(identity{})); diff != "" {
+				t.Fatalf("unexpected identity: %v", diff)
+			}
+			for _, key := range []string{"", "Secret", "secret ", keyDigest("secret")} {
+				if _, ok := keys.lookup(key); ok {
+					t.Fatalf("expected API key %q to be unknown", key)
+				}
+			}
+		})
+	}
+}
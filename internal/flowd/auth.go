@@ -0,0 +1,194 @@
+package flowd
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/si74/flow-api/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+// The names of identities are prefixed by the type of their credential, so an API key, a token subject and a
+// client certificate sharing a name are different identities
+const (
+	apiKeyIdentity = "apikey:"
+	jwtIdentity    = "jwt:"
+	certIdentity   = "cert:"
+)
+
+// identity is the authenticated caller of a request
+type identity struct {
+	// Name identifies the caller, the name of its API key, the subject of its token or the name in its client
+	// certificate prefixed by the type of the credential. It is empty when the caller is anonymous.
+	Name string
+	// Tenant is the tenant whose flow data the caller reads and writes
+	Tenant string
+	// scopes are the scopes granted to the caller by its bindings
+	scopes scopes
+	// vpcs restricts the caller to the flows of some VPCs, nil allows every VPC
+	vpcs store.VPCScope
+}
+
+// identityContextKey is the request context key of the identity set by authenticator.wrap
+type identityContextKey struct{}
+
+// identityFrom returns the identity of a request context, nil if the request was not authenticated
+func identityFrom(ctx context.Context) *identity {
+	id, _ := ctx.Value(identityContextKey{}).(*identity)
+	return id
+}
+
+// tenantFrom returns the tenant of a request context, empty if the request was not authenticated
+func tenantFrom(ctx context.Context) string {
+	if id := identityFrom(ctx); id != nil {
+		return id.Tenant
+	}
+	return ""
+}
+
+// errNoCredentials is returned for requests without a bearer token
+var errNoCredentials = errors.New("request has no bearer token")
+
+// errUnknownClientCert is returned for requests with a verified client certificate whose name is not configured
+var errUnknownClientCert = errors.New("client certificate is not configured")
+
+// authenticator identifies the callers of requests by the bearer token they carry, either a static API key or
+// a JWT, or by their TLS client certificate. When no credentials are configured, requests without a client
+// certificate are anonymous and belong to the default tenant.
+type authenticator struct {
+	// keys are the static API keys accepted, nil when API keys are not configured
+	keys apiKeys
+	// jwt validates JWT bearer tokens, nil when JWTs are not configured
+	jwt *jwtVerifier
+	// certs map client certificates to the tenants and VPCs of their holders. When nil, the holders of every
+	// verified client certificate belong to the default tenant and see every VPC.
+	certs clientCerts
+	// bindings grant scopes to identities, every identity is granted every scope when nil
+	bindings bindings
+	ts       *store.TenantStore
+	mm       *Metrics
+	ll       *logrus.Logger
+	// now returns the time tokens are validated at
+	now func() time.Time
+}
+
+// enabled reports whether requests must carry credentials, a bearer token or a client certificate
+func (a *authenticator) enabled() bool {
+	return a.keys != nil || a.jwt != nil || a.certs != nil
+}
+
+// wrap authenticates every request before passing it on to next with its identity in its context. Requests
+// without valid credentials are rejected with a 401 and a WWW-Authenticate challenge, and requests for a
+// tenant that does not exist with a 403, counted as requests of the given type.
+func (a *authenticator) wrap(typ string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id, err := a.authenticate(r)
+		if err != nil {
+			requestLogger(a.ll, r).Debugf("unauthenticated %s request: %v", typ, err)
+			// Following RFC 6750, requests without credentials are not told of an error
+			challenge := `Bearer realm="flowd"`
+			if !errors.Is(err, errNoCredentials) && !errors.Is(err, errUnknownClientCert) {
+				challenge += `, error="invalid_token"`
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			a.mm.observe(typ, r, start, http.StatusUnauthorized)
+			writeBody(w, http.StatusUnauthorized, newProblem(http.StatusUnauthorized, "a valid API key or bearer token is required").body())
+			return
+		}
+
+		if _, ok := a.ts.Tenant(id.Tenant); !ok {
+			requestLogger(a.ll, r).Debugf("%s request by %s for unknown tenant %q", typ, id.Name, id.Tenant)
+			a.mm.observe(typ, r, start, http.StatusForbidden)
+			writeBody(w, http.StatusForbidden, newProblem(http.StatusForbidden, fmt.Sprintf("tenant %q does not exist", id.Tenant)).body())
+			return
+		}
+
+		id.scopes = allScopes
+		if a.bindings != nil {
+			id.scopes = a.bindings[id.Name]
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, id)))
+	})
+}
+
+// authenticate returns the identity of the caller of a request. Bearer tokens shaped like a JWT are validated
+// as one when JWTs are configured, other tokens are looked up as API keys. Requests without a bearer token are
+// identified by their verified client certificate, if any.
+func (a *authenticator) authenticate(r *http.Request) (*identity, error) {
+	auth := r.Header.Get("Authorization")
+	if (a.keys != nil || a.jwt != nil) && strings.HasPrefix(auth, "Bearer ") {
+		return a.authenticateToken(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if cert := peerCertificate(r); cert != nil {
+		return a.authenticateCert(cert)
+	}
+	if !a.enabled() {
+		return &identity{Tenant: store.DefaultTenant}, nil
+	}
+	return nil, errNoCredentials
+}
+
+// authenticateToken returns the identity of the caller of a bearer token
+func (a *authenticator) authenticateToken(token string) (*identity, error) {
+	var id *identity
+	switch {
+	case a.jwt != nil && strings.Count(token, ".") == 2:
+		claims, err := a.jwt.verify(token, a.now())
+		if err != nil {
+			return nil, err
+		}
+		id = &identity{Name: jwtIdentity + claims.Subject, Tenant: claims.Tenant}
+		if claims.VpcIDs != nil {
+			if id.vpcs, err = store.ParseVPCScope(claims.VpcIDs); err != nil {
+				return nil, fmt.Errorf("invalid token vpc_ids claim: %w", err)
+			}
+		}
+	case a.keys != nil:
+		key, ok := a.keys.lookup(token)
+		if !ok {
+			return nil, errors.New("unknown API key")
+		}
+		copied := *key
+		id = &copied
+	default:
+		return nil, errors.New("bearer token is not a JWT")
+	}
+
+	if id.Tenant == "" {
+		id.Tenant = store.DefaultTenant
+	}
+	return id, nil
+}
+
+// authenticateCert returns the identity of the holder of a verified client certificate
+func (a *authenticator) authenticateCert(cert *x509.Certificate) (*identity, error) {
+	// Without a client certificates file no other credentials are configured, so certificates are not bound to
+	// tenants or VPCs
+	if a.certs == nil {
+		return &identity{Name: certIdentity + certName(cert), Tenant: store.DefaultTenant}, nil
+	}
+	id, ok := a.certs.lookup(cert)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", errUnknownClientCert, certName(cert))
+	}
+	copied := *id
+	if copied.Tenant == "" {
+		copied.Tenant = store.DefaultTenant
+	}
+	return &copied, nil
+}
+
+// requestLogger returns a logger of a request recording its source and the identity of its caller
+func requestLogger(ll *logrus.Logger, r *http.Request) *logrus.Entry {
+	entry := ll.WithField("src", r.RemoteAddr)
+	if id := identityFrom(r.Context()); id != nil && id.Name != "" {
+		entry = entry.WithField("identity", id.Name)
+	}
+	return entry
+}
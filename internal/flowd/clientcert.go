@@ -0,0 +1,72 @@
+package flowd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/si74/flow-api/internal/store"
+)
+
+// clientCertsFile maps the names in client certificates to the tenants and VPCs of their holders, read from a
+// JSON file
+type clientCertsFile struct {
+	Certs []clientCertConfig `json:"certs"`
+}
+
+// clientCertConfig is the holder of a client certificate
+type clientCertConfig struct {
+	// Name is the name identifying the holder in its certificate: its first DNS, URI or email subject
+	// alternative name, or else its subject common name
+	Name string `json:"name"`
+	// Tenant is the tenant of the holder, the default tenant when empty
+	Tenant string `json:"tenant,omitempty"`
+	// VpcIDs restricts the holder to the flows of the VPCs matching any of the IDs or patterns when set
+	VpcIDs []string `json:"vpc_ids,omitempty"`
+}
+
+// clientCerts maps the names in client certificates to the identity of their holders
+type clientCerts map[string]*identity
+
+// loadClientCerts reads the client certificates file at path
+func loadClientCerts(path string) (clientCerts, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client certificates file: %w", err)
+	}
+	var file clientCertsFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("unable to parse client certificates file %s: %w", path, err)
+	}
+
+	certs := clientCerts{}
+	for _, cc := range file.Certs {
+		if cc.Name == "" {
+			return nil, fmt.Errorf("client certificates file %s holds a certificate without a name", path)
+		}
+		if _, ok := certs[cc.Name]; ok {
+			return nil, fmt.Errorf("client certificate %q is configured more than once", cc.Name)
+		}
+		id := &identity{Name: certIdentity + cc.Name, Tenant: cc.Tenant}
+		if cc.VpcIDs != nil {
+			if id.vpcs, err = store.ParseVPCScope(cc.VpcIDs); err != nil {
+				return nil, fmt.Errorf("client certificate %q: %w", cc.Name, err)
+			}
+		}
+		certs[cc.Name] = id
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("client certificates file %s holds no certificates", path)
+	}
+	return certs, nil
+}
+
+// lookup returns the identity of the holder of a client certificate, or false if its name is not configured
+func (c clientCerts) lookup(cert *x509.Certificate) (*identity, bool) {
+	id, ok := c[certName(cert)]
+	return id, ok
+}
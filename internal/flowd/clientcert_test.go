@@ -0,0 +1,96 @@
+package flowd
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func Test_LoadClientCerts(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		invalid bool
+	}{
+		{name: "certificates", file: `{"certs":[{"name":"collector.example.com","tenant":"payments","vpc_ids":["team-a-*"]},{"name":"reader"}]}`},
+		{name: "no certificates", file: `{"certs":[]}`, invalid: true},
+		{name: "no name", file: `{"certs":[{"tenant":"payments"}]}`, invalid: true},
+		{name: "duplicate name", file: `{"certs":[{"name":"reader"},{"name":"reader"}]}`, invalid: true},
+		{name: "empty VPC scope", file: `{"certs":[{"name":"reader","vpc_ids":[]}]}`, invalid: true},
+		{name: "unknown field", file: `{"certs":[{"name":"reader","scopes":["read"]}]}`, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadClientCerts(writeFile(t, "client_certs.json", tt.file))
+			if tt.invalid && err == nil {
+				t.Fatal("expected an error loading client certificates")
+			}
+			if !tt.invalid && err != nil {
+				t.Fatalf("unexpected error loading client certificates: %v", err)
+			}
+		})
+	}
+}
+
+func Test_ClientCertScope(t *testing.T) {
+	certFile, keyFile, caFile, ca := serverTLSFiles(t)
+	apiKeys := writeFile(t, "api_keys.json", `{"keys":[{"name":"grafana","sha256":"`+keyDigest("secret")+`","vpc_ids":["team-a-*"]}]}`)
+
+	// Certificates are not accepted along with other credentials unless they are mapped to tenants and VPCs
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+	if _, err := NewServer(":0", prometheus.NewPedanticRegistry(), ll, WithTLS(certFile, keyFile, caFile, false), WithAPIKeysFile(apiKeys)); err == nil {
+		t.Fatal("expected an error accepting unmapped client certificates along with API keys")
+	}
+
+	s := newTestServer(t,
+		WithTLS(certFile, keyFile, caFile, false),
+		WithAPIKeysFile(apiKeys),
+		WithClientCertsFile(writeFile(t, "client_certs.json", `{"certs":[{"name":"collector.example.com","vpc_ids":["team-a-*"]}]}`)),
+	)
+	ts := startTLS(t, s)
+	collector := tlsClient(t, ca, &x509.Certificate{DNSNames: []string{"collector.example.com"}}, ca)
+
+	post := func(client *http.Client, vpc string) int {
+		resp, err := client.Post(ts.URL+"/flows", "application/json", strings.NewReader(`[{"src_app":"foo","dest_app":"bar","vpc_id":"`+vpc+`","bytes_tx":1,"hour":1}]`))
+		if err != nil {
+			t.Fatalf("unexpected error sending request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post(collector, "team-a-1"); status != http.StatusOK {
+		t.Fatalf("expected a write within the VPCs of the certificate to succeed, got %d", status)
+	}
+	if status := post(collector, "team-b-1"); status != http.StatusForbidden {
+		t.Fatalf("expected a write outside the VPCs of the certificate to be forbidden, got %d", status)
+	}
+
+	// A best effort write holding records outside the VPCs of the caller inserts none of its records
+	h, bearer := s.handler(), http.Header{"Authorization": {"Bearer secret"}}
+	mixed := `[{"src_app":"foo","dest_app":"bar","vpc_id":"team-a-2","bytes_tx":1,"hour":1},{"src_app":"foo","dest_app":"bar","vpc_id":"team-b-1","bytes_tx":1,"hour":1}]`
+	w := serve(h, "POST", "/flows?mode=best_effort", mixed, bearer)
+	p := decodeProblem(t, w)
+	if w.Code != http.StatusForbidden || p.Accepted != 0 || len(p.Errors) != 1 || p.Errors[0].Index != 1 || p.Errors[0].Reason != reasonVPCForbidden {
+		t.Fatalf("expected a best effort write outside the VPCs of the caller to be forbidden, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(h, "GET", "/flows?hour=1&vpc_id=team-a-2", "", bearer); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("expected no flows of a forbidden write to be inserted, got %d: %s", w.Code, w.Body)
+	}
+
+	for name, client := range map[string]*http.Client{
+		"unknown certificate": tlsClient(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "stranger"}}, ca),
+		"no certificate":      tlsClient(t, ca, nil, nil),
+	} {
+		if status := post(client, "team-a-1"); status != http.StatusUnauthorized {
+			t.Fatalf("expected a write with %s to be unauthorized, got %d", name, status)
+		}
+	}
+}
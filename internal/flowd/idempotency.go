@@ -0,0 +1,92 @@
+package flowd
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// idempotencyCache remembers the responses of writes by idempotency key for a window, so a retried write is
+// answered with the response of the original rather than applied again. It holds at most max writes, the oldest
+// are forgotten first when it is full.
+type idempotencyCache struct {
+	window time.Duration
+	max    int
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order holds the writes in the order they began, and so in the order they expire
+	order *list.List
+}
+
+// idempotentWrite is a write remembered by its idempotency key
+type idempotentWrite struct {
+	key string
+	// digest identifies the request, so a key reused for a different request is detected
+	digest  [sha256.Size]byte
+	expires time.Time
+	// done is closed once the response is recorded
+	done   chan struct{}
+	status int
+	body   []byte
+}
+
+func newIdempotencyCache(window time.Duration, max int) *idempotencyCache {
+	return &idempotencyCache{
+		window:  window,
+		max:     max,
+		now:     time.Now,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// begin returns the write remembered for a key and true, or starts a write for the key and returns it with
+// false. The caller must finish a write it started. A remembered write may still be in flight, its response is
+// ready once done is closed.
+func (c *idempotencyCache) begin(key string, digest [sha256.Size]byte) (*idempotentWrite, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		iw := e.Value.(*idempotentWrite)
+		if iw.expires.After(now) {
+			break
+		}
+		c.remove(e)
+	}
+
+	if e, ok := c.entries[key]; ok {
+		return e.Value.(*idempotentWrite), true
+	}
+	for c.order.Len() >= c.max {
+		c.remove(c.order.Front())
+	}
+	iw := &idempotentWrite{
+		key:     key,
+		digest:  digest,
+		expires: now.Add(c.window),
+		done:    make(chan struct{}),
+	}
+	c.entries[key] = c.order.PushBack(iw)
+	return iw, false
+}
+
+// finish records the response of a write. Responses to server errors are forgotten so the write can be retried.
+func (c *idempotencyCache) finish(iw *idempotentWrite, status int, body []byte) {
+	c.mu.Lock()
+	iw.status, iw.body = status, body
+	if e, ok := c.entries[iw.key]; ok && status >= 500 && e.Value == iw {
+		c.remove(e)
+	}
+	c.mu.Unlock()
+	close(iw.done)
+}
+
+func (c *idempotencyCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*idempotentWrite).key)
+}
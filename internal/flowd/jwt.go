@@ -0,0 +1,318 @@
+package flowd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the clock skew allowed when checking the expiry and not before times of tokens
+const jwtLeeway = time.Minute
+
+// jwk is a JSON web key of a JWKS file. Only RSA and EC public keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// N and E are the modulus and exponent of an RSA key
+	N string `json:"n"`
+	E string `json:"e"`
+	// Crv, X and Y are the curve and coordinates of an EC key
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verificationKey is a public key tokens are signed with
+type verificationKey struct {
+	kid string
+	// alg restricts the key to an algorithm, empty allows any algorithm of the key type
+	alg string
+	key crypto.PublicKey
+}
+
+// jwtVerifier validates JWT bearer tokens signed with the keys of a local JWKS file
+type jwtVerifier struct {
+	keys []verificationKey
+	// issuer and audience are required of the iss and aud claims when set
+	issuer   string
+	audience string
+}
+
+// loadJWKS reads the public keys of the JWKS file at path
+func loadJWKS(path, issuer, audience string) (*jwtVerifier, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read JWKS file: %w", err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("unable to parse JWKS file %s: %w", path, err)
+	}
+
+	v := &jwtVerifier{issuer: issuer, audience: audience}
+	for i, k := range set.Keys {
+		// Keys for encryption are not used to verify signatures
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS file %s key %d: %w", path, i, err)
+		}
+		v.keys = append(v.keys, verificationKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("JWKS file %s holds no signing keys", path)
+	}
+	return v, nil
+}
+
+// publicKey decodes the public key of a JWK
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent %q", k.E)
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key of %d bits is shorter than 2048 bits", n.BitLen())
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported EC curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC x coordinate: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC y coordinate: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// jwtClaims are the claims of a token used by flowd
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+	// Tenant is the tenant of the caller, the default tenant when empty
+	Tenant string `json:"tenant"`
+	// VpcIDs restricts the caller to the flows of the VPCs matching any of the IDs or patterns when set
+	VpcIDs []string `json:"vpc_ids"`
+}
+
+// audience is the aud claim, either a single string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return errors.New("aud is not a string or an array of strings")
+	}
+	*a = ss
+	return nil
+}
+
+// verify checks the signature and claims of a compact serialized token, returning its claims. Tokens must be
+// signed with RS256, RS384, RS512, ES256, ES384 or ES512 by a key of the JWKS, name a subject and expire.
+func (v *jwtVerifier) verify(token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a signed JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature encoding: %w", err)
+	}
+
+	key, err := v.key(header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(key, header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("token does not expire")
+	}
+	if now.After(unixTime(*claims.ExpiresAt).Add(jwtLeeway)) {
+		return nil, errors.New("token has expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(unixTime(*claims.NotBefore)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("token issuer %q is not %q", claims.Issuer, v.issuer)
+	}
+	if v.audience != "" && !claims.Audience.has(v.audience) {
+		return nil, fmt.Errorf("token audience %v does not include %q", []string(claims.Audience), v.audience)
+	}
+	return &claims, nil
+}
+
+func (a audience) has(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the key of the JWKS a token was signed with, by key ID. Tokens without a key ID can only be
+// verified when the JWKS holds a single key.
+func (v *jwtVerifier) key(kid, alg string) (verificationKey, error) {
+	var found []verificationKey
+	for _, k := range v.keys {
+		if k.kid == kid || kid == "" {
+			found = append(found, k)
+		}
+	}
+	if len(found) != 1 {
+		return verificationKey{}, fmt.Errorf("no single key in the JWKS for key ID %q", kid)
+	}
+	if found[0].alg != "" && found[0].alg != alg {
+		return verificationKey{}, fmt.Errorf("token algorithm %q does not match the key algorithm %q", alg, found[0].alg)
+	}
+	return found[0], nil
+}
+
+// verifySignature checks the signature of the signing input of a token with the algorithm named in its header
+func verifySignature(key verificationKey, alg, input string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(input))
+	digest := h.Sum(nil)
+
+	switch pub := key.key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("token algorithm %q cannot be verified with an RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, sig); err != nil {
+			return errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		// Each curve is used with a single algorithm
+		var curveAlg string
+		switch pub.Curve {
+		case elliptic.P256():
+			curveAlg = "ES256"
+		case elliptic.P384():
+			curveAlg = "ES384"
+		case elliptic.P521():
+			curveAlg = "ES512"
+		}
+		if alg != curveAlg {
+			return fmt.Errorf("token algorithm %q cannot be verified with a %s key", alg, pub.Curve.Params().Name)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+	default:
+		return errors.New("unsupported verification key")
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// unixTime converts a NumericDate claim into a time
+func unixTime(secs float64) time.Time {
+	whole := int64(secs)
+	return time.Unix(whole, int64((secs-float64(whole))*float64(time.Second)))
+}
@@ -0,0 +1,245 @@
+package flowd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publicJWK returns the JWK of a public key
+func publicJWK(kid, alg string, pub crypto.PublicKey) jwk {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return jwk{Kty: "RSA", Kid: kid, Alg: alg, N: enc(pub.N.Bytes()), E: enc(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return jwk{Kty: "EC", Kid: kid, Alg: alg, Crv: pub.Curve.Params().Name, X: enc(pub.X.FillBytes(make([]byte, size))), Y: enc(pub.Y.FillBytes(make([]byte, size)))}
+	default:
+		panic("unsupported public key")
+	}
+}
+
+// writeJWKS writes a JWKS file of keys and returns its path
+func writeJWKS(t *testing.T, keys ...jwk) string {
+	t.Helper()
+
+	b, err := json.Marshal(map[string][]jwk{"keys": keys})
+	if err != nil {
+		t.Fatalf("unable to encode JWKS: %v", err)
+	}
+	return writeFile(t, "jwks.json", string(b))
+}
+
+// signJWT returns a compact serialized token of claims signed with a private key, naming the algorithm alg and
+// key ID kid in its header
+func signJWT(t *testing.T, kid, alg string, priv crypto.Signer, claims interface{}) string {
+	t.Helper()
+
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	segment := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("unable to encode token segment: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	input := segment(header) + "." + segment(claims)
+
+	hash := crypto.SHA256
+	switch alg[2:] {
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	h := hash.New()
+	h.Write([]byte(input))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, priv, hash, digest)
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, priv, digest)
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+	if err != nil {
+		t.Fatalf("unable to sign token: %v", err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// generateKeys returns an RSA, a P-256 and a P-384 private key
+func generateKeys(t *testing.T) (*rsa.PrivateKey, *ecdsa.PrivateKey, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate RSA key: %v", err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate EC key: %v", err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate EC key: %v", err)
+	}
+	return rsaKey, p256, p384
+}
+
+func Test_JWTVerify(t *testing.T) {
+	rsaKey, p256, p384 := generateKeys(t)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate EC key: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	v, err := loadJWKS(writeJWKS(t,
+		publicJWK("rsa", "", &rsaKey.PublicKey),
+		publicJWK("rs384", "RS384", &rsaKey.PublicKey),
+		publicJWK("p256", "", &p256.PublicKey),
+		publicJWK("p384", "ES384", &p384.PublicKey),
+	), "https://sso.example.com", "flowd")
+	if err != nil {
+		t.Fatalf("unexpected error loading JWKS: %v", err)
+	}
+
+	// claims returns valid claims with the given overrides
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":    "exporter",
+			"iss":    "https://sso.example.com",
+			"aud":    "flowd",
+			"exp":    now.Add(time.Hour).Unix(),
+			"tenant": "payments",
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+	valid := claims(nil)
+
+	tests := []struct {
+		name    string
+		token   string
+		invalid bool
+	}{
+		{name: "RS256", token: signJWT(t, "rsa", "RS256", rsaKey, valid)},
+		{name: "RS512", token: signJWT(t, "rsa", "RS512", rsaKey, valid)},
+		{name: "ES256", token: signJWT(t, "p256", "ES256", p256, valid)},
+		{name: "ES384", token: signJWT(t, "p384", "ES384", p384, valid)},
+		{name: "audience list", token: signJWT(t, "rsa", "RS256", rsaKey, claims(map[string]interface{}{"aud": []string{"other", "flowd"}}))},
+		{name: "expired within leeway", token: signJWT(t, "rsa", "RS256", rsaKey, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}))},
+		{name: "expired", token: signJWT(t, "rsa", "RS256", rsaKey, claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})), invalid: true},
+		{name: "no expiry", token: signJWT(t, "rsa", "RS256", rsaKey, claims(map[string]interface{}{"exp": nil})), invalid: true},
+		{name: "not before within leeway", token: signJWT(t, "rsa", "RS256", rsaKey, claims(map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()}))},
+		{name: "not yet valid", token: signJWT(t, "rsa", "RS256", rsaKey, claims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()})), invalid: true},
+		{name: "no subject", token: signJWT(t, "rsa", "RS256", rsaKey, claims(map[string]interface{}{"sub": nil})), invalid: true},
+		{name: "wrong issuer", token: signJWT(t, "rsa", "RS256", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})), invalid: true},
+		{name: "no issuer", token: signJWT(t, "rsa", "RS256", rsaKey, claims(map[string]interface{}{"iss": nil})), invalid: true},
+		{name: "wrong audience", token: signJWT(t, "rsa", "RS256", rsaKey, claims(map[string]interface{}{"aud": []string{"other"}})), invalid: true},
+		// An RS algorithm names the key type as well as the hash, so it is never verified with an EC key
+		{name: "RS alg on EC key", token: signJWT(t, "p256", "RS256", rsaKey, valid), invalid: true},
+		{name: "ES alg on RSA key", token: signJWT(t, "rsa", "ES256", p256, valid), invalid: true},
+		{name: "ES alg of another curve", token: signJWT(t, "p256", "ES384", p256, valid), invalid: true},
+		{name: "alg not allowed by key", token: signJWT(t, "rs384", "RS256", rsaKey, valid), invalid: true},
+		{name: "unsupported alg", token: signJWT(t, "rsa", "PS256", rsaKey, valid), invalid: true},
+		{name: "signed by another key", token: signJWT(t, "p256", "ES256", other, valid), invalid: true},
+		{name: "unknown key ID", token: signJWT(t, "other", "RS256", rsaKey, valid), invalid: true},
+		{name: "no key ID with several keys", token: signJWT(t, "", "RS256", rsaKey, valid), invalid: true},
+		{name: "short ES signature", token: truncateSignature(signJWT(t, "p256", "ES256", p256, valid), 1), invalid: true},
+		{name: "long ES signature", token: signJWT(t, "p256", "ES256", p256, valid) + "AA", invalid: true},
+		{name: "tampered claims", token: tamper(signJWT(t, "rsa", "RS256", rsaKey, valid), claims(map[string]interface{}{"tenant": "search"})), invalid: true},
+		{name: "not a JWT", token: "foo.bar", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := v.verify(tt.token, now)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("expected an error verifying token, got claims %+v", c)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error verifying token: %v", err)
+			}
+			if c.Subject != "exporter" || c.Tenant != "payments" {
+				t.Fatalf("unexpected claims %+v", c)
+			}
+		})
+	}
+}
+
+// truncateSignature removes n bytes from the end of the signature of a token
+func truncateSignature(token string, n int) string {
+	i := strings.LastIndex(token, ".")
+	sig, _ := base64.RawURLEncoding.DecodeString(token[i+1:])
+	return token[:i+1] + base64.RawURLEncoding.EncodeToString(sig[:len(sig)-n])
+}
+
+// tamper replaces the claims of a token, keeping its header and signature
+func tamper(token string, claims interface{}) string {
+	parts := strings.Split(token, ".")
+	b, _ := json.Marshal(claims)
+	parts[1] = base64.RawURLEncoding.EncodeToString(b)
+	return strings.Join(parts, ".")
+}
+
+func Test_LoadJWKS(t *testing.T) {
+	rsaKey, p256, _ := generateKeys(t)
+	short, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unable to generate RSA key: %v", err)
+	}
+	offCurve := publicJWK("p256", "", &p256.PublicKey)
+	offCurve.Y = offCurve.X
+
+	tests := []struct {
+		name    string
+		keys    []jwk
+		invalid bool
+	}{
+		{name: "keys", keys: []jwk{publicJWK("rsa", "", &rsaKey.PublicKey), publicJWK("p256", "", &p256.PublicKey)}},
+		{name: "no keys", invalid: true},
+		{name: "encryption keys only", keys: []jwk{func() jwk { k := publicJWK("rsa", "", &rsaKey.PublicKey); k.Use = "enc"; return k }()}, invalid: true},
+		{name: "short RSA key", keys: []jwk{publicJWK("rsa", "", &short.PublicKey)}, invalid: true},
+		{name: "point off the curve", keys: []jwk{offCurve}, invalid: true},
+		{name: "unsupported key type", keys: []jwk{{Kty: "oct", Kid: "hmac"}}, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadJWKS(writeJWKS(t, tt.keys...), "", "")
+			if tt.invalid && err == nil {
+				t.Fatal("expected an error loading JWKS")
+			}
+			if !tt.invalid && err != nil {
+				t.Fatalf("unexpected error loading JWKS: %v", err)
+			}
+		})
+	}
+}
@@ -1,10 +1,20 @@
 package flowd
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 type Metrics struct {
 	requests        *prometheus.CounterVec
 	requestDuration *prometheus.HistogramVec
+	// rejected counts the flows rejected by writes, by reason
+	rejected *prometheus.CounterVec
+	// idempotencyHits counts the writes answered with the response of an earlier write
+	idempotencyHits *prometheus.CounterVec
 }
 
 func NewMetrics(reg *prometheus.Registry) *Metrics {
@@ -15,7 +25,7 @@ func NewMetrics(reg *prometheus.Registry) *Metrics {
 				Name:      "http_requests_total",
 				Help:      "Flow http requests total",
 			},
-			[]string{"type", "method", "status_code"},
+			[]string{"type", "method", "status_code", "tenant"},
 		),
 		requestDuration: prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
@@ -25,12 +35,38 @@ func NewMetrics(reg *prometheus.Registry) *Metrics {
 				// Note(sneha): Not defining histogram buckets but
 				// using default values here.
 			},
-			[]string{"type", "method", "status_code"},
+			[]string{"type", "method", "status_code", "tenant"},
+		),
+		rejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "flowd",
+				Name:      "flows_rejected_total",
+				Help:      "Flows rejected by writes by reason",
+			},
+			[]string{"reason", "tenant"},
+		),
+		idempotencyHits: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "flowd",
+				Name:      "idempotency_hits_total",
+				Help:      "Writes answered with the response of an earlier write with the same idempotency key",
+			},
+			[]string{"tenant"},
 		),
 	}
 
 	reg.MustRegister(metrics.requests)
 	reg.MustRegister(metrics.requestDuration)
+	reg.MustRegister(metrics.rejected)
+	reg.MustRegister(metrics.idempotencyHits)
 
 	return metrics
 }
+
+// observe records the count and duration of a request of a type by its status code and the tenant it
+// belongs to, empty if it was not authenticated
+func (mm *Metrics) observe(typ string, r *http.Request, start time.Time, status int) {
+	labels := []string{typ, r.Method, strconv.Itoa(status), tenantFrom(r.Context())}
+	mm.requests.WithLabelValues(labels...).Inc()
+	mm.requestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,145 @@
+package flowd
+
+import (
+	"time"
+
+	"github.com/si74/flow-api/internal/store"
+)
+
+// DefaultIdempotencyWindow is how long the responses of writes are remembered by idempotency key by default
+const DefaultIdempotencyWindow = time.Hour
+
+// DefaultIdempotencyEntries is the number of write responses remembered by idempotency key by default
+const DefaultIdempotencyEntries = 100000
+
+type config struct {
+	// storeOpts configure the flow store backing the server
+	storeOpts []store.Option
+	// idempotencyWindow is how long write responses are remembered by idempotency key, 0 disables
+	// deduplication
+	idempotencyWindow time.Duration
+	// idempotencyEntries is the most write responses remembered, the oldest are forgotten first
+	idempotencyEntries int
+	// tenantsFile configures the tenants of the server. Without it only the default tenant exists.
+	tenantsFile string
+	// apiKeysFile lists the hashed API keys accepted, API keys are not accepted when empty
+	apiKeysFile string
+	// jwksFile holds the keys JWT bearer tokens are verified with, JWTs are not accepted when empty
+	jwksFile string
+	// jwtIssuer and jwtAudience are required of the iss and aud claims of JWTs when set
+	jwtIssuer   string
+	jwtAudience string
+	// tlsCertFile and tlsKeyFile are the server certificate and key, the server serves plain HTTP when empty
+	tlsCertFile string
+	tlsKeyFile  string
+	// tlsClientCAFile is the bundle of CAs client certificates are verified against, client certificates are
+	// not requested when empty
+	tlsClientCAFile string
+	// tlsRequireClientCert rejects connections without a client certificate
+	tlsRequireClientCert bool
+	// tlsReloadInterval is how often the TLS files are checked for changes, 0 disables reloading
+	tlsReloadInterval time.Duration
+	// clientCertsFile maps client certificates to tenants and VPCs, every certificate belongs to the default
+	// tenant and sees every VPC when empty
+	clientCertsFile string
+	// bindingsFile grants scopes to the identities of callers, every caller is granted every scope when empty
+	bindingsFile string
+}
+
+func defaultConfig() config {
+	return config{
+		idempotencyWindow:  DefaultIdempotencyWindow,
+		idempotencyEntries: DefaultIdempotencyEntries,
+		tlsReloadInterval:  DefaultTLSReloadInterval,
+	}
+}
+
+// Option configures a flowd server
+type Option func(*config)
+
+// WithStoreOptions configures the flow store backing the server
+func WithStoreOptions(opts ...store.Option) Option {
+	return func(c *config) {
+		c.storeOpts = append(c.storeOpts, opts...)
+	}
+}
+
+// WithIdempotencyWindow sets how long the response of a write carrying an idempotency key is remembered and
+// replayed to retries instead of applying them again. A window of 0 disables deduplication.
+func WithIdempotencyWindow(window time.Duration) Option {
+	return func(c *config) {
+		c.idempotencyWindow = window
+	}
+}
+
+// WithIdempotencyEntries sets the most write responses remembered by idempotency key. Once it is reached the
+// oldest responses are forgotten before their window ends, so retries of them are applied again.
+func WithIdempotencyEntries(n int) Option {
+	return func(c *config) {
+		c.idempotencyEntries = n
+	}
+}
+
+// WithTenantsFile reads the tenants of the server from a JSON file. Each tenant's flow data is kept apart from
+// the others', and requests only see the flow data of the tenant of their credentials, so authentication must
+// be configured along with tenants.
+func WithTenantsFile(path string) Option {
+	return func(c *config) {
+		c.tenantsFile = path
+	}
+}
+
+// WithAPIKeysFile authenticates requests carrying a bearer API key listed by its SHA-256 digest in a JSON file
+func WithAPIKeysFile(path string) Option {
+	return func(c *config) {
+		c.apiKeysFile = path
+	}
+}
+
+// WithJWT authenticates requests carrying a bearer JWT signed by a key of the JWKS file at jwksFile. When issuer
+// or audience are set, tokens must also carry them in their iss and aud claims.
+func WithJWT(jwksFile, issuer, audience string) Option {
+	return func(c *config) {
+		c.jwksFile = jwksFile
+		c.jwtIssuer = issuer
+		c.jwtAudience = audience
+	}
+}
+
+// WithTLS serves HTTPS with the certificate and key in the PEM files certFile and keyFile. When clientCAFile is
+// set, client certificates are verified against the CAs it holds and identify the callers not presenting a
+// bearer token, and requireClientCert rejects connections without one.
+func WithTLS(certFile, keyFile, clientCAFile string, requireClientCert bool) Option {
+	return func(c *config) {
+		c.tlsCertFile = certFile
+		c.tlsKeyFile = keyFile
+		c.tlsClientCAFile = clientCAFile
+		c.tlsRequireClientCert = requireClientCert
+	}
+}
+
+// WithTLSReloadInterval sets how often the TLS certificate, key and client CA bundle are checked for changes
+// and reloaded, so rotated certificates are served without a restart. An interval of 0 disables reloading.
+func WithTLSReloadInterval(interval time.Duration) Option {
+	return func(c *config) {
+		c.tlsReloadInterval = interval
+	}
+}
+
+// WithClientCertsFile maps the names in client certificates to the tenants and VPCs of their holders from a JSON
+// file. Certificates whose name is not listed are rejected. It is required to accept client certificates along
+// with tenants, API keys or JWTs, so certificates cannot bypass the tenants and VPCs of other credentials.
+func WithClientCertsFile(path string) Option {
+	return func(c *config) {
+		c.clientCertsFile = path
+	}
+}
+
+// WithBindingsFile authorizes requests with the roles bound to the identity of their caller in a JSON file.
+// Reading flows requires the read scope, writing flows the write scope, and the admin and metrics endpoints the
+// admin scope. Callers are denied with a 403. Without bindings every caller is granted every scope.
+func WithBindingsFile(path string) Option {
+	return func(c *config) {
+		c.bindingsFile = path
+	}
+}
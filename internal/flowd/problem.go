@@ -0,0 +1,77 @@
+package flowd
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// problem is an RFC 7807 problem details body, returned with every error response
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// writeResult extends the problems of writes with the records accepted and rejected
+	*writeResult
+}
+
+// writeResult reports the records of a write that were accepted and rejected
+type writeResult struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Errors   []recordError `json:"errors,omitempty"`
+}
+
+// Invalid records are rejected with the store.InvalidReason of their validation error, other rejected records
+// with one of these reasons
+const (
+	// reasonTupleLimit is the reason of records that would exceed the flow tuple limit of the tenant
+	reasonTupleLimit = "tuple_limit"
+	// reasonVPCForbidden is the reason of records of a VPC outside the scope of the caller's credential
+	reasonVPCForbidden = "vpc_forbidden"
+)
+
+// recordError describes why a record of a write was rejected
+type recordError struct {
+	// Index is the position of the record in the written array
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+	Detail string `json:"detail"`
+}
+
+// newProblem returns a problem for a status code. Problems are not given a type URI, so they are identified
+// by their status code alone.
+func newProblem(status int, detail string) *problem {
+	return &problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// body returns the problem encoded as JSON
+func (p *problem) body() []byte {
+	// A problem only holds strings and ints, so it always encodes
+	b, _ := json.Marshal(p)
+	return b
+}
+
+// body returns the write result encoded as JSON
+func (res *writeResult) body() []byte {
+	b, _ := json.Marshal(res)
+	return b
+}
+
+// writeBody writes the status code and body of a response. Error responses hold a problem.
+func writeBody(w http.ResponseWriter, status int, body []byte) {
+	if body != nil {
+		contentType := "application/json"
+		if status >= http.StatusBadRequest {
+			contentType = "application/problem+json"
+		}
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
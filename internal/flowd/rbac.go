@@ -0,0 +1,165 @@
+package flowd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// scope is a permission granted to the callers of a role
+type scope int
+
+const (
+	// scopeRead allows reading flows and top flows
+	scopeRead scope = iota + 1
+	// scopeWrite allows writing flows
+	scopeWrite
+	// scopeAdmin allows the admin and metrics endpoints
+	scopeAdmin
+)
+
+// scopes are the scopes granted, a bit per scope
+type scopes uint
+
+// allScopes are granted to every caller when authorization is not configured
+const allScopes = scopes(1<<scopeRead | 1<<scopeWrite | 1<<scopeAdmin)
+
+// String returns the name of a scope in the bindings file
+func (s scope) String() string {
+	switch s {
+	case scopeRead:
+		return "read"
+	case scopeWrite:
+		return "write"
+	case scopeAdmin:
+		return "admin"
+	default:
+		return fmt.Sprintf("scope(%d)", int(s))
+	}
+}
+
+// parseScope returns the scope for a name such as "read", "write" or "admin"
+func parseScope(s string) (scope, error) {
+	for _, sc := range []scope{scopeRead, scopeWrite, scopeAdmin} {
+		if sc.String() == s {
+			return sc, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown scope %q", s)
+}
+
+// has reports whether a scope is granted
+func (ss scopes) has(s scope) bool {
+	return ss&(1<<s) != 0
+}
+
+// bindingsFile configures authorization, read from a JSON file. Roles name sets of scopes, and bindings grant
+// roles to the identities of callers.
+type bindingsFile struct {
+	// Roles maps the name of each role to the scopes it grants
+	Roles map[string][]string `json:"roles"`
+	// Bindings grant roles to identities
+	Bindings []bindingConfig `json:"bindings"`
+}
+
+// bindingConfig grants a role to the callers with the listed identities: the names of their API keys, the
+// subjects of their tokens or the names in their client certificates, prefixed by apikey:, jwt: or cert:
+type bindingConfig struct {
+	Role       string   `json:"role"`
+	Identities []string `json:"identities"`
+}
+
+// bindings maps the names of identities to the scopes granted to them, identities without a binding are
+// granted no scopes
+type bindings map[string]scopes
+
+// loadBindings reads the bindings file at path
+func loadBindings(path string) (bindings, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read bindings file: %w", err)
+	}
+	var file bindingsFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("unable to parse bindings file %s: %w", path, err)
+	}
+
+	roles := map[string]scopes{}
+	for name, names := range file.Roles {
+		var granted scopes
+		for _, n := range names {
+			s, err := parseScope(n)
+			if err != nil {
+				return nil, fmt.Errorf("role %q: %w", name, err)
+			}
+			granted |= 1 << s
+		}
+		roles[name] = granted
+	}
+
+	bb := bindings{}
+	for _, bc := range file.Bindings {
+		granted, ok := roles[bc.Role]
+		if !ok {
+			return nil, fmt.Errorf("binding of unknown role %q", bc.Role)
+		}
+		for _, id := range bc.Identities {
+			if !validIdentity(id) {
+				return nil, fmt.Errorf("binding of role %q to identity %q without an apikey:, jwt: or cert: prefix and name", bc.Role, id)
+			}
+			// Identities bound to several roles are granted the scopes of all of them
+			bb[id] |= granted
+		}
+	}
+	if len(bb) == 0 {
+		return nil, fmt.Errorf("bindings file %s binds no identities", path)
+	}
+	return bb, nil
+}
+
+// validIdentity reports whether the name of an identity in the bindings file is prefixed by the type of a
+// credential
+func validIdentity(id string) bool {
+	for _, prefix := range []string{apiKeyIdentity, jwtIdentity, certIdentity} {
+		if strings.HasPrefix(id, prefix) && len(id) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize returns an error if the caller of a request is not granted a scope
+func authorize(r *http.Request, s scope) error {
+	id := identityFrom(r.Context())
+	if id == nil || !id.scopes.has(s) {
+		name := ""
+		if id != nil {
+			name = id.Name
+		}
+		return fmt.Errorf("identity %q is not granted the %s scope", name, s)
+	}
+	return nil
+}
+
+// requireScope passes requests on to next only if their caller is granted a scope, for handlers serving a
+// single scope that do not check it themselves. Denials are rejected with a 403 counted as requests of the
+// given type.
+func requireScope(typ string, s scope, mm *Metrics, ll *logrus.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := authorize(r, s); err != nil {
+			requestLogger(ll, r).Debugf("unauthorized %s request: %v", typ, err)
+			mm.observe(typ, r, time.Now(), http.StatusForbidden)
+			writeBody(w, http.StatusForbidden, newProblem(http.StatusForbidden, err.Error()).body())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,102 @@
+package flowd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_LoadBindings(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		invalid bool
+	}{
+		{name: "bindings", file: `{"roles":{"reader":["read"]},"bindings":[{"role":"reader","identities":["apikey:grafana","jwt:grafana","cert:grafana.example.com"]}]}`},
+		{name: "no bindings", file: `{"roles":{"reader":["read"]},"bindings":[]}`, invalid: true},
+		{name: "unknown role", file: `{"roles":{"reader":["read"]},"bindings":[{"role":"writer","identities":["apikey:grafana"]}]}`, invalid: true},
+		{name: "unknown scope", file: `{"roles":{"reader":["list"]},"bindings":[{"role":"reader","identities":["apikey:grafana"]}]}`, invalid: true},
+		{name: "identity without a credential type", file: `{"roles":{"reader":["read"]},"bindings":[{"role":"reader","identities":["grafana"]}]}`, invalid: true},
+		{name: "identity of an unknown credential type", file: `{"roles":{"reader":["read"]},"bindings":[{"role":"reader","identities":["basic:grafana"]}]}`, invalid: true},
+		{name: "identity without a name", file: `{"roles":{"reader":["read"]},"bindings":[{"role":"reader","identities":["apikey:"]}]}`, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadBindings(writeFile(t, "bindings.json", tt.file))
+			if tt.invalid && err == nil {
+				t.Fatal("expected an error loading bindings")
+			}
+			if !tt.invalid && err != nil {
+				t.Fatalf("unexpected error loading bindings: %v", err)
+			}
+		})
+	}
+}
+
+func Test_Authorize(t *testing.T) {
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate EC key: %v", err)
+	}
+
+	s := newTestServer(t,
+		WithAPIKeysFile(writeFile(t, "api_keys.json", `{"keys":[`+
+			`{"name":"reader","sha256":"`+keyDigest("reader-key")+`"},`+
+			`{"name":"writer","sha256":"`+keyDigest("writer-key")+`"},`+
+			`{"name":"admin","sha256":"`+keyDigest("admin-key")+`"},`+
+			`{"name":"unbound","sha256":"`+keyDigest("unbound-key")+`"}]}`)),
+		WithJWT(writeJWKS(t, publicJWK("ec", "ES256", &signer.PublicKey)), "", ""),
+		WithBindingsFile(writeFile(t, "bindings.json", `{"roles":{"reader":["read"],"writer":["write"],"admin":["admin"]},"bindings":[`+
+			`{"role":"reader","identities":["apikey:reader"]},`+
+			`{"role":"writer","identities":["apikey:writer"]},`+
+			`{"role":"admin","identities":["apikey:admin"]}]}`)),
+	)
+	h := s.handler()
+
+	bearer := func(token string) http.Header { return http.Header{"Authorization": {"Bearer " + token}} }
+	callers := map[string]struct {
+		header  http.Header
+		granted scope
+	}{
+		"reader":  {header: bearer("reader-key"), granted: scopeRead},
+		"writer":  {header: bearer("writer-key"), granted: scopeWrite},
+		"admin":   {header: bearer("admin-key"), granted: scopeAdmin},
+		"unbound": {header: bearer("unbound-key")},
+		// A token subject is not the API key of the same name, so it is not granted the API key's scopes
+		"token of a bound API key name": {header: bearer(signJWT(t, "ec", "ES256", signer, map[string]interface{}{"sub": "reader", "exp": time.Now().Add(time.Hour).Unix()}))},
+	}
+	endpoints := []struct {
+		method string
+		target string
+		body   string
+		scope  scope
+	}{
+		{method: "GET", target: "/flows?hour=1", scope: scopeRead},
+		{method: "POST", target: "/flows", body: `[{"src_app":"foo","dest_app":"bar","vpc_id":"vpc-0","bytes_tx":1,"hour":1}]`, scope: scopeWrite},
+		{method: "GET", target: "/flows/top?hour=1", scope: scopeRead},
+		{method: "GET", target: "/admin/snapshots", scope: scopeAdmin},
+		{method: "GET", target: "/metrics", scope: scopeAdmin},
+	}
+
+	for name, caller := range callers {
+		for _, e := range endpoints {
+			t.Run(name+"/"+e.method+" "+e.target, func(t *testing.T) {
+				w := serve(h, e.method, e.target, e.body, caller.header)
+				if caller.granted != e.scope {
+					if w.Code != http.StatusForbidden {
+						t.Fatalf("expected a 403 without the %s scope, got %d: %s", e.scope, w.Code, w.Body)
+					}
+					decodeProblem(t, w)
+					return
+				}
+				if w.Code == http.StatusUnauthorized || w.Code == http.StatusForbidden {
+					t.Fatalf("expected the %s scope to be granted, got %d: %s", e.scope, w.Code, w.Body)
+				}
+			})
+		}
+	}
+}
@@ -2,11 +2,17 @@ package flowd
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -18,37 +24,138 @@ import (
 
 type Server struct {
 	addr string
+	ts   *store.TenantStore
+	auth *authenticator
 	fh   *FlowHandler
+	th   *TopHandler
+	sh   *SnapshotHandler
+	mm   *Metrics
 	ll   *logrus.Logger
 	reg  *prometheus.Registry
+	// tls serves HTTPS, nil when serving plain HTTP
+	tls *certReloader
 }
 
-func NewServer(addr string, reg *prometheus.Registry, ll *logrus.Logger) (*Server, error) {
+// NewServer creates a flowd server listening on addr
+func NewServer(addr string, reg *prometheus.Registry, ll *logrus.Logger, opts ...Option) (*Server, error) {
 	// TODO(sneha): Validate addr
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.idempotencyWindow < 0 {
+		return nil, fmt.Errorf("idempotency window %v is negative", cfg.idempotencyWindow)
+	}
+	if cfg.idempotencyEntries <= 0 {
+		return nil, fmt.Errorf("idempotency entries %d is not positive", cfg.idempotencyEntries)
+	}
+
+	tenantOpts, err := loadTenants(cfg.tenantsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys apiKeys
+	if cfg.apiKeysFile != "" {
+		if keys, err = loadAPIKeys(cfg.apiKeysFile); err != nil {
+			return nil, err
+		}
+	}
+	var jwt *jwtVerifier
+	if cfg.jwksFile != "" {
+		if jwt, err = loadJWKS(cfg.jwksFile, cfg.jwtIssuer, cfg.jwtAudience); err != nil {
+			return nil, err
+		}
+	}
+	var tls *certReloader
+	if cfg.tlsCertFile != "" || cfg.tlsKeyFile != "" || cfg.tlsClientCAFile != "" {
+		tls, err = newCertReloader(cfg.tlsCertFile, cfg.tlsKeyFile, cfg.tlsClientCAFile, cfg.tlsRequireClientCert, cfg.tlsReloadInterval, ll)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var certs clientCerts
+	if cfg.clientCertsFile != "" {
+		if cfg.tlsClientCAFile == "" {
+			return nil, errors.New("a client certificates file requires a client CA bundle")
+		}
+		if certs, err = loadClientCerts(cfg.clientCertsFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.tlsClientCAFile != "" && certs == nil && (cfg.tenantsFile != "" || keys != nil || jwt != nil) {
+		return nil, errors.New("client certificates require a client certificates file mapping them to tenants and VPCs along with tenants, API keys or JWTs")
+	}
+	if cfg.tenantsFile != "" && keys == nil && jwt == nil && certs == nil {
+		return nil, errors.New("tenants require API keys, JWTs or client certificates to identify the tenant of requests")
+	}
+	var bb bindings
+	if cfg.bindingsFile != "" {
+		if keys == nil && jwt == nil && cfg.tlsClientCAFile == "" {
+			return nil, errors.New("bindings require API keys, JWTs or client certificates to identify callers")
+		}
+		if bb, err = loadBindings(cfg.bindingsFile); err != nil {
+			return nil, err
+		}
+	}
 
-	// Create a flow handler that contains the data structure
-	fs := store.NewFlowStore(reg, ll)
+	// Create a flow store per tenant that contains the data structure
+	ts, err := store.NewTenantStore(reg, ll, tenantOpts, cfg.storeOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create flow store: %w", err)
+	}
+
+	// Fail fast on API keys and client certificates of tenants that do not exist rather than on every request
+	var ids []*identity
+	for _, id := range keys {
+		ids = append(ids, id)
+	}
+	for _, id := range certs {
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		tenant := id.Tenant
+		if tenant == "" {
+			tenant = store.DefaultTenant
+		}
+		if _, ok := ts.Tenant(tenant); !ok {
+			ts.Close()
+			return nil, fmt.Errorf("identity %q belongs to unknown tenant %q", id.Name, tenant)
+		}
+	}
 
 	mm := NewMetrics(reg)
 
 	return &Server{
 		addr: addr,
-		fh:   NewFlowHandler(fs, mm, ll),
+		ts:   ts,
+		auth: &authenticator{keys: keys, jwt: jwt, certs: certs, bindings: bb, ts: ts, mm: mm, ll: ll, now: time.Now},
+		tls:  tls,
+		fh:   NewFlowHandler(ts, mm, ll, cfg.idempotencyWindow, cfg.idempotencyEntries),
+		th:   NewTopHandler(ts, mm, ll),
+		sh:   NewSnapshotHandler(ts, mm, ll),
+		mm:   mm,
 		ll:   ll,
 		reg:  reg,
 	}, nil
 }
 
-func (s *Server) Serve(ctx context.Context) error {
+// handler routes the requests of every endpoint through authentication to its handler
+func (s *Server) handler() http.Handler {
 	mux := http.NewServeMux()
-	mux.Handle("/flows", s.fh)
-	mux.Handle("/metrics", promhttp.HandlerFor(s.reg, promhttp.HandlerOpts{}))
+	mux.Handle("/flows", s.auth.wrap("flows", s.fh))
+	mux.Handle("/flows/top", s.auth.wrap("top", s.th))
+	mux.Handle("/admin/snapshots", s.auth.wrap("snapshots", s.sh))
+	mux.Handle("/metrics", s.auth.wrap("metrics", requireScope("metrics", scopeAdmin, s.mm, s.ll, promhttp.HandlerFor(s.reg, promhttp.HandlerOpts{}))))
 	// Add go tracing endpoints
+	return mux
+}
 
+func (s *Server) Serve(ctx context.Context) error {
 	// use this method later with an http custom server and logging middleware
 	srv := &http.Server{
 		Addr:    s.addr,
-		Handler: mux,
+		Handler: s.handler(),
 		// ErrorLog:
 	}
 
@@ -60,159 +167,483 @@ func (s *Server) Serve(ctx context.Context) error {
 		return srv.Close()
 	})
 
+	// Background flow store maintenance such as retention purges
+	eg.Go(func() error {
+		return s.ts.Run(ctx)
+	})
+
+	// Reload rotated certificates
+	if s.tls != nil {
+		srv.TLSConfig = s.tls.config()
+		eg.Go(func() error {
+			return s.tls.run(ctx)
+		})
+	}
+
 	// Separate goroutine to run
 	eg.Go(func() error {
-		s.ll.Infof("starting flowd http server on: %v...", s.addr)
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if s.tls != nil {
+			s.ll.Infof("starting flowd https server on: %v...", s.addr)
+			// The certificate is handed out by the TLS configuration
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			s.ll.Infof("starting flowd http server on: %v...", s.addr)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return err
 		}
 		s.ll.Info("gracefully stopping flowd server")
 		return nil
 	})
-	return eg.Wait()
+	err := eg.Wait()
+	if cerr := s.ts.Close(); cerr != nil {
+		s.ll.Errorf("unable to close flow store: %v", cerr)
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
+// maxIdempotencyKey is the length in bytes of the longest idempotency key accepted
+const maxIdempotencyKey = 255
+
 type FlowHandler struct {
-	fs *store.FlowStore
+	ts *store.TenantStore
 	// TODO(sneha): add custom metrics
 	mm *Metrics
 	ll *logrus.Logger
+	// idempotency remembers the responses of writes by idempotency key, nil when deduplication is disabled
+	idempotency *idempotencyCache
 }
 
-func NewFlowHandler(fs *store.FlowStore, mm *Metrics, ll *logrus.Logger) *FlowHandler {
-	return &FlowHandler{
-		fs: fs,
+// NewFlowHandler creates a handler reading and writing the flows of the tenant of each request. Writes
+// carrying an idempotency key are deduplicated over the idempotency window, a window of 0 disables
+// deduplication. At most idempotencyEntries responses are remembered.
+func NewFlowHandler(ts *store.TenantStore, mm *Metrics, ll *logrus.Logger, idempotencyWindow time.Duration, idempotencyEntries int) *FlowHandler {
+	h := &FlowHandler{
+		ts: ts,
 		mm: mm,
 		ll: ll,
 	}
+	if idempotencyWindow > 0 {
+		h.idempotency = newIdempotencyCache(idempotencyWindow, idempotencyEntries)
+	}
+	return h
 }
 
 func (h *FlowHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ll := h.ll.WithField("src", r.RemoteAddr)
+	ll := requestLogger(h.ll, r)
 	ll.Debug("incoming request")
 
 	// TODO(sneha): Using a custom response writer will let us get a more accurate
 	// histogram duration metric.
 	start := time.Now()
+	var required scope
 	switch r.Method {
 	case "GET":
-		h.handleRead(w, r)
+		required = scopeRead
 	case "POST":
-		h.handleWrite(w, r)
+		required = scopeWrite
 	default:
-		h.ll.Debugf("invalid request type %s", r.Method)
-		duration := time.Since(start)
-		h.mm.requests.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
-		h.mm.requestDuration.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusBadRequest)).Observe(duration.Seconds())
-		w.WriteHeader(http.StatusBadRequest)
+		ll.Debugf("invalid request type %s", r.Method)
+		h.respond(w, r, start, http.StatusBadRequest, newProblem(http.StatusBadRequest, "flows are read with GET and written with POST").body())
+		return
+	}
+	if err := authorize(r, required); err != nil {
+		ll.Debugf("unauthorized request: %v", err)
+		h.respond(w, r, start, http.StatusForbidden, newProblem(http.StatusForbidden, err.Error()).body())
+		return
 	}
-}
-
-func (h *FlowHandler) handleRead(w http.ResponseWriter, r *http.Request) {
-	ll := h.ll.WithField("src", r.RemoteAddr)
-	ll.Debug("incoming read request")
-
-	start := time.Now()
 
-	str := r.URL.Query().Get("hour")
-	if str == "" {
-		ll.Debug("read request missing parameter hour")
-		h.mm.requests.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
-		duration := time.Since(start)
-		h.mm.requestDuration.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusBadRequest)).Observe(duration.Seconds())
-		w.WriteHeader(http.StatusBadRequest)
+	fs, err := scopedStore(h.ts, r)
+	if err != nil {
+		ll.Errorf("%v", err)
+		h.respond(w, r, start, http.StatusInternalServerError, newProblem(http.StatusInternalServerError, "unable to find the flow store of the tenant").body())
 		return
 	}
 
-	// Check if hour is a valid int
-	hour, err := strconv.Atoi(str)
+	if required == scopeWrite {
+		h.handleWrite(w, r, fs, start)
+	} else {
+		h.handleRead(w, r, fs, start)
+	}
+}
+
+func (h *FlowHandler) handleRead(w http.ResponseWriter, r *http.Request, fs store.FlowStore, start time.Time) {
+	ll := requestLogger(h.ll, r)
+	ll.Debug("incoming read request")
+
+	q, err := parseQuery(r.URL.Query())
 	if err != nil {
-		ll.Debugf("read request parameter hour is not an int: %s", str)
-		h.mm.requests.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusBadRequest)).Inc()
-		duration := time.Since(start)
-		h.mm.requestDuration.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusBadRequest)).Observe(duration.Seconds())
-		w.WriteHeader(http.StatusBadRequest)
+		ll.Debugf("invalid read request: %v", err)
+		h.respond(w, r, start, http.StatusBadRequest, newProblem(http.StatusBadRequest, err.Error()).body())
 		return
 	}
 
 	ll.Debug("successful request read request")
-	flows, err := h.fs.Get(hour)
+	flows, err := fs.Query(q)
+	if errors.Is(err, store.ErrInvalidQuery) {
+		ll.Debugf("invalid read request: %v", err)
+		h.respond(w, r, start, http.StatusBadRequest, newProblem(http.StatusBadRequest, err.Error()).body())
+		return
+	}
 	if err != nil {
-		ll.Debugf("unable to retrieve flows for hour %d: %v", hour, flows)
-		h.mm.requests.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusInternalServerError)).Inc()
-		duration := time.Since(start)
-		h.mm.requestDuration.WithLabelValues("type", r.Method, strconv.Itoa(http.StatusBadRequest)).Observe(duration.Seconds())
-		w.WriteHeader(http.StatusInternalServerError)
+		ll.Debugf("unable to retrieve flows: %v", err)
+		h.respond(w, r, start, http.StatusInternalServerError, newProblem(http.StatusInternalServerError, "unable to retrieve flows").body())
 		return
 	}
 
 	out, err := json.Marshal(flows)
 	if err != nil {
 		ll.Debugf("unable to marshal flows: %v", err)
-		h.mm.requests.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusInternalServerError)).Inc()
-		duration := time.Since(start)
-		h.mm.requestDuration.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusInternalServerError)).Observe(duration.Seconds())
-		w.WriteHeader(http.StatusInternalServerError)
+		h.respond(w, r, start, http.StatusInternalServerError, newProblem(http.StatusInternalServerError, "unable to encode flows").body())
 		return
 	}
+	h.respond(w, r, start, http.StatusOK, out)
+}
+
+// writeMode selects what a write does with the valid records of a batch holding invalid ones
+type writeMode int
 
-	duration := time.Since(start)
-	h.mm.requestDuration.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusOK)).Observe(duration.Seconds())
-	h.mm.requests.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusOK)).Inc()
-	w.Write(out)
+const (
+	// writeAllOrNothing inserts no records of a batch holding an invalid record
+	writeAllOrNothing writeMode = iota + 1
+	// writeBestEffort inserts the valid records of a batch and skips the invalid ones
+	writeBestEffort
+)
+
+// parseWriteMode parses the mode parameter of a write, defaulting to all_or_nothing
+func parseWriteMode(s string) (writeMode, error) {
+	switch s {
+	case "", "all_or_nothing":
+		return writeAllOrNothing, nil
+	case "best_effort":
+		return writeBestEffort, nil
+	default:
+		return 0, fmt.Errorf("parameter mode is not all_or_nothing or best_effort: %s", s)
+	}
 }
 
-// TODO(sneha): Switch from write error to http.Error()
-func (h *FlowHandler) handleWrite(w http.ResponseWriter, r *http.Request) {
-	ll := h.ll.WithField("src", r.RemoteAddr)
+// handleWrite inserts a JSON array of flows and responds with the number of records accepted and rejected
+// along with the index and reason of each rejected record. Every record is validated before any is inserted.
+// By default a batch is all or nothing: if any record is rejected nothing is inserted and the result is
+// returned in a 422 problem. With mode=best_effort the valid records are inserted, and the write only fails
+// if every record is rejected.
+//
+// A write carrying an Idempotency-Key header, or a batch_id parameter, is applied once: retries of it within
+// the idempotency window are answered with the response of the original write.
+func (h *FlowHandler) handleWrite(w http.ResponseWriter, r *http.Request, fs store.FlowStore, start time.Time) {
+	ll := requestLogger(h.ll, r)
 	ll.Debug("incoming write request")
 
-	start := time.Now()
-
 	// Confirm we are receiving a body type of json
 	if r.Header.Get("Content-Type") != "application/json" {
 		ll.Debugf("invalid write request type: %v", r.Header.Get("Content-Type"))
-		h.mm.requests.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusUnsupportedMediaType)).Inc()
-		duration := time.Since(start)
-		h.mm.requestDuration.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusUnsupportedMediaType)).Observe(duration.Seconds())
-		w.WriteHeader(http.StatusUnsupportedMediaType)
+		h.respond(w, r, start, http.StatusUnsupportedMediaType, newProblem(http.StatusUnsupportedMediaType, "flows must be written as application/json").body())
 		return
 	}
 
-	// Read body and validate request type
-	var flowList []*store.Flow
+	mode, err := parseWriteMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		ll.Debugf("invalid write request: %v", err)
+		h.respond(w, r, start, http.StatusBadRequest, newProblem(http.StatusBadRequest, err.Error()).body())
+		return
+	}
 
 	b, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
 		ll.Debugf("unble to read write body: %v", err)
-		h.mm.requests.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusInternalServerError)).Inc()
-		duration := time.Since(start)
-		h.mm.requestDuration.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusInternalServerError)).Observe(duration.Seconds())
-		w.WriteHeader(http.StatusInternalServerError)
+		h.respond(w, r, start, http.StatusBadRequest, newProblem(http.StatusBadRequest, "unable to read request body").body())
 		return
 	}
 
-	if err = json.Unmarshal(b, &flowList); err != nil {
-		ll.Debugf("unable to unmarshal write body into flows: %v", err)
-		h.mm.requests.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusInternalServerError)).Inc()
-		duration := time.Since(start)
-		h.mm.requestDuration.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusInternalServerError)).Observe(duration.Seconds())
-		w.WriteHeader(http.StatusInternalServerError)
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = r.URL.Query().Get("batch_id")
+	}
+	if key == "" || h.idempotency == nil {
+		status, body := h.write(ll, fs, identityFrom(r.Context()), mode, b)
+		h.respond(w, r, start, status, body)
+		return
+	}
+	if len(key) > maxIdempotencyKey {
+		ll.Debugf("invalid write request idempotency key of %d bytes", len(key))
+		h.respond(w, r, start, http.StatusBadRequest, newProblem(http.StatusBadRequest, fmt.Sprintf("idempotency key is longer than %d bytes", maxIdempotencyKey)).body())
 		return
 	}
 
-	if err := h.fs.Insert(flowList); err != nil {
-		ll.Debugf("unable to insert flows: %v", err)
-		h.mm.requests.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusInternalServerError)).Inc()
-		duration := time.Since(start)
-		h.mm.requestDuration.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusInternalServerError)).Observe(duration.Seconds())
-		w.WriteHeader(http.StatusInternalServerError)
+	// A key identifies a single write of a caller, so it may not be reused with another mode or body. Keys of
+	// other callers are never replayed, since the write was checked against the VPCs of its own caller.
+	id := identityFrom(r.Context())
+	digest := sha256.Sum256(append([]byte(strconv.Itoa(int(mode))+"\n"), b...))
+	iw, ok := h.idempotency.begin(id.Tenant+"\x00"+id.Name+"\x00"+key, digest)
+	if !ok {
+		status, body := h.write(ll, fs, id, mode, b)
+		h.idempotency.finish(iw, status, body)
+		h.respond(w, r, start, status, body)
 		return
 	}
+	if iw.digest != digest {
+		ll.Debugf("idempotency key %q reused by a different write", key)
+		h.respond(w, r, start, http.StatusUnprocessableEntity, newProblem(http.StatusUnprocessableEntity, "idempotency key was already used by a different write").body())
+		return
+	}
+
+	// A retry of a write still in flight waits for its response
+	<-iw.done
+	ll.Debugf("replaying response to write with idempotency key %q", key)
+	h.mm.idempotencyHits.WithLabelValues(tenantFrom(r.Context())).Inc()
+	w.Header().Set("Idempotent-Replayed", "true")
+	h.respond(w, r, start, iw.status, iw.body)
+}
+
+// write validates and inserts the records of a write body by a caller, returning the response status and body.
+// A write holding records of VPCs outside the scope of the caller is answered with a 403 and inserts no
+// flows, whatever its mode.
+func (h *FlowHandler) write(ll *logrus.Entry, fs store.FlowStore, id *identity, mode writeMode, b []byte) (int, []byte) {
+	// Records are decoded one by one so a malformed record is reported by its index
+	var records []json.RawMessage
+	if err := json.Unmarshal(b, &records); err != nil {
+		ll.Debugf("unable to unmarshal write body into records: %v", err)
+		return http.StatusBadRequest, newProblem(http.StatusBadRequest, "request body is not a JSON array: "+err.Error()).body()
+	}
+
+	res := &writeResult{}
+	var forbidden bool
+	reject := func(index int, reason string, err error) {
+		h.mm.rejected.WithLabelValues(reason, id.Tenant).Inc()
+		res.Errors = append(res.Errors, recordError{Index: index, Reason: reason, Detail: err.Error()})
+		if reason == reasonVPCForbidden {
+			forbidden = true
+		}
+	}
+	rejected := func() (int, []byte) {
+		sort.Slice(res.Errors, func(i, j int) bool { return res.Errors[i].Index < res.Errors[j].Index })
+		res.Rejected = len(res.Errors)
+		ll.Debugf("rejected %d of %d flows", res.Rejected, len(records))
+		status := http.StatusUnprocessableEntity
+		if forbidden {
+			status = http.StatusForbidden
+		}
+		p := newProblem(status, fmt.Sprintf("%d of %d flows were rejected, no flows were inserted", res.Rejected, len(records)))
+		p.writeResult = res
+		return status, p.body()
+	}
+
+	flowList := make([]*store.Flow, 0, len(records))
+	// indexes holds the index of the record of each flow
+	indexes := make([]int, 0, len(records))
+	for i, record := range records {
+		var flow *store.Flow
+		// Malformed flows, including negative counters, are rejected
+		err := json.Unmarshal(record, &flow)
+		if err == nil {
+			err = store.ValidateFlow(flow)
+		}
+		if err != nil {
+			reason := store.InvalidRecord
+			var ve *store.ValidationError
+			if errors.As(err, &ve) {
+				reason = ve.Reason
+			}
+			reject(i, string(reason), err)
+			continue
+		}
+		if id.vpcs != nil && !id.vpcs.Allows(flow.VpcID) {
+			reject(i, reasonVPCForbidden, fmt.Errorf("vpc_id %q is outside the VPCs of the credential", flow.VpcID))
+			continue
+		}
+		flowList = append(flowList, flow)
+		indexes = append(indexes, i)
+	}
+	if forbidden || len(res.Errors) > 0 && (mode == writeAllOrNothing || len(flowList) == 0) {
+		return rejected()
+	}
+
+	// Flows that would exceed the tenant's tuple limit are rejected, and on a best effort write the others
+	// are inserted without them
+	for {
+		err := fs.Insert(flowList)
+		var le *store.TupleLimitError
+		if !errors.As(err, &le) {
+			if err != nil {
+				ll.Debugf("unable to insert flows: %v", err)
+				return http.StatusInternalServerError, newProblem(http.StatusInternalServerError, "unable to insert flows").body()
+			}
+			break
+		}
+
+		beyond := map[int]bool{}
+		for _, i := range le.Indexes {
+			beyond[i] = true
+			reject(indexes[i], reasonTupleLimit, fmt.Errorf("flow would exceed the limit of %d flow tuples", le.Limit))
+		}
+		if mode == writeAllOrNothing || len(beyond) == len(flowList) {
+			return rejected()
+		}
+		var keptFlows []*store.Flow
+		var keptIndexes []int
+		for i, flow := range flowList {
+			if !beyond[i] {
+				keptFlows = append(keptFlows, flow)
+				keptIndexes = append(keptIndexes, indexes[i])
+			}
+		}
+		flowList, indexes = keptFlows, keptIndexes
+	}
+
+	sort.Slice(res.Errors, func(i, j int) bool { return res.Errors[i].Index < res.Errors[j].Index })
+	res.Accepted, res.Rejected = len(flowList), len(res.Errors)
+	if res.Rejected > 0 {
+		ll.Debugf("inserted %d flows, rejected %d", res.Accepted, res.Rejected)
+	}
+	return http.StatusOK, res.body()
+}
+
+// respond records the request metrics and writes the status code and body
+func (h *FlowHandler) respond(w http.ResponseWriter, r *http.Request, start time.Time, status int, body []byte) {
+	h.mm.observe("flows", r, start, status)
+	writeBody(w, status, body)
+}
+
+// parseQuery reads the time range, filters and grouping of a flow query from its request parameters.
+// Both start and end, as RFC 3339 times or seconds since the unix epoch, select a time range. Otherwise
+// either hour or both start_hour and end_hour select epoch hours. Filters and group_by may be repeated
+// and each may hold a comma separated list of values.
+func parseQuery(query url.Values) (store.Query, error) {
+	var q store.Query
+	if query.Has("start") || query.Has("end") {
+		for param, t := range map[string]*time.Time{"start": &q.From, "end": &q.To} {
+			str := query.Get(param)
+			if str == "" {
+				return store.Query{}, fmt.Errorf("missing parameter %s", param)
+			}
+			ts, err := store.ParseTimestamp(str)
+			if err != nil {
+				return store.Query{}, fmt.Errorf("parameter %s is invalid: %w", param, err)
+			}
+			*t = ts
+		}
+		if q.To.Sub(q.From) > maxQueryHours*time.Hour {
+			return store.Query{}, fmt.Errorf("parameters start and end must be at most %d hours apart", maxQueryHours)
+		}
+	} else {
+		var err error
+		if q.Start, q.End, err = parseHours(query); err != nil {
+			return store.Query{}, err
+		}
+	}
+
+	for param, values := range map[string]*[]string{
+		"src_app":  &q.Filter.Src,
+		"dest_app": &q.Filter.Dst,
+		"vpc_id":   &q.Filter.VpcID,
+	} {
+		for _, value := range splitParam(query, param) {
+			if value == "" {
+				return store.Query{}, fmt.Errorf("parameter %s has an empty value", param)
+			}
+			*values = append(*values, value)
+		}
+	}
+
+	for param, cidrs := range map[string]*[]netip.Prefix{
+		"src_cidr":  &q.Filter.SrcCIDR,
+		"dest_cidr": &q.Filter.DstCIDR,
+	} {
+		for _, value := range splitParam(query, param) {
+			cidr, err := store.ParseCIDR(value)
+			if err != nil {
+				return store.Query{}, fmt.Errorf("parameter %s is not a CIDR: %w", param, err)
+			}
+			*cidrs = append(*cidrs, cidr)
+		}
+	}
+
+	// Addresses are rolled up to subnets with a prefix length per address family
+	for _, p := range []struct {
+		param  string
+		length *int
+		max    int
+	}{
+		{param: "src_prefix_len", length: &q.SrcPrefixLen.V4, max: 32},
+		{param: "src_prefix_len6", length: &q.SrcPrefixLen.V6, max: 128},
+		{param: "dest_prefix_len", length: &q.DstPrefixLen.V4, max: 32},
+		{param: "dest_prefix_len6", length: &q.DstPrefixLen.V6, max: 128},
+	} {
+		str := query.Get(p.param)
+		if str == "" {
+			continue
+		}
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 || n > p.max {
+			return store.Query{}, fmt.Errorf("parameter %s is not a prefix length between 0 and %d: %s", p.param, p.max, str)
+		}
+		*p.length = n
+	}
+
+	for _, name := range splitParam(query, "group_by") {
+		d, err := store.ParseDimension(name)
+		if err != nil {
+			return store.Query{}, fmt.Errorf("parameter group_by is invalid: %w", err)
+		}
+		q.GroupBy = append(q.GroupBy, d)
+	}
 
-	h.mm.requests.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusOK)).Inc()
-	duration := time.Since(start)
-	h.mm.requestDuration.WithLabelValues("flows", r.Method, strconv.Itoa(http.StatusOK)).Observe(duration.Seconds())
-	w.WriteHeader(http.StatusOK)
+	return q, nil
+}
+
+// maxQueryHours is the longest range of hours a flow query may cover, about ten years
+const maxQueryHours = 10 * 366 * 24
+
+// parseHours reads the epoch hours of a flow query selected by either hour or both start_hour and end_hour,
+// returning the range from start, inclusive, to end, exclusive
+func parseHours(query url.Values) (int, int, error) {
+	// A range of hours is requested with start_hour and end_hour instead of hour
+	params := []string{"hour"}
+	if query.Has("start_hour") || query.Has("end_hour") {
+		params = []string{"start_hour", "end_hour"}
+	}
+
+	hours := make([]int, len(params))
+	for i, param := range params {
+		str := query.Get(param)
+		if str == "" {
+			return 0, 0, fmt.Errorf("missing parameter %s", param)
+		}
+
+		// Check if hour is a valid int
+		hour, err := strconv.Atoi(str)
+		if err != nil {
+			return 0, 0, fmt.Errorf("parameter %s is not an int: %s", param, str)
+		}
+		if hour <= 0 {
+			return 0, 0, fmt.Errorf("parameter %s must be greater than 0: %s", param, str)
+		}
+		hours[i] = hour
+	}
+
+	if len(hours) == 2 {
+		if hours[1] <= hours[0] {
+			return 0, 0, fmt.Errorf("parameter end_hour %d must be greater than start_hour %d", hours[1], hours[0])
+		}
+		if hours[1]-hours[0] > maxQueryHours {
+			return 0, 0, fmt.Errorf("parameters start_hour and end_hour must be at most %d hours apart", maxQueryHours)
+		}
+		return hours[0], hours[1], nil
+	}
+	return hours[0], hours[0] + 1, nil
+}
+
+// splitParam returns the values of a repeatable parameter, splitting each on commas
+func splitParam(query url.Values, param string) []string {
+	var values []string
+	for _, str := range query[param] {
+		values = append(values, strings.Split(str, ",")...)
+	}
+	return values
 }
@@ -1,3 +1,264 @@
 package flowd
 
-// TODO(sneha): Add HTTP flowd server tests
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/si74/flow-api/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestServer creates a server whose handler is exercised without listening
+func newTestServer(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	s, err := NewServer(":0", prometheus.NewPedanticRegistry(), ll, opts...)
+	if err != nil {
+		t.Fatalf("unexpected error creating server: %v", err)
+	}
+	t.Cleanup(func() { s.ts.Close() })
+	return s
+}
+
+// writeFile writes a file of a test and returns its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("unable to write %s: %v", name, err)
+	}
+	return path
+}
+
+// serve sends a request through a handler, writing JSON bodies, and returns the response
+func serve(h http.Handler, method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// decodeProblem checks that a response is a problem+json body of its status code and returns the problem
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) *problem {
+	t.Helper()
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("expected a problem+json response, got %q: %s", ct, w.Body)
+	}
+	p := &problem{writeResult: &writeResult{}}
+	if err := json.Unmarshal(w.Body.Bytes(), p); err != nil {
+		t.Fatalf("unable to decode problem: %v", err)
+	}
+	if p.Status != w.Code || p.Title != http.StatusText(w.Code) || p.Type != "about:blank" {
+		t.Fatalf("problem %+v does not match status %d", p, w.Code)
+	}
+	return p
+}
+
+func Test_ParseHours(t *testing.T) {
+	tests := []struct {
+		query      string
+		start, end int
+		invalid    bool
+	}{
+		{query: "hour=5", start: 5, end: 6},
+		{query: "start_hour=5&end_hour=8", start: 5, end: 8},
+		{query: "", invalid: true},
+		{query: "hour=foo", invalid: true},
+		{query: "hour=0", invalid: true},
+		{query: "hour=-3", invalid: true},
+		{query: "start_hour=5", invalid: true},
+		{query: "start_hour=0&end_hour=3", invalid: true},
+		{query: "start_hour=5&end_hour=5", invalid: true},
+		{query: "start_hour=5&end_hour=3", invalid: true},
+		{query: "start_hour=1&end_hour=87841", start: 1, end: 87841},
+		{query: "start_hour=1&end_hour=87842", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			values, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("unable to parse query: %v", err)
+			}
+			start, end, err := parseHours(values)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("expected an error parsing hours, got %d to %d", start, end)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error parsing hours: %v", err)
+			}
+			if start != tt.start || end != tt.end {
+				t.Fatalf("expected hours %d to %d, got %d to %d", tt.start, tt.end, start, end)
+			}
+		})
+	}
+}
+
+func Test_ProblemResponses(t *testing.T) {
+	h := newTestServer(t).handler()
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		header http.Header
+		status int
+		// rejected is the number of records a write reports rejected
+		rejected int
+	}{
+		{name: "missing hour", method: "GET", target: "/flows", status: http.StatusBadRequest},
+		{name: "zero hour", method: "GET", target: "/flows?hour=0", status: http.StatusBadRequest},
+		{name: "reversed hours", method: "GET", target: "/flows?start_hour=5&end_hour=3", status: http.StatusBadRequest},
+		{name: "time range before the first bucket", method: "GET", target: "/flows?start=0&end=10", status: http.StatusBadRequest},
+		{name: "reversed time range", method: "GET", target: "/flows?start=7200&end=3600", status: http.StatusBadRequest},
+		{name: "unbounded hours", method: "GET", target: "/flows?start_hour=1&end_hour=268435456", status: http.StatusBadRequest},
+		{name: "unbounded time range", method: "GET", target: "/flows?start=3600&end=9999999999", status: http.StatusBadRequest},
+		{name: "unknown dimension", method: "GET", target: "/flows?hour=1&group_by=color", status: http.StatusBadRequest},
+		{name: "top of reversed hours", method: "GET", target: "/flows/top?start_hour=5&end_hour=3", status: http.StatusBadRequest},
+		{name: "top of no flows", method: "GET", target: "/flows/top?hour=1&n=0", status: http.StatusBadRequest},
+		{name: "unsupported method", method: "PUT", target: "/flows", status: http.StatusBadRequest},
+		{name: "unsupported content type", method: "POST", target: "/flows", header: http.Header{"Content-Type": {"text/plain"}}, status: http.StatusUnsupportedMediaType},
+		{name: "malformed body", method: "POST", target: "/flows", body: `{"src_app":`, status: http.StatusBadRequest},
+		{name: "unknown write mode", method: "POST", target: "/flows?mode=some", body: `[]`, status: http.StatusBadRequest},
+		{
+			name:     "invalid records",
+			method:   "POST",
+			target:   "/flows",
+			body:     `[{"src_app":"foo","dest_app":"bar","vpc_id":"vpc-0","bytes_tx":1,"hour":1},{"dest_app":"bar","hour":1},{"src_app":"foo","dest_app":"bar","bytes_tx":-1,"hour":1}]`,
+			status:   http.StatusUnprocessableEntity,
+			rejected: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(h, tt.method, tt.target, tt.body, tt.header)
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, w.Code, w.Body)
+			}
+			p := decodeProblem(t, w)
+			if p.Detail == "" {
+				t.Fatal("expected a problem detail")
+			}
+			if p.Rejected != tt.rejected || len(p.Errors) != tt.rejected {
+				t.Fatalf("expected %d rejected records, got %+v", tt.rejected, p.writeResult)
+			}
+		})
+	}
+
+	// Nothing of a rejected all or nothing write is inserted
+	w := serve(h, "GET", "/flows?hour=1", "", nil)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("expected no flows after rejected writes, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func Test_IdempotentWrites(t *testing.T) {
+	const body = `[{"src_app":"foo","dest_app":"bar","vpc_id":"vpc-0","bytes_tx":1,"hour":1}]`
+	key := func(k string) http.Header { return http.Header{"Idempotency-Key": {k}} }
+
+	t.Run("replay", func(t *testing.T) {
+		h := newTestServer(t).handler()
+
+		first := serve(h, "POST", "/flows", body, key("batch-1"))
+		if first.Code != http.StatusOK || first.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("expected the write to be applied, got %d: %s", first.Code, first.Body)
+		}
+		for _, target := range []string{"/flows", "/flows?batch_id=batch-1"} {
+			header := key("batch-1")
+			if strings.Contains(target, "batch_id") {
+				header = nil
+			}
+			retry := serve(h, "POST", target, body, header)
+			if retry.Code != first.Code || retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+				t.Fatalf("expected the response of the first write to be replayed to %s, got %d: %s", target, retry.Code, retry.Body)
+			}
+		}
+
+		// A key reused for a different write is refused rather than replayed
+		w := serve(h, "POST", "/flows?mode=best_effort", body, key("batch-1"))
+		if w.Code != http.StatusUnprocessableEntity || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("expected a different write with the same key to be refused, got %d: %s", w.Code, w.Body)
+		}
+		decodeProblem(t, w)
+
+		w = serve(h, "GET", "/flows?hour=1", "", nil)
+		if !strings.Contains(w.Body.String(), `"bytes_tx":1,`) {
+			t.Fatalf("expected the write to be applied once, got %d: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		s := newTestServer(t, WithStoreOptions(store.WithWAL(t.TempDir(), store.SyncNever, 0)))
+		h := s.handler()
+		// Writes to a closed write-ahead log fail
+		if err := s.ts.Close(); err != nil {
+			t.Fatalf("unexpected error closing the flow store: %v", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			w := serve(h, "POST", "/flows", body, key("batch-1"))
+			if w.Code != http.StatusInternalServerError || w.Header().Get("Idempotent-Replayed") != "" {
+				t.Fatalf("expected write %d to fail without being replayed, got %d: %s", i, w.Code, w.Body)
+			}
+		}
+	})
+
+	t.Run("identities", func(t *testing.T) {
+		h := newTestServer(t, WithAPIKeysFile(writeFile(t, "api_keys.json", `{"keys":[`+
+			`{"name":"exporter","sha256":"`+keyDigest("exporter-key")+`"},`+
+			`{"name":"team-a","sha256":"`+keyDigest("team-a-key")+`","vpc_ids":["team-a-*"]}]}`))).handler()
+
+		header := func(token string) http.Header {
+			return http.Header{"Authorization": {"Bearer " + token}, "Idempotency-Key": {"batch-1"}}
+		}
+		if w := serve(h, "POST", "/flows", body, header("exporter-key")); w.Code != http.StatusOK {
+			t.Fatalf("expected the write to be applied, got %d: %s", w.Code, w.Body)
+		}
+		// The same key and body of another caller is checked against its own VPCs rather than replayed
+		w := serve(h, "POST", "/flows", body, header("team-a-key"))
+		if w.Code != http.StatusForbidden || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("expected a write of another caller's VPC to be forbidden, got %d: %s", w.Code, w.Body)
+		}
+		if w := serve(h, "POST", "/flows", body, header("exporter-key")); w.Header().Get("Idempotent-Replayed") != "true" {
+			t.Fatalf("expected the write to be replayed to its own caller, got %d: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		h := newTestServer(t, WithIdempotencyEntries(1)).handler()
+
+		serve(h, "POST", "/flows", body, key("batch-1"))
+		serve(h, "POST", "/flows", body, key("batch-2"))
+		// batch-1 was forgotten to make room for batch-2, so its retry is applied again
+		if w := serve(h, "POST", "/flows", body, key("batch-1")); w.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("expected the oldest write to be forgotten, got %d: %s", w.Code, w.Body)
+		}
+		if w := serve(h, "POST", "/flows", body, key("batch-1")); w.Header().Get("Idempotent-Replayed") != "true" {
+			t.Fatalf("expected the newest write to be replayed, got %d: %s", w.Code, w.Body)
+		}
+	})
+}
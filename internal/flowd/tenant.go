@@ -0,0 +1,87 @@
+package flowd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/si74/flow-api/internal/store"
+)
+
+// tenantsFile is the configuration of the tenants of a server, read from a JSON file. It holds no credentials:
+// callers are mapped to their tenant by the API keys file or the tenant claim of their token.
+type tenantsFile struct {
+	Tenants []tenantConfig `json:"tenants"`
+}
+
+// tenantConfig is a tenant along with its limits
+type tenantConfig struct {
+	Name string `json:"name"`
+	// RetentionHours overrides the number of hours of flow data kept for the tenant when set
+	RetentionHours *int `json:"retention_hours,omitempty"`
+	// MaxTuples limits the number of flow tuples held for the tenant, 0 is unlimited
+	MaxTuples int `json:"max_tuples,omitempty"`
+}
+
+// loadTenants reads the tenants file at path, returning the flow store options of each tenant. Without a path
+// only the default tenant exists.
+func loadTenants(path string) (map[string][]store.Option, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read tenants file: %w", err)
+	}
+	var file tenantsFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("unable to parse tenants file %s: %w", path, err)
+	}
+	if len(file.Tenants) == 0 {
+		return nil, fmt.Errorf("tenants file %s holds no tenants", path)
+	}
+
+	opts := map[string][]store.Option{}
+	for _, tc := range file.Tenants {
+		if _, ok := opts[tc.Name]; ok {
+			return nil, fmt.Errorf("tenant %q is configured more than once", tc.Name)
+		}
+		var tenantOpts []store.Option
+		if tc.RetentionHours != nil {
+			tenantOpts = append(tenantOpts, store.WithRetentionHours(*tc.RetentionHours))
+		}
+		if tc.MaxTuples != 0 {
+			tenantOpts = append(tenantOpts, store.WithMaxTuples(tc.MaxTuples))
+		}
+		opts[tc.Name] = tenantOpts
+	}
+	return opts, nil
+}
+
+// tenantStore returns the flow store of the tenant of a request
+func tenantStore(ts *store.TenantStore, r *http.Request) (store.FlowStore, error) {
+	name := tenantFrom(r.Context())
+	fs, ok := ts.Tenant(name)
+	if !ok {
+		return nil, fmt.Errorf("no flow store for tenant %q", name)
+	}
+	return fs, nil
+}
+
+// scopedStore returns the flow store of the tenant of a request, exposing only the flows of the VPCs its caller
+// is restricted to
+func scopedStore(ts *store.TenantStore, r *http.Request) (store.FlowStore, error) {
+	fs, err := tenantStore(ts, r)
+	if err != nil {
+		return nil, err
+	}
+	if id := identityFrom(r.Context()); id != nil && id.vpcs != nil {
+		return store.Scoped(fs, id.vpcs), nil
+	}
+	return fs, nil
+}
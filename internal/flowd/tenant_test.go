@@ -0,0 +1,51 @@
+package flowd
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_LoadTenants(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		tenants []string
+		invalid bool
+	}{
+		{
+			name:    "tenants",
+			file:    `{"tenants":[{"name":"payments","retention_hours":720},{"name":"search","max_tuples":100000}]}`,
+			tenants: []string{"payments", "search"},
+		},
+		{name: "no tenants", file: `{"tenants":[]}`, invalid: true},
+		{name: "duplicate tenant", file: `{"tenants":[{"name":"payments"},{"name":"payments"}]}`, invalid: true},
+		{name: "malformed", file: `{"tenants":`, invalid: true},
+		// Credentials belong in the API keys file, never next to the tenants
+		{name: "api keys", file: `{"tenants":[{"name":"payments","api_keys":["secret"]}]}`, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := loadTenants(writeFile(t, "tenants.json", tt.file))
+			if tt.invalid {
+				if err == nil {
+					t.Fatal("expected an error loading tenants")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error loading tenants: %v", err)
+			}
+			var tenants []string
+			for name := range opts {
+				tenants = append(tenants, name)
+			}
+			sort.Strings(tenants)
+			if diff := cmp.Diff(tenants, tt.tenants); diff != "" {
+				t.Fatalf("unexpected tenants: %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package flowd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTLSReloadInterval is how often the server certificate and client CA bundle are checked for changes on
+// disk by default
+const DefaultTLSReloadInterval = time.Minute
+
+// fileStamp identifies a version of a file on disk
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// certReloader serves HTTPS with a server certificate and client CA bundle read from disk, reloading them when
+// the files change so that rotated certificates are picked up without a restart
+type certReloader struct {
+	certFile, keyFile, clientCAFile string
+	clientAuth                      tls.ClientAuthType
+	// interval is how often the files are checked for changes, 0 disables reloading
+	interval time.Duration
+	ll       *logrus.Logger
+
+	mu     sync.RWMutex
+	cfg    *tls.Config
+	stamps []fileStamp
+}
+
+// newCertReloader loads the server certificate and key, and the client CA bundle when clientCAFile is set.
+// Client certificates are verified against the bundle when presented, and are required of every connection
+// when requireClientCert is set.
+func newCertReloader(certFile, keyFile, clientCAFile string, requireClientCert bool, interval time.Duration, ll *logrus.Logger) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS requires both a certificate and a key file")
+	}
+	if interval < 0 {
+		return nil, fmt.Errorf("TLS reload interval %v is negative", interval)
+	}
+
+	c := &certReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		clientAuth:   tls.NoClientCert,
+		interval:     interval,
+		ll:           ll,
+	}
+	switch {
+	case clientCAFile != "" && requireClientCert:
+		c.clientAuth = tls.RequireAndVerifyClientCert
+	case clientCAFile != "":
+		c.clientAuth = tls.VerifyClientCertIfGiven
+	case requireClientCert:
+		return nil, errors.New("requiring client certificates requires a client CA bundle")
+	}
+
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// files returns the files the configuration is read from
+func (c *certReloader) files() []string {
+	files := []string{c.certFile, c.keyFile}
+	if c.clientCAFile != "" {
+		files = append(files, c.clientCAFile)
+	}
+	return files
+}
+
+// reload reads the files again if any of them changed since they were last read, returning whether they were.
+// The current configuration is kept if the files cannot be read, so a rotation caught half way through is
+// retried on the next check.
+func (c *certReloader) reload() (bool, error) {
+	var stamps []fileStamp
+	for _, f := range c.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return false, fmt.Errorf("unable to stat TLS file: %w", err)
+		}
+		stamps = append(stamps, fileStamp{modTime: fi.ModTime(), size: fi.Size()})
+	}
+
+	c.mu.RLock()
+	changed := c.cfg == nil
+	for i := range c.stamps {
+		if c.stamps[i] != stamps[i] {
+			changed = true
+		}
+	}
+	c.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("unable to load TLS certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   c.clientAuth,
+	}
+	if c.clientCAFile != "" {
+		b, err := os.ReadFile(c.clientCAFile)
+		if err != nil {
+			return false, fmt.Errorf("unable to read client CA bundle: %w", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(b) {
+			return false, fmt.Errorf("client CA bundle %s holds no PEM certificates", c.clientCAFile)
+		}
+	}
+
+	c.mu.Lock()
+	c.cfg = cfg
+	c.stamps = stamps
+	c.mu.Unlock()
+	return true, nil
+}
+
+// config returns the TLS configuration of the server, which hands each connection the configuration loaded last
+func (c *certReloader) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return c.cfg, nil
+		},
+	}
+}
+
+// run checks the files for changes every interval until ctx is cancelled
+func (c *certReloader) run(ctx context.Context) error {
+	if c.interval == 0 {
+		return nil
+	}
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			reloaded, err := c.reload()
+			if err != nil {
+				c.ll.Errorf("unable to reload TLS certificates, keeping the current ones: %v", err)
+				continue
+			}
+			if reloaded {
+				c.ll.Info("reloaded TLS certificates")
+			}
+		}
+	}
+}
+
+// peerCertificate returns the verified client certificate of a request, nil if it did not present one
+func peerCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certName returns the name identifying the holder of a client certificate: its first DNS, URI or email
+// subject alternative name, in that order, or else its subject common name
+func certName(cert *x509.Certificate) string {
+	switch {
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	default:
+		return cert.Subject.String()
+	}
+}
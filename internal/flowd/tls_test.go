@@ -0,0 +1,321 @@
+package flowd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testCert is a certificate generated for a test along with its key
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert generates a certificate of a template, signed by parent or self-signed when parent is nil
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("unable to generate serial number: %v", err)
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if tmpl.KeyUsage == 0 {
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	}
+
+	signer, signerCert := key, tmpl
+	if parent != nil {
+		signer, signerCert = parent.key, parent.cert
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unable to parse certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to encode key: %v", err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// newTestCA generates a self-signed CA certificate
+func newTestCA(t *testing.T) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "flowd test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+// newServerCert generates a server certificate for localhost signed by ca
+func newServerCert(t *testing.T, ca *testCert, name string) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+}
+
+// writeTLSFile writes a TLS file, moving its modification time forward so a rewrite within the resolution of
+// the file system clock is seen as a change
+func writeTLSFile(t *testing.T, path string, b []byte) {
+	t.Helper()
+
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatalf("unable to write %s: %v", path, err)
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("unable to touch %s: %v", path, err)
+		}
+	}
+}
+
+// servedCert returns the leaf certificate a reloader hands to connections
+func servedCert(t *testing.T, c *certReloader) []byte {
+	t.Helper()
+
+	cfg, err := c.config().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("unexpected error getting TLS config: %v", err)
+	}
+	return cfg.Certificates[0].Certificate[0]
+}
+
+func Test_CertReloader(t *testing.T) {
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	ca := newTestCA(t)
+	first := newServerCert(t, ca, "first")
+	writeTLSFile(t, certFile, first.certPEM)
+	writeTLSFile(t, keyFile, first.keyPEM)
+	writeTLSFile(t, caFile, ca.certPEM)
+
+	c, err := newCertReloader(certFile, keyFile, caFile, true, time.Minute, ll)
+	if err != nil {
+		t.Fatalf("unexpected error loading TLS files: %v", err)
+	}
+	if !bytes.Equal(servedCert(t, c), first.cert.Raw) {
+		t.Fatal("expected the first certificate to be served")
+	}
+	if reloaded, err := c.reload(); err != nil || reloaded {
+		t.Fatalf("expected unchanged files not to be reloaded, got %v and %v", reloaded, err)
+	}
+
+	// A rotated certificate is served once the files change
+	second := newServerCert(t, ca, "second")
+	writeTLSFile(t, certFile, second.certPEM)
+	writeTLSFile(t, keyFile, second.keyPEM)
+	if reloaded, err := c.reload(); err != nil || !reloaded {
+		t.Fatalf("expected changed files to be reloaded, got %v and %v", reloaded, err)
+	}
+	if !bytes.Equal(servedCert(t, c), second.cert.Raw) {
+		t.Fatal("expected the rotated certificate to be served")
+	}
+
+	// Invalid files, such as a rotation caught half way through, keep the current certificate
+	third := newServerCert(t, ca, "third")
+	invalid := []struct {
+		name string
+		path string
+		b    []byte
+	}{
+		{name: "mismatched key", path: certFile, b: third.certPEM},
+		{name: "malformed certificate", path: certFile, b: []byte("not a certificate")},
+		{name: "malformed client CA bundle", path: caFile, b: []byte("not a certificate")},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			writeTLSFile(t, tt.path, tt.b)
+			if _, err := c.reload(); err == nil {
+				t.Fatal("expected an error reloading invalid files")
+			}
+			if !bytes.Equal(servedCert(t, c), second.cert.Raw) {
+				t.Fatal("expected the current certificate to be kept")
+			}
+		})
+	}
+
+	// The next check after the rotation completes picks it up
+	writeTLSFile(t, keyFile, third.keyPEM)
+	writeTLSFile(t, certFile, third.certPEM)
+	writeTLSFile(t, caFile, ca.certPEM)
+	if reloaded, err := c.reload(); err != nil || !reloaded {
+		t.Fatalf("expected completed rotation to be reloaded, got %v and %v", reloaded, err)
+	}
+	if !bytes.Equal(servedCert(t, c), third.cert.Raw) {
+		t.Fatal("expected the rotated certificate to be served")
+	}
+
+	for _, args := range [][4]string{
+		{certFile, "", "", ""},
+		{certFile, keyFile, "", "require"},
+		{certFile, filepath.Join(dir, "missing.pem"), "", ""},
+	} {
+		if _, err := newCertReloader(args[0], args[1], args[2], args[3] != "", 0, ll); err == nil {
+			t.Fatalf("expected an error loading TLS files %q", args)
+		}
+	}
+	if _, err := newCertReloader(certFile, keyFile, "", false, -time.Second, ll); err == nil {
+		t.Fatal("expected an error with a negative reload interval")
+	}
+}
+
+func Test_CertName(t *testing.T) {
+	spiffe, err := url.Parse("spiffe://example.com/collector")
+	if err != nil {
+		t.Fatalf("unable to parse URI: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		tmpl     *x509.Certificate
+		expected string
+	}{
+		{
+			name:     "DNS SAN over CN",
+			tmpl:     &x509.Certificate{Subject: pkix.Name{CommonName: "ignored"}, DNSNames: []string{"collector.example.com", "other.example.com"}, URIs: []*url.URL{spiffe}},
+			expected: "collector.example.com",
+		},
+		{
+			name:     "URI SAN",
+			tmpl:     &x509.Certificate{Subject: pkix.Name{CommonName: "ignored"}, URIs: []*url.URL{spiffe}, EmailAddresses: []string{"ops@example.com"}},
+			expected: "spiffe://example.com/collector",
+		},
+		{
+			name:     "email SAN",
+			tmpl:     &x509.Certificate{Subject: pkix.Name{CommonName: "ignored"}, EmailAddresses: []string{"ops@example.com"}},
+			expected: "ops@example.com",
+		},
+		{name: "CN", tmpl: &x509.Certificate{Subject: pkix.Name{CommonName: "collector"}}, expected: "collector"},
+		{name: "subject", tmpl: &x509.Certificate{Subject: pkix.Name{Organization: []string{"flowd"}}}, expected: "O=flowd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if name := certName(newTestCert(t, tt.tmpl, nil).cert); name != tt.expected {
+				t.Fatalf("expected certificate name %q, got %q", tt.expected, name)
+			}
+		})
+	}
+}
+
+// serverTLSFiles writes the certificate, key and client CA bundle of a server and returns their paths along with
+// the CA
+func serverTLSFiles(t *testing.T) (string, string, string, *testCert) {
+	ca := newTestCA(t)
+	server := newServerCert(t, ca, "flowd")
+	return writeFile(t, "cert.pem", string(server.certPEM)), writeFile(t, "key.pem", string(server.keyPEM)), writeFile(t, "ca.pem", string(ca.certPEM)), ca
+}
+
+// startTLS serves the handler of a server over HTTPS with its TLS configuration until the test ends
+func startTLS(t *testing.T, s *Server) *httptest.Server {
+	ts := httptest.NewUnstartedServer(s.handler())
+	ts.TLS = s.tls.config()
+	// Refused handshakes are expected
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// tlsClient returns a client trusting a CA and presenting a client certificate of a template signed by signer,
+// or no certificate when tmpl is nil
+func tlsClient(t *testing.T, ca *testCert, tmpl *x509.Certificate, signer *testCert) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cfg := &tls.Config{RootCAs: roots}
+	if tmpl != nil {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		c := newTestCert(t, tmpl, signer)
+		cfg.Certificates = []tls.Certificate{{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+}
+
+func Test_ClientCertificates(t *testing.T) {
+	certFile, keyFile, caFile, ca := serverTLSFiles(t)
+	s := newTestServer(t,
+		WithTLS(certFile, keyFile, caFile, false),
+		WithBindingsFile(writeFile(t, "bindings.json", `{"roles":{"reader":["read"]},"bindings":[{"role":"reader","identities":["cert:collector.example.com","cert:reader"]}]}`)),
+	)
+	ts := startTLS(t, s)
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		status int
+	}{
+		{name: "bound DNS SAN", client: tlsClient(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "reader-not-used"}, DNSNames: []string{"collector.example.com"}}, ca), status: http.StatusOK},
+		{name: "bound CN", client: tlsClient(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "reader"}}, ca), status: http.StatusOK},
+		// The CN is only used without a SAN, so it does not grant the scopes bound to it
+		{name: "CN shadowed by a SAN", client: tlsClient(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "reader"}, DNSNames: []string{"unbound.example.com"}}, ca), status: http.StatusForbidden},
+		{name: "no certificate", client: tlsClient(t, ca, nil, nil), status: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.client.Get(ts.URL + "/flows?hour=1")
+			if err != nil {
+				t.Fatalf("unexpected error sending request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+
+	// Certificates of another CA are refused during the handshake
+	client := tlsClient(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "reader"}}, newTestCA(t))
+	if resp, err := client.Get(ts.URL + "/flows?hour=1"); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected a certificate of another CA to be refused")
+	}
+}
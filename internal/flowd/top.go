@@ -0,0 +1,109 @@
+package flowd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/si74/flow-api/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultTopN is the number of flows returned by the top endpoint when n is not given
+const defaultTopN = 10
+
+// TopHandler serves the heaviest flows of an hour or range of hours
+type TopHandler struct {
+	ts *store.TenantStore
+	mm *Metrics
+	ll *logrus.Logger
+}
+
+func NewTopHandler(ts *store.TenantStore, mm *Metrics, ll *logrus.Logger) *TopHandler {
+	return &TopHandler{
+		ts: ts,
+		mm: mm,
+		ll: ll,
+	}
+}
+
+// ServeHTTP accepts the same parameters as a flows read, along with the number of flows n and the
+// counter they are ranked by in rank_by (bytes_tx, bytes_rx or total, the default)
+func (h *TopHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ll := requestLogger(h.ll, r)
+	ll.Debug("incoming top request")
+
+	start := time.Now()
+
+	if r.Method != "GET" {
+		ll.Debugf("invalid request type %s", r.Method)
+		h.respond(w, r, start, http.StatusBadRequest, newProblem(http.StatusBadRequest, "top flows are only read with GET").body())
+		return
+	}
+	if err := authorize(r, scopeRead); err != nil {
+		ll.Debugf("unauthorized top request: %v", err)
+		h.respond(w, r, start, http.StatusForbidden, newProblem(http.StatusForbidden, err.Error()).body())
+		return
+	}
+
+	query := r.URL.Query()
+	q, err := parseQuery(query)
+	if err != nil {
+		ll.Debugf("invalid top request: %v", err)
+		h.respond(w, r, start, http.StatusBadRequest, newProblem(http.StatusBadRequest, err.Error()).body())
+		return
+	}
+
+	n := defaultTopN
+	if str := query.Get("n"); str != "" {
+		if n, err = strconv.Atoi(str); err != nil || n <= 0 {
+			ll.Debugf("top request parameter n is not a positive int: %s", str)
+			h.respond(w, r, start, http.StatusBadRequest, newProblem(http.StatusBadRequest, "parameter n is not a positive int: "+str).body())
+			return
+		}
+	}
+
+	rank := store.RankTotal
+	if str := query.Get("rank_by"); str != "" {
+		if rank, err = store.ParseRank(str); err != nil {
+			ll.Debugf("top request parameter rank_by is invalid: %v", err)
+			h.respond(w, r, start, http.StatusBadRequest, newProblem(http.StatusBadRequest, "parameter rank_by is invalid: "+err.Error()).body())
+			return
+		}
+	}
+
+	fs, err := scopedStore(h.ts, r)
+	if err != nil {
+		ll.Errorf("%v", err)
+		h.respond(w, r, start, http.StatusInternalServerError, newProblem(http.StatusInternalServerError, "unable to find the flow store of the tenant").body())
+		return
+	}
+
+	flows, err := fs.Top(q, n, rank)
+	if errors.Is(err, store.ErrInvalidQuery) {
+		ll.Debugf("invalid top request: %v", err)
+		h.respond(w, r, start, http.StatusBadRequest, newProblem(http.StatusBadRequest, err.Error()).body())
+		return
+	}
+	if err != nil {
+		ll.Debugf("unable to retrieve top flows: %v", err)
+		h.respond(w, r, start, http.StatusInternalServerError, newProblem(http.StatusInternalServerError, "unable to retrieve top flows").body())
+		return
+	}
+
+	body, err := json.Marshal(flows)
+	if err != nil {
+		ll.Debugf("unable to marshal flows: %v", err)
+		h.respond(w, r, start, http.StatusInternalServerError, newProblem(http.StatusInternalServerError, "unable to encode flows").body())
+		return
+	}
+	h.respond(w, r, start, http.StatusOK, body)
+}
+
+// respond records the request metrics and writes the status code and body
+func (h *TopHandler) respond(w http.ResponseWriter, r *http.Request, start time.Time, status int, body []byte) {
+	h.mm.observe("top", r, start, status)
+	writeBody(w, status, body)
+}
@@ -0,0 +1,281 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Columns of a block, in the order they are stored. The key and count columns are followed by a column per
+// counter.
+const (
+	blockKeyColumn = iota
+	blockCountColumn
+	blockCounterColumn
+	blockColumns = blockCounterColumn + numCounters
+)
+
+// rawFlowSize is the size of a data point held as a *Flow, excluding its strings
+const rawFlowSize = int(unsafe.Sizeof(Flow{}) + unsafe.Sizeof(&Flow{}))
+
+// sealingPolicy describes when buckets stop receiving writes and are sealed into blocks
+type sealingPolicy struct {
+	// openHours is the number of most recent hours, up to and including the newest bucket inserted, left
+	// unsealed. 0 disables sealing.
+	openHours int
+	interval  time.Duration
+}
+
+// sealedPoint is a data point taken out of a flow list to be sealed into a block or written to a snapshot.
+// Flow lists that pre-aggregate data points return a single point holding a bucket's totals.
+type sealedPoint struct {
+	bucket int
+	counters
+	// count is the number of data points folded into the point
+	count int
+}
+
+// flow returns the data point as a flow holding its totals, without its tuple
+func (p sealedPoint) flow() *Flow {
+	flow := &Flow{Hour: p.bucket}
+	p.addTo(flow)
+	return flow
+}
+
+// block is an immutable, compressed columnar encoding of the data points of a shard's flow tuples for a
+// sealed bucket.
+//
+// Flow keys are dictionary coded: every distinct FlowKey is stored once and rows refer to it by index.
+// Rows are sorted by key index and stored column by column. Key indexes are delta encoded as uvarints and
+// each counter is delta encoded against the previous row as a zigzag varint, so a run of similar data
+// points of a tuple takes a byte or two per counter.
+type block struct {
+	bucket int
+	// keys is the dictionary of flow keys, sorted
+	keys []FlowKey
+	cols [blockColumns][]byte
+	rows int
+	// points is the number of data points folded into the rows
+	points int
+	// rawSize is the estimated size of the rows held as *Flow data points and size the size of the block
+	rawSize int
+	size    int
+}
+
+// newBlock encodes the data points of each flow tuple for a bucket into a block
+func newBlock(bucket int, points map[FlowKey][]sealedPoint) *block {
+	b := &block{
+		bucket: bucket,
+		keys:   make([]FlowKey, 0, len(points)),
+	}
+	for key := range points {
+		b.keys = append(b.keys, key)
+	}
+	sort.Slice(b.keys, func(i, j int) bool { return lessKey(b.keys[i], b.keys[j]) })
+
+	var prevKey int
+	var prev counters
+	for i, key := range b.keys {
+		for _, p := range points[key] {
+			b.cols[blockKeyColumn] = appendUvarint(b.cols[blockKeyColumn], uint64(i-prevKey))
+			b.cols[blockCountColumn] = appendUvarint(b.cols[blockCountColumn], uint64(p.count))
+			prevFields := prev.fields()
+			for j, v := range p.fields() {
+				col := blockCounterColumn + j
+				// Deltas wrap around and decoding wraps them back, so a decrease is a small negative varint
+				b.cols[col] = appendVarint(b.cols[col], int64(*v-*prevFields[j]))
+			}
+			prevKey, prev = i, p.counters
+
+			b.rows++
+			b.points += p.count
+			b.rawSize += rawFlowSize + len(key.Src) + len(key.Dst) + len(key.VpcID)
+		}
+	}
+
+	b.size = int(unsafe.Sizeof(*b)) + len(b.keys)*int(unsafe.Sizeof(FlowKey{}))
+	for _, key := range b.keys {
+		b.size += len(key.Src) + len(key.Dst) + len(key.VpcID)
+	}
+	for _, col := range b.cols {
+		b.size += len(col)
+	}
+	return b
+}
+
+func lessKey(a, b FlowKey) bool {
+	if a.Src != b.Src {
+		return a.Src < b.Src
+	}
+	if a.Dst != b.Dst {
+		return a.Dst < b.Dst
+	}
+	if a.VpcID != b.VpcID {
+		return a.VpcID < b.VpcID
+	}
+	if c := comparePrefix(a.SrcIP, b.SrcIP); c != 0 {
+		return c < 0
+	}
+	if c := comparePrefix(a.DstIP, b.DstIP); c != 0 {
+		return c < 0
+	}
+	if a.SrcPort != b.SrcPort {
+		return a.SrcPort < b.SrcPort
+	}
+	if a.DstPort != b.DstPort {
+		return a.DstPort < b.DstPort
+	}
+	return a.Protocol < b.Protocol
+}
+
+// each decodes the rows of the block in order
+func (b *block) each(fn func(key FlowKey, p sealedPoint)) error {
+	var ds [blockColumns]decoder
+	for i, col := range b.cols {
+		ds[i] = decoder{buf: col}
+	}
+
+	var key int64
+	var c counters
+	for r := 0; r < b.rows; r++ {
+		key += int64(ds[blockKeyColumn].uvarint())
+		count := ds[blockCountColumn].uvarint()
+		for j, v := range c.fields() {
+			*v += uint64(ds[blockCounterColumn+j].varint())
+		}
+		for _, d := range ds {
+			if d.err != nil {
+				return fmt.Errorf("corrupt block for bucket %d at row %d: %w", b.bucket, r, d.err)
+			}
+		}
+		if key >= int64(len(b.keys)) {
+			return fmt.Errorf("corrupt block for bucket %d at row %d: key index %d out of range", b.bucket, r, key)
+		}
+		fn(b.keys[key], sealedPoint{bucket: b.bucket, counters: c, count: int(count)})
+	}
+	return nil
+}
+
+// aggregate returns the totals of every flow tuple in the block matching the filter.
+// The filter is applied once to the key dictionary rather than to every row. If a total saturates the totals
+// are returned along with errOverflow.
+func (b *block) aggregate(filter Filter) (map[FlowKey]*Flow, error) {
+	var saturated bool
+	matched := make(map[FlowKey]bool, len(b.keys))
+	for _, key := range b.keys {
+		matched[key] = filter.Match(key)
+	}
+
+	flows := map[FlowKey]*Flow{}
+	err := b.each(func(key FlowKey, p sealedPoint) {
+		if !matched[key] {
+			return
+		}
+		flow, ok := flows[key]
+		if !ok {
+			flow = key.flow(b.bucket)
+			flows[key] = flow
+		}
+		if p.addTo(flow) {
+			saturated = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if saturated {
+		return flows, errOverflow
+	}
+	return flows, nil
+}
+
+// Seal encodes the data points of every bucket older than the open hours into immutable columnar blocks, a
+// block per bucket. Data points inserted for a bucket after it was sealed are merged into its block by the
+// next seal.
+// It returns the number of data points sealed.
+func (fs *MemoryStore) Seal() int {
+	if fs.sealing.openHours <= 0 {
+		return 0
+	}
+
+	start := fs.now()
+
+	before := int(atomic.LoadInt64(&fs.newestBucket)) - fs.timeline.hours(fs.sealing.openHours) + 1
+	var sealed int
+	for _, s := range fs.shards {
+		sealed += fs.sealShard(s, before)
+	}
+
+	fs.observeBlocks()
+	fs.mm.sealDuration.Observe(time.Since(start).Seconds())
+
+	fs.ll.Debugf("sealed %d flows older than %v", sealed, fs.timeline.start(before))
+	return sealed
+}
+
+// sealShard moves the data points older than the given bucket out of the shard's flow lists and into blocks,
+// removing flow tuples left without data points
+func (fs *MemoryStore) sealShard(s *shard, before int) int {
+	s.lock()
+	defer s.unlock()
+
+	var sealed int
+	byBucket := map[int]map[FlowKey][]sealedPoint{}
+	for key, list := range s.flowMap {
+		for _, p := range list.take(before) {
+			points, ok := byBucket[p.bucket]
+			if !ok {
+				points = map[FlowKey][]sealedPoint{}
+				byBucket[p.bucket] = points
+			}
+			points[key] = append(points[key], p)
+			sealed += p.count
+		}
+		if list.len() == 0 {
+			s.remove(key)
+		}
+	}
+
+	for bucket, points := range byBucket {
+		merged := map[FlowKey][]sealedPoint{}
+		if b, ok := s.blocks[bucket]; ok {
+			err := b.each(func(key FlowKey, p sealedPoint) {
+				merged[key] = append(merged[key], p)
+			})
+			if err != nil {
+				fs.ll.Errorf("dropping block: %v", err)
+				merged = map[FlowKey][]sealedPoint{}
+			}
+		}
+		for key, p := range points {
+			merged[key] = append(merged[key], p...)
+		}
+		s.blocks[bucket] = newBlock(bucket, merged)
+	}
+	return sealed
+}
+
+// observeBlocks updates the block metrics from the blocks held across all shards
+func (fs *MemoryStore) observeBlocks() {
+	var blocks, rawSize, size int
+	for _, s := range fs.shards {
+		s.rlock()
+		for _, b := range s.blocks {
+			blocks++
+			rawSize += b.rawSize
+			size += b.size
+		}
+		s.runlock()
+	}
+
+	fs.mm.blocks.Set(float64(blocks))
+	fs.mm.blockRawBytes.Set(float64(rawSize))
+	fs.mm.blockBytes.Set(float64(size))
+	ratio := 0.0
+	if size > 0 {
+		ratio = float64(rawSize) / float64(size)
+	}
+	fs.mm.blockCompressionRatio.Set(ratio)
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"io"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func Test_Seal(t *testing.T) {
+	insert := []*Flow{
+		{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 100, BytesRx: 300, Hour: 1},
+		{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 200, BytesRx: 600, Hour: 1},
+		{Src: "baz", Dst: "qux", VpcID: "vpc-0", BytesTx: 100, BytesRx: 500, Hour: 1},
+		{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 50, BytesRx: 70, Hour: 2},
+		{Src: "baz", Dst: "qux", VpcID: "vpc-1", BytesTx: 100, BytesRx: 500, Hour: 3},
+	}
+	// Inserted for hour 1 after it was sealed
+	late := []*Flow{
+		{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 1, BytesRx: 2, Hour: 1},
+		{Src: "baz", Dst: "qux", VpcID: "vpc-1", BytesTx: 3, BytesRx: 4, Hour: 1},
+	}
+
+	for _, version := range []FlowListVersion{FlowListV1, FlowListV2, FlowListBucket} {
+		t.Run(version.String(), func(t *testing.T) {
+			ll := logrus.New()
+			ll.SetOutput(io.Discard)
+
+			// The unsealed store is the reference the sealed store must agree with
+			reference, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithFlowListVersion(version))
+			if err != nil {
+				t.Fatalf("unexpected error creating flow store: %v", err)
+			}
+			store, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithFlowListVersion(version), WithShards(2), WithSealing(1, 0))
+			if err != nil {
+				t.Fatalf("unexpected error creating flow store: %v", err)
+			}
+
+			for _, fs := range []*MemoryStore{reference, store} {
+				if err := fs.Insert(insert); err != nil {
+					t.Fatalf("unexpected error inserting flows: %v", err)
+				}
+			}
+
+			// Hours 1 and 2 are sealed, hour 3 is left open
+			if sealed := store.Seal(); sealed != 4 {
+				t.Fatalf("expected 4 flows sealed, got %d", sealed)
+			}
+			if keys := flowKeyCount(store); keys != 1 {
+				t.Fatalf("expected 1 flow key left unsealed, got %d", keys)
+			}
+
+			for _, fs := range []*MemoryStore{reference, store} {
+				if err := fs.Insert(late); err != nil {
+					t.Fatalf("unexpected error inserting flows: %v", err)
+				}
+			}
+
+			check := func() {
+				t.Helper()
+				for _, hour := range []int{1, 2, 3, 4} {
+					expected, err := reference.Get(hour)
+					if err != nil {
+						t.Fatalf("unexpected error retrieving flows: %v", err)
+					}
+					flows, err := store.Get(hour)
+					if err != nil {
+						t.Fatalf("unexpected error retrieving flows: %v", err)
+					}
+					if diff := cmp.Diff(flows, expected, cmpopts.SortSlices(less)); diff != "" {
+						t.Fatalf("unexpected flows for hour %d: %v", hour, diff)
+					}
+				}
+			}
+
+			// Late flows are read alongside the block and merged into it by the next seal
+			check()
+			if sealed := store.Seal(); sealed != 2 {
+				t.Fatalf("expected 2 flows sealed, got %d", sealed)
+			}
+			check()
+
+			if blocks := metricValue(t, store.mm.blocks); blocks != 3 {
+				t.Fatalf("expected 3 blocks, got %v", blocks)
+			}
+			if ratio := metricValue(t, store.mm.blockCompressionRatio); ratio <= 0 {
+				t.Fatalf("expected a positive compression ratio, got %v", ratio)
+			}
+			if size := metricValue(t, store.mm.flows); size != float64(len(insert)+len(late)) {
+				t.Fatalf("expected flowstore size %d, got %v", len(insert)+len(late), size)
+			}
+		})
+	}
+}
+
+func Test_SealPurge(t *testing.T) {
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	store, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithFlowListVersion(FlowListV2), WithSealing(1, 0), WithRetention(1, RetentionNewestHour))
+	if err != nil {
+		t.Fatalf("unexpected error creating flow store: %v", err)
+	}
+	if err := store.Insert(walFlows); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+
+	// Hour 1 is sealed and then purged along with its block
+	if sealed := store.Seal(); sealed != 3 {
+		t.Fatalf("expected 3 flows sealed, got %d", sealed)
+	}
+	if removed := store.Purge(); removed != 3 {
+		t.Fatalf("expected 3 flows purged, got %d", removed)
+	}
+	if blocks := metricValue(t, store.mm.blocks); blocks != 0 {
+		t.Fatalf("expected no blocks after purge, got %v", blocks)
+	}
+	if size := metricValue(t, store.mm.flows); size != 1 {
+		t.Fatalf("expected flowstore size 1, got %v", size)
+	}
+}
+
+func Test_BlockCompression(t *testing.T) {
+	// Data points of a few tuples with similar byte counters
+	points := map[FlowKey][]sealedPoint{}
+	for i := 0; i < 1000; i++ {
+		key := FlowKey{Src: "frontend", Dst: "backend", VpcID: []string{"vpc-0", "vpc-1", "vpc-2"}[i%3]}
+		points[key] = append(points[key], sealedPoint{bucket: 1, counters: counters{bytesTx: uint64(1000 + i%7), bytesRx: uint64(5000 - i%11)}, count: 1})
+	}
+
+	b := newBlock(1, points)
+	if b.rows != 1000 || b.points != 1000 {
+		t.Fatalf("expected 1000 rows and points, got %d and %d", b.rows, b.points)
+	}
+	if ratio := float64(b.rawSize) / float64(b.size); ratio < 10 {
+		t.Fatalf("expected a compression ratio of at least 10, got %v", ratio)
+	}
+
+	decoded := map[FlowKey][]sealedPoint{}
+	if err := b.each(func(key FlowKey, p sealedPoint) { decoded[key] = append(decoded[key], p) }); err != nil {
+		t.Fatalf("unexpected error decoding block: %v", err)
+	}
+	if diff := cmp.Diff(decoded, points, cmp.AllowUnexported(sealedPoint{}, counters{})); diff != "" {
+		t.Fatalf("unexpected decoded block: %v", diff)
+	}
+}
@@ -0,0 +1,405 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// boltHours holds a nested bucket per time bucket of the store's granularity, keyed by boltHourKey,
+	// mapping encoded flow keys to the time bucket's totals for the tuple
+	boltHours = []byte("hours")
+	// boltMeta holds the newest time bucket inserted, the number of data points stored and the granularity
+	// in seconds
+	boltMeta        = []byte("meta")
+	boltNewestHour  = []byte("newest_hour")
+	boltDataPoints  = []byte("data_points")
+	boltGranularity = []byte("granularity")
+)
+
+// BoltStore is a FlowStore kept in an embedded on-disk bbolt database.
+// Data points are folded into per-bucket totals for each flow tuple on insert, so the database grows with the
+// number of buckets and tuples rather than with the number of data points and only the pages being read or
+// written need to be held in memory. The granularity of the buckets is fixed when the database is created.
+type BoltStore struct {
+	db        *bolt.DB
+	timeline  timeline
+	retention retentionPolicy
+	mm        *Metrics
+	ll        *logrus.Logger
+	// now returns the current time, it is replaced in tests
+	now func() time.Time
+}
+
+// NewBoltStore opens, creating if needed, the bbolt database configured with WithBoltPath
+func NewBoltStore(reg prometheus.Registerer, ll *logrus.Logger, opts ...Option) (*BoltStore, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	tl, err := newTimeline(cfg.granularity)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkBolt(); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(cfg.boltPath, 0o644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open bolt database %s: %w", cfg.boltPath, err)
+	}
+
+	var dataPoints uint64
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltHours); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(boltMeta)
+		if err != nil {
+			return err
+		}
+		dataPoints = boltUint(meta.Get(boltDataPoints))
+
+		// The granularity is recorded when the database is created
+		width := int64(boltUint(meta.Get(boltGranularity)))
+		if width != 0 && width != tl.width {
+			return fmt.Errorf("database granularity %v does not match configured granularity %v", time.Duration(width)*time.Second, tl.granularity())
+		}
+		return putBoltUint(meta, boltGranularity, uint64(tl.width))
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to initialize bolt database %s: %w", cfg.boltPath, err)
+	}
+
+	mm := NewMetrics(reg)
+	mm.flows.Set(float64(dataPoints))
+	ll.Infof("opened bolt database %s holding %d flows", cfg.boltPath, dataPoints)
+
+	return &BoltStore{
+		db:       db,
+		timeline: tl,
+		retention: retentionPolicy{
+			hours:    cfg.retentionHours,
+			mode:     cfg.retentionMode,
+			interval: cfg.purgeInterval,
+			timeline: tl,
+		},
+		mm:  mm,
+		ll:  ll,
+		now: time.Now,
+	}, nil
+}
+
+// checkBolt returns an error for the options of the memory backend the bolt backend does not support, rather
+// than silently ignoring them
+func (cfg config) checkBolt() error {
+	defaults := defaultConfig()
+	var unsupported string
+	switch {
+	case cfg.maxTuples != 0:
+		unsupported = "tuple limits"
+	case cfg.walDir != "":
+		unsupported = "write-ahead logs"
+	case cfg.snapshotDir != "":
+		unsupported = "snapshots"
+	case cfg.sealOpenHours != 0:
+		unsupported = "sealing"
+	case len(cfg.rollups) > 0:
+		unsupported = "rollups"
+	case cfg.flowListVersion != defaults.flowListVersion:
+		unsupported = "flow list versions"
+	case cfg.shards != defaults.shards:
+		unsupported = "shards"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%s are not supported by the bolt backend", unsupported)
+}
+
+// boltHourKey encodes a time bucket so that buckets sort in numeric order, including negative buckets
+func boltHourKey(hour int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(hour)^(1<<63))
+	return key
+}
+
+func boltHour(key []byte) int {
+	return int(binary.BigEndian.Uint64(key) ^ (1 << 63))
+}
+
+// boltFlowKey encodes a flow tuple with appendKey
+func boltFlowKey(key FlowKey) []byte {
+	return appendKey(nil, key)
+}
+
+func decodeBoltFlowKey(k []byte) (FlowKey, error) {
+	d := &decoder{buf: k}
+	key := d.key()
+	return key, d.err
+}
+
+func boltUint(v []byte) uint64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func putBoltUint(b *bolt.Bucket, key []byte, v uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	return b.Put(key, buf)
+}
+
+// boltTotals are the totals of a flow tuple for a time bucket
+type boltTotals struct {
+	counters
+	// count is the number of data points folded into the totals
+	count uint64
+}
+
+// decodeBoltTotals decodes totals written by encode
+func decodeBoltTotals(v []byte) (boltTotals, error) {
+	d := &decoder{buf: v}
+	t := boltTotals{counters: d.counters()}
+	t.count = d.uvarint()
+	return t, d.err
+}
+
+// encode encodes the counters followed by the count
+func (t boltTotals) encode() []byte {
+	buf := appendCounters(nil, t.counters)
+	return appendUvarint(buf, t.count)
+}
+
+// Insert folds flow data points into the per-bucket totals of their tuples in a single transaction
+func (bs *BoltStore) Insert(flows []*Flow) error {
+	if len(flows) == 0 {
+		return nil
+	}
+
+	var inserted, saturated int
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		hours := tx.Bucket(boltHours)
+		meta := tx.Bucket(boltMeta)
+		newest := int(int64(boltUint(meta.Get(boltNewestHour))))
+
+		for _, flow := range flows {
+			fk, err := validKey(flow)
+			if err != nil {
+				bs.ll.Errorf("unable to insert flow: %v", err)
+				continue
+			}
+			bucket := bs.timeline.flowBucket(flow)
+			hour, err := hours.CreateBucketIfNotExists(boltHourKey(bucket))
+			if err != nil {
+				return err
+			}
+
+			key := boltFlowKey(fk)
+			var totals boltTotals
+			if v := hour.Get(key); v != nil {
+				if totals, err = decodeBoltTotals(v); err != nil {
+					return fmt.Errorf("corrupt totals for %v at bucket %d: %w", fk, bucket, err)
+				}
+			}
+			if totals.add(flowCounters(flow)) {
+				saturated++
+			}
+			totals.count++
+			if err := hour.Put(key, totals.encode()); err != nil {
+				return err
+			}
+
+			if bucket > newest {
+				newest = bucket
+			}
+			inserted++
+		}
+
+		if err := putBoltUint(meta, boltNewestHour, uint64(int64(newest))); err != nil {
+			return err
+		}
+		return putBoltUint(meta, boltDataPoints, boltUint(meta.Get(boltDataPoints))+uint64(inserted))
+	})
+	if err != nil {
+		return fmt.Errorf("unable to insert flows: %w", err)
+	}
+
+	bs.mm.flows.Add(float64(inserted))
+	bs.mm.counterOverflows.Add(float64(saturated))
+	return nil
+}
+
+// Get returns an aggregation of flow stats for all tuples for a given hour
+func (bs *BoltStore) Get(hour int) ([]*Flow, error) {
+	return bs.Query(Query{Start: hour, End: hour + 1})
+}
+
+// GetRange returns an aggregation of flow stats for all tuples over the hours from start, inclusive,
+// to end, exclusive
+func (bs *BoltStore) GetRange(start, end int) ([]*Flow, error) {
+	return bs.Query(Query{Start: start, End: end})
+}
+
+// Query sums the totals of each flow tuple matching the filter across the time buckets in the range,
+// in a single read transaction, and rolls them up to the group by dimensions
+func (bs *BoltStore) Query(q Query) ([]*Flow, error) {
+	start, end, err := bs.timeline.buckets(q)
+	if err != nil {
+		return nil, err
+	}
+
+	var saturated int
+	flows := []*Flow{}
+	byKey := map[FlowKey]*Flow{}
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		hours := tx.Bucket(boltHours)
+		c := hours.Cursor()
+		for k, _ := c.Seek(boltHourKey(start)); k != nil && boltHour(k) < end; k, _ = c.Next() {
+			hour := boltHour(k)
+			err := hours.Bucket(k).ForEach(func(k, v []byte) error {
+				key, err := decodeBoltFlowKey(k)
+				if err != nil {
+					return fmt.Errorf("corrupt flow key at bucket %d: %w", hour, err)
+				}
+				if !q.Filter.Match(key) {
+					return nil
+				}
+				totals, err := decodeBoltTotals(v)
+				if err != nil {
+					return fmt.Errorf("corrupt totals for %v at bucket %d: %w", key, hour, err)
+				}
+
+				flow, ok := byKey[key]
+				if !ok {
+					flow = key.flow(start)
+					byKey[key] = flow
+					flows = append(flows, flow)
+				}
+				if totals.addTo(flow) {
+					saturated++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	flows, grouped := q.group(flows)
+	bs.mm.counterOverflows.Add(float64(saturated + grouped))
+	bs.timeline.report(flows, start)
+	return flows, nil
+}
+
+// Top returns the n flows of a query ranked highest by the given rank, highest first
+func (bs *BoltStore) Top(q Query, n int, rank Rank) ([]*Flow, error) {
+	if err := validateTop(n, rank); err != nil {
+		return nil, err
+	}
+	flows, err := bs.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	return topFlows(flows, n, rank), nil
+}
+
+// Run purges expired time buckets on the configured purge interval until the context is cancelled.
+// Run returns immediately if no retention period is configured.
+func (bs *BoltStore) Run(ctx context.Context) error {
+	if bs.retention.hours <= 0 {
+		return nil
+	}
+	if bs.retention.interval <= 0 {
+		return fmt.Errorf("purge interval must be greater than 0, got %v", bs.retention.interval)
+	}
+
+	bs.ll.Infof("purging flows older than %d hours (%v) every %v", bs.retention.hours, bs.retention.mode, bs.retention.interval)
+	ticker := time.NewTicker(bs.retention.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if _, err := bs.Purge(); err != nil {
+				bs.ll.Errorf("unable to purge flows: %v", err)
+			}
+		}
+	}
+}
+
+// Purge removes the time buckets older than the retention period and returns the number of data points removed
+func (bs *BoltStore) Purge() (int, error) {
+	if bs.retention.hours <= 0 {
+		return 0, nil
+	}
+
+	start := bs.now()
+	var removed uint64
+	var cutoff int
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		hours := tx.Bucket(boltHours)
+		meta := tx.Bucket(boltMeta)
+
+		newest := int(int64(boltUint(meta.Get(boltNewestHour))))
+		cutoff = bs.retention.cutoff(newest, start)
+
+		// Collect the expired time buckets first, buckets must not be deleted while iterating
+		var expired [][]byte
+		c := hours.Cursor()
+		for k, _ := c.First(); k != nil && boltHour(k) < cutoff; k, _ = c.Next() {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+
+		for _, k := range expired {
+			err := hours.Bucket(k).ForEach(func(_, v []byte) error {
+				totals, err := decodeBoltTotals(v)
+				if err != nil {
+					return err
+				}
+				removed += totals.count
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("corrupt totals at bucket %d: %w", boltHour(k), err)
+			}
+			if err := hours.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+
+		return putBoltUint(meta, boltDataPoints, boltUint(meta.Get(boltDataPoints))-removed)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	bs.mm.flows.Sub(float64(removed))
+	bs.mm.purged.Add(float64(removed))
+	bs.mm.purgeDuration.Observe(time.Since(start).Seconds())
+	bs.mm.purgeLastRun.Set(float64(start.Unix()))
+
+	bs.ll.Debugf("purged %d flows older than %v", removed, bs.timeline.start(cutoff))
+	return int(removed), nil
+}
+
+// Close closes the bolt database
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// openBoltStore opens a bolt flow store in dir
+func openBoltStore(t *testing.T, dir string, opts ...Option) *BoltStore {
+	t.Helper()
+
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	opts = append([]Option{WithBackend(BackendBolt), WithBoltPath(filepath.Join(dir, "flows.db"))}, opts...)
+	fs, err := NewFlowStore(prometheus.NewPedanticRegistry(), ll, opts...)
+	if err != nil {
+		t.Fatalf("unexpected error creating flow store: %v", err)
+	}
+	bs, ok := fs.(*BoltStore)
+	if !ok {
+		t.Fatalf("expected a bolt flow store, got %T", fs)
+	}
+	return bs
+}
+
+func Test_BoltStore(t *testing.T) {
+	dir := t.TempDir()
+
+	// The bolt store must agree with the in-memory store
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+	reference, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll)
+	if err != nil {
+		t.Fatalf("unexpected error creating flow store: %v", err)
+	}
+	if err := reference.Insert(walFlows); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+
+	store := openBoltStore(t, dir)
+	if err := store.Insert(walFlows[:2]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if err := store.Insert(walFlows[2:]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("unexpected error closing flow store: %v", err)
+	}
+
+	// Flows are persisted across reopening the database
+	reopened := openBoltStore(t, dir)
+	defer reopened.Close()
+
+	for _, hour := range []int{1, 2, 3} {
+		expected, err := reference.Get(hour)
+		if err != nil {
+			t.Fatalf("unexpected error retrieving flows: %v", err)
+		}
+		flows, err := reopened.Get(hour)
+		if err != nil {
+			t.Fatalf("unexpected error retrieving flows: %v", err)
+		}
+		if diff := cmp.Diff(flows, expected, cmpopts.SortSlices(less)); diff != "" {
+			t.Fatalf("unexpected flows for hour %d: %v", hour, diff)
+		}
+	}
+	if size := metricValue(t, reopened.mm.flows); size != float64(len(walFlows)) {
+		t.Fatalf("expected flowstore size %d, got %v", len(walFlows), size)
+	}
+}
+
+func Test_BoltPurge(t *testing.T) {
+	store := openBoltStore(t, t.TempDir(), WithRetention(1, RetentionNewestHour))
+	defer store.Close()
+
+	if err := store.Insert(walFlows); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+
+	// Only hour 2 is retained
+	removed, err := store.Purge()
+	if err != nil {
+		t.Fatalf("unexpected error purging flows: %v", err)
+	}
+	if removed != 3 {
+		t.Fatalf("expected 3 flows purged, got %d", removed)
+	}
+
+	flows, err := store.Get(1)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving flows: %v", err)
+	}
+	if len(flows) != 0 {
+		t.Fatalf("expected no flows for purged hour 1, got %+v", flows)
+	}
+	if size := metricValue(t, store.mm.flows); size != 1 {
+		t.Fatalf("expected flowstore size 1, got %v", size)
+	}
+}
+
+func Test_BoltUnsupportedOptions(t *testing.T) {
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	for name, opt := range map[string]Option{
+		"tuple limit":       WithMaxTuples(1),
+		"write-ahead log":   WithWAL(t.TempDir(), SyncAlways, 0),
+		"snapshots":         WithSnapshots(t.TempDir(), 0, 1),
+		"sealing":           WithSealing(2, 0),
+		"rollup":            WithRollup(ResolutionDay, 7),
+		"flow list version": WithFlowListVersion(FlowListV2),
+		"shards":            WithShards(4),
+	} {
+		if _, err := NewBoltStore(prometheus.NewPedanticRegistry(), ll, WithBoltPath(filepath.Join(t.TempDir(), "flows.db")), opt); err == nil {
+			t.Fatalf("expected an error creating a bolt flow store with a %s", name)
+		}
+	}
+}
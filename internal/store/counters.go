@@ -0,0 +1,78 @@
+package store
+
+import (
+	"errors"
+	"math"
+)
+
+// numCounters is the number of counters carried by a flow
+const numCounters = 7
+
+// errOverflow is returned along with the saturated aggregate when summing counters exceeds their range
+var errOverflow = errors.New("flow counter overflow, saturated at the maximum counter value")
+
+// counters are the counters of a flow, summed when flow data points are aggregated
+type counters struct {
+	bytesTx     uint64
+	bytesRx     uint64
+	packetsTx   uint64
+	packetsRx   uint64
+	connections uint64
+	dropped     uint64
+	retransmits uint64
+}
+
+// flowCounters returns the counters of a flow
+func flowCounters(flow *Flow) counters {
+	return counters{
+		bytesTx:     flow.BytesTx,
+		bytesRx:     flow.BytesRx,
+		packetsTx:   flow.PacketsTx,
+		packetsRx:   flow.PacketsRx,
+		connections: flow.Connections,
+		dropped:     flow.Dropped,
+		retransmits: flow.Retransmits,
+	}
+}
+
+// flowFields returns the counters of a flow in the order they are encoded
+func flowFields(flow *Flow) [numCounters]*uint64 {
+	return [numCounters]*uint64{&flow.BytesTx, &flow.BytesRx, &flow.PacketsTx, &flow.PacketsRx, &flow.Connections, &flow.Dropped, &flow.Retransmits}
+}
+
+// fields returns the counters in the order they are encoded, starting with the byte counters
+func (c *counters) fields() [numCounters]*uint64 {
+	return [numCounters]*uint64{&c.bytesTx, &c.bytesRx, &c.packetsTx, &c.packetsRx, &c.connections, &c.dropped, &c.retransmits}
+}
+
+// add sums other counters into the counters and reports whether any sum saturated
+func (c *counters) add(o counters) bool {
+	return sumFields(c.fields(), o.fields())
+}
+
+// addTo sums the counters into a flow and reports whether any sum saturated
+func (c counters) addTo(flow *Flow) bool {
+	return sumFields(flowFields(flow), c.fields())
+}
+
+// sumFields adds each of src to dst, saturating at the maximum counter value rather than wrapping, and
+// reports whether any sum saturated
+func sumFields(dst, src [numCounters]*uint64) bool {
+	var saturated bool
+	for i, v := range dst {
+		var ok bool
+		if *v, ok = addCounter(*v, *src[i]); !ok {
+			saturated = true
+		}
+	}
+	return saturated
+}
+
+// addCounter returns the sum of two counter values, or the maximum counter value and false if the sum
+// overflows
+func addCounter(a, b uint64) (uint64, bool) {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64, false
+	}
+	return a + b, true
+}
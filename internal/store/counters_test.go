@@ -0,0 +1,229 @@
+package store
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+var counterFlows = []*Flow{
+	{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 100, BytesRx: 300, PacketsTx: 10, PacketsRx: 20, Connections: 1, Hour: 1},
+	{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 200, BytesRx: 600, PacketsTx: 15, PacketsRx: 30, Connections: 2, Dropped: 3, Retransmits: 4, Hour: 2},
+	{Src: "foo", Dst: "bar", VpcID: "vpc-1", BytesTx: 50, BytesRx: 50, Dropped: 7, Hour: 2},
+	// Byte-only data points aggregate with the others
+	{Src: "baz", Dst: "bar", VpcID: "vpc-1", BytesTx: 1, BytesRx: 2, Hour: 1},
+	{Src: "baz", Dst: "bar", VpcID: "vpc-1", BytesTx: 3, BytesRx: 4, PacketsTx: 1, Hour: 2},
+}
+
+func Test_QueryCounters(t *testing.T) {
+	tests := []struct {
+		name     string
+		q        Query
+		expected []*Flow
+	}{
+		{
+			name: "single hour",
+			q:    Query{Start: 1, End: 2},
+			expected: []*Flow{
+				{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 100, BytesRx: 300, PacketsTx: 10, PacketsRx: 20, Connections: 1, Hour: 1},
+				{Src: "baz", Dst: "bar", VpcID: "vpc-1", BytesTx: 1, BytesRx: 2, Hour: 1},
+			},
+		},
+		{
+			name: "range",
+			q:    Query{Start: 1, End: 3},
+			expected: []*Flow{
+				{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 300, BytesRx: 900, PacketsTx: 25, PacketsRx: 50, Connections: 3, Dropped: 3, Retransmits: 4, Hour: 1},
+				{Src: "foo", Dst: "bar", VpcID: "vpc-1", BytesTx: 50, BytesRx: 50, Dropped: 7, Hour: 1},
+				{Src: "baz", Dst: "bar", VpcID: "vpc-1", BytesTx: 4, BytesRx: 6, PacketsTx: 1, Hour: 1},
+			},
+		},
+		{
+			name: "grouped",
+			q:    Query{Start: 1, End: 3, GroupBy: []Dimension{DimensionDst}},
+			expected: []*Flow{
+				{Dst: "bar", BytesTx: 354, BytesRx: 956, PacketsTx: 26, PacketsRx: 50, Connections: 3, Dropped: 10, Retransmits: 4, Hour: 1},
+			},
+		},
+	}
+
+	stores := openQueryStores(t, counterFlows)
+	for name, store := range stores {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				flows, err := store.Query(tt.q)
+				if err != nil {
+					t.Fatalf("unexpected error retrieving flows: %v", err)
+				}
+				if diff := cmp.Diff(flows, reported(tt.expected), cmpopts.SortSlices(less)); diff != "" {
+					t.Fatalf("unexpected flows: %v", diff)
+				}
+			})
+		}
+	}
+}
+
+func Test_CountersRestore(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithRollup(ResolutionDay, 0)}
+
+	store := openSnapshotStore(t, dir, opts...)
+	if err := store.Insert(counterFlows[:2]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if _, err := store.Snapshot(); err != nil {
+		t.Fatalf("unexpected error taking snapshot: %v", err)
+	}
+	// Flows inserted after the snapshot are replayed from the write-ahead log
+	if err := store.Insert(counterFlows[2:]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	// Whole days are answered by the rollup, the remaining hours by the flow lists
+	queries := []Query{{Start: 1, End: 3}, {Start: 1, End: 48}}
+	var expected [][]*Flow
+	for _, q := range queries {
+		flows, err := store.Query(q)
+		if err != nil {
+			t.Fatalf("unexpected error retrieving flows: %v", err)
+		}
+		expected = append(expected, flows)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("unexpected error closing flow store: %v", err)
+	}
+
+	restored := openSnapshotStore(t, dir, opts...)
+	defer restored.Close()
+	for i, q := range queries {
+		flows, err := restored.Query(q)
+		if err != nil {
+			t.Fatalf("unexpected error retrieving flows: %v", err)
+		}
+		if diff := cmp.Diff(flows, expected[i], cmpopts.SortSlices(less)); diff != "" {
+			t.Fatalf("unexpected flows for hours [%d, %d) after restore: %v", q.Start, q.End, diff)
+		}
+	}
+}
+
+func Test_FlowJSON(t *testing.T) {
+	// Byte-only flows keep their original encoding
+	body, err := json.Marshal(reported([]*Flow{{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 100, BytesRx: 300, Hour: 1}})[0])
+	if err != nil {
+		t.Fatalf("unexpected error marshaling flow: %v", err)
+	}
+	if expected := `{"src_app":"foo","dest_app":"bar","vpc_id":"vpc-0","bytes_tx":100,"bytes_rx":300,"timestamp":"1970-01-01T01:00:00Z","hour":1}`; string(body) != expected {
+		t.Fatalf("expected %s, got %s", expected, body)
+	}
+
+	// Counters are unsigned, negative counters are rejected
+	if err := json.Unmarshal([]byte(`{"src_app":"foo","bytes_tx":-1,"hour":1}`), &Flow{}); err == nil {
+		t.Fatal("expected an error unmarshaling a negative counter")
+	}
+
+	var flow Flow
+	if err := json.Unmarshal([]byte(`{"src_app":"foo","bytes_tx":1,"packets_tx":2,"packets_rx":3,"connections":4,"dropped":5,"retransmits":6,"hour":1}`), &flow); err != nil {
+		t.Fatalf("unexpected error unmarshaling flow: %v", err)
+	}
+	if diff := cmp.Diff(flow, Flow{Src: "foo", BytesTx: 1, PacketsTx: 2, PacketsRx: 3, Connections: 4, Dropped: 5, Retransmits: 6, Hour: 1}); diff != "" {
+		t.Fatalf("unexpected flow: %v", diff)
+	}
+}
+
+func Test_CounterOverflow(t *testing.T) {
+	insert := []*Flow{
+		{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: math.MaxUint64 - 1, BytesRx: 1, Hour: 1},
+		{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 5, BytesRx: 1, Hour: 1},
+		{Src: "foo", Dst: "bar", VpcID: "vpc-1", BytesTx: 1, BytesRx: math.MaxUint64, Hour: 3},
+	}
+	tests := []struct {
+		name     string
+		q        Query
+		expected []*Flow
+	}{
+		{
+			name: "hour",
+			q:    Query{Start: 1, End: 2},
+			expected: []*Flow{
+				{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: math.MaxUint64, BytesRx: 2, Hour: 1},
+			},
+		},
+		{
+			name: "grouped",
+			q:    Query{Start: 1, End: 4, GroupBy: []Dimension{DimensionSrc}},
+			expected: []*Flow{
+				{Src: "foo", BytesTx: math.MaxUint64, BytesRx: math.MaxUint64, Hour: 1},
+			},
+		},
+	}
+
+	stores := openQueryStores(t, insert)
+	for name, store := range stores {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				flows, err := store.Query(tt.q)
+				if err != nil {
+					t.Fatalf("unexpected error retrieving flows: %v", err)
+				}
+				if diff := cmp.Diff(flows, reported(tt.expected), cmpopts.SortSlices(less)); diff != "" {
+					t.Fatalf("unexpected flows: %v", diff)
+				}
+			})
+		}
+
+		var mm *Metrics
+		switch s := store.(type) {
+		case *MemoryStore:
+			mm = s.mm
+		case *BoltStore:
+			mm = s.mm
+		}
+		if overflows := metricValue(t, mm.counterOverflows); overflows == 0 {
+			t.Fatalf("%s: expected counter overflows to be reported", name)
+		}
+	}
+}
+
+func Test_CounterRange(t *testing.T) {
+	// Counters are encoded as uvarints, taking a byte up to 127 and 10 bytes at most
+	for v, size := range map[uint64]int{0: 1, 127: 1, 128: 2, math.MaxInt64: 9, math.MaxUint64: 10} {
+		buf := appendCounter(nil, v)
+		d := &decoder{buf: buf}
+		if got := d.counter(); len(buf) != size || got != v || d.err != nil {
+			t.Fatalf("expected counter %d encoded in %d bytes, got %d in %d bytes and %v", v, size, got, len(buf), d.err)
+		}
+	}
+
+	// Counters past the range of a signed integer survive the write-ahead log and snapshots
+	dir := t.TempDir()
+	insert := []*Flow{
+		{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: math.MaxUint64, BytesRx: math.MaxInt64 + 1, Dropped: math.MaxUint64, Hour: 1},
+		{Src: "baz", Dst: "bar", VpcID: "vpc-0", BytesTx: math.MaxUint64 - 1, Retransmits: math.MaxUint64, Hour: 1},
+	}
+
+	store := openSnapshotStore(t, dir)
+	if err := store.Insert(insert[:1]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if _, err := store.Snapshot(); err != nil {
+		t.Fatalf("unexpected error taking snapshot: %v", err)
+	}
+	if err := store.Insert(insert[1:]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("unexpected error closing flow store: %v", err)
+	}
+
+	restored := openSnapshotStore(t, dir)
+	defer restored.Close()
+	flows, err := restored.Get(1)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving flows: %v", err)
+	}
+	if diff := cmp.Diff(flows, reported(insert), cmpopts.SortSlices(less)); diff != "" {
+		t.Fatalf("unexpected flows after restore: %v", diff)
+	}
+}
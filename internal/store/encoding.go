@@ -0,0 +1,278 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"time"
+)
+
+// errShortBuffer is returned when an encoded value extends past the end of its buffer
+var errShortBuffer = errors.New("encoded flow data is truncated")
+
+// flowEncodingVersion is the version of the flow encoding written by appendFlows
+const flowEncodingVersion = 1
+
+// appendFlows appends the compact binary encoding of a batch of flows to buf.
+// A batch is the encoding version and the number of flows followed by each flow's strings and counters as
+// varints.
+func appendFlows(buf []byte, flows []*Flow) []byte {
+	buf = appendUvarint(buf, flowEncodingVersion)
+	buf = appendUvarint(buf, uint64(len(flows)))
+	for _, flow := range flows {
+		buf = appendFlow(buf, flow)
+	}
+	return buf
+}
+
+func appendFlow(buf []byte, flow *Flow) []byte {
+	buf = appendString(buf, flow.Src)
+	buf = appendString(buf, flow.Dst)
+	buf = appendString(buf, flow.VpcID)
+	buf = appendString(buf, flow.SrcIP)
+	buf = appendString(buf, flow.DstIP)
+	buf = appendVarint(buf, int64(flow.SrcPort))
+	buf = appendVarint(buf, int64(flow.DstPort))
+	buf = appendVarint(buf, int64(flow.Protocol))
+	buf = appendCounter(buf, flow.BytesTx)
+	buf = appendCounter(buf, flow.BytesRx)
+	buf = appendCounter(buf, flow.PacketsTx)
+	buf = appendCounter(buf, flow.PacketsRx)
+	buf = appendCounter(buf, flow.Connections)
+	buf = appendCounter(buf, flow.Dropped)
+	buf = appendCounter(buf, flow.Retransmits)
+	buf = appendTimestamp(buf, flow.Timestamp)
+	return appendVarint(buf, int64(flow.Hour))
+}
+
+// appendTimestamp appends a zero for an unset timestamp, or a one followed by its seconds and nanoseconds
+// since the unix epoch
+func appendTimestamp(buf []byte, t Timestamp) []byte {
+	if t.IsZero() {
+		return appendUvarint(buf, 0)
+	}
+	buf = appendUvarint(buf, 1)
+	buf = appendVarint(buf, t.Unix())
+	return appendUvarint(buf, uint64(t.Nanosecond()))
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// appendCounters appends every counter with appendCounter
+func appendCounters(buf []byte, c counters) []byte {
+	for _, v := range c.fields() {
+		buf = appendCounter(buf, *v)
+	}
+	return buf
+}
+
+// appendCounter appends a counter as a uvarint
+func appendCounter(buf []byte, v uint64) []byte {
+	return appendUvarint(buf, v)
+}
+
+// appendKey appends a flow tuple: its strings followed by its IP 5-tuple
+func appendKey(buf []byte, key FlowKey) []byte {
+	buf = appendString(buf, key.Src)
+	buf = appendString(buf, key.Dst)
+	buf = appendString(buf, key.VpcID)
+	return appendIPTuple(buf, key)
+}
+
+// appendIPTuple appends the IP 5-tuple of a flow tuple. Each address is written as its bytes, with no
+// bytes for app flows, followed by its prefix length.
+func appendIPTuple(buf []byte, key FlowKey) []byte {
+	buf = appendPrefix(buf, key.SrcIP)
+	buf = appendPrefix(buf, key.DstIP)
+	buf = appendUvarint(buf, uint64(key.SrcPort))
+	buf = appendUvarint(buf, uint64(key.DstPort))
+	return appendUvarint(buf, uint64(key.Protocol))
+}
+
+func appendPrefix(buf []byte, p netip.Prefix) []byte {
+	if !p.IsValid() {
+		return appendUvarint(buf, 0)
+	}
+	addr := p.Addr().AsSlice()
+	buf = appendUvarint(buf, uint64(len(addr)))
+	buf = append(buf, addr...)
+	return appendUvarint(buf, uint64(p.Bits()))
+}
+
+// decoder reads values encoded by the append functions, recording the first error encountered
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errShortBuffer
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errShortBuffer
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = errShortBuffer
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+// counters decodes counters written by appendCounters
+func (d *decoder) counters() counters {
+	var c counters
+	for _, v := range c.fields() {
+		*v = d.counter()
+	}
+	return c
+}
+
+// counter decodes a counter written by appendCounter
+func (d *decoder) counter() uint64 {
+	return d.uvarint()
+}
+
+// key decodes a flow tuple written by appendKey
+func (d *decoder) key() FlowKey {
+	key := FlowKey{Src: d.string(), Dst: d.string(), VpcID: d.string()}
+	d.ipTuple(&key)
+	return key
+}
+
+// ipTuple decodes an IP 5-tuple written by appendIPTuple into a flow tuple
+func (d *decoder) ipTuple(key *FlowKey) {
+	key.SrcIP = d.prefix()
+	key.DstIP = d.prefix()
+	srcPort, dstPort, protocol := d.uvarint(), d.uvarint(), d.uvarint()
+	if d.err == nil && (srcPort > math.MaxUint16 || dstPort > math.MaxUint16 || protocol > math.MaxUint8) {
+		d.err = fmt.Errorf("encoded ports %d and %d or protocol %d out of range", srcPort, dstPort, protocol)
+	}
+	key.SrcPort, key.DstPort, key.Protocol = uint16(srcPort), uint16(dstPort), uint8(protocol)
+}
+
+func (d *decoder) prefix() netip.Prefix {
+	b := d.string()
+	if d.err != nil || len(b) == 0 {
+		return netip.Prefix{}
+	}
+	addr, ok := netip.AddrFromSlice([]byte(b))
+	if !ok {
+		d.err = fmt.Errorf("encoded address of %d bytes", len(b))
+		return netip.Prefix{}
+	}
+	bits := d.uvarint()
+	if d.err != nil {
+		return netip.Prefix{}
+	}
+	if bits > uint64(addr.BitLen()) {
+		d.err = fmt.Errorf("encoded prefix length %d exceeds address length", bits)
+		return netip.Prefix{}
+	}
+	return netip.PrefixFrom(addr, int(bits))
+}
+
+func (d *decoder) flow() *Flow {
+	return &Flow{
+		Src:         d.string(),
+		Dst:         d.string(),
+		VpcID:       d.string(),
+		SrcIP:       d.string(),
+		DstIP:       d.string(),
+		SrcPort:     int(d.varint()),
+		DstPort:     int(d.varint()),
+		Protocol:    int(d.varint()),
+		BytesTx:     d.counter(),
+		BytesRx:     d.counter(),
+		PacketsTx:   d.counter(),
+		PacketsRx:   d.counter(),
+		Connections: d.counter(),
+		Dropped:     d.counter(),
+		Retransmits: d.counter(),
+		Timestamp:   d.timestamp(),
+		Hour:        int(d.varint()),
+	}
+}
+
+// timestamp decodes a timestamp written by appendTimestamp
+func (d *decoder) timestamp() Timestamp {
+	if d.uvarint() == 0 {
+		return Timestamp{}
+	}
+	secs, nanos := d.varint(), d.uvarint()
+	if d.err == nil && nanos >= uint64(time.Second) {
+		d.err = fmt.Errorf("encoded nanoseconds %d out of range", nanos)
+	}
+	if d.err != nil {
+		return Timestamp{}
+	}
+	return Timestamp{time.Unix(secs, int64(nanos)).UTC()}
+}
+
+// decodeFlows decodes a batch of flows encoded by appendFlows
+func decodeFlows(buf []byte) ([]*Flow, error) {
+	d := &decoder{buf: buf}
+	if version := d.uvarint(); d.err == nil && version != flowEncodingVersion {
+		return nil, fmt.Errorf("unsupported flow encoding version %d", version)
+	}
+	n := d.uvarint()
+	// Every flow takes at least 17 bytes, guard against allocating for a corrupt count
+	if d.err == nil && n > uint64(len(d.buf)/17) {
+		return nil, fmt.Errorf("flow count %d exceeds encoded data", n)
+	}
+
+	flows := make([]*Flow, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		flows = append(flows, d.flow())
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.buf) != 0 {
+		return nil, fmt.Errorf("%d unexpected trailing bytes after flows", len(d.buf))
+	}
+	return flows, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+)
+
+// hourBucket is the running aggregate of every flow data point inserted for an hour
+type hourBucket struct {
+	counters
+	// count is the number of data points folded into the bucket
+	count int
+}
+
+// flowListBucket pre-aggregates flow data points into a bucket per hour on insert.
+// Individual data points are not kept, so memory grows with the number of hours seen rather than
+// with the number of data points and aggregation is a single lookup.
+type flowListBucket struct {
+	buckets map[int]*hourBucket
+}
+
+func newFlowListBucket() flowList {
+	return &flowListBucket{buckets: map[int]*hourBucket{}}
+}
+
+// insert folds a new flow data point into the bucket for its hour, returning errOverflow if a total saturates
+func (fl *flowListBucket) insert(flow *Flow) error {
+	b, ok := fl.buckets[flow.Hour]
+	if !ok {
+		b = &hourBucket{}
+		fl.buckets[flow.Hour] = b
+	}
+	saturated := b.add(flowCounters(flow))
+	b.count++
+	if saturated {
+		return errOverflow
+	}
+	return nil
+}
+
+// get returns an aggregated flow for a given tuple and range of hour timestamps.
+// The range is walked hour by hour unless it is longer than the number of buckets held.
+func (fl *flowListBucket) get(key FlowKey, start, end int) (*Flow, error) {
+	if start <= 0 {
+		return nil, fmt.Errorf("provided hour timestamp must be greater than 0")
+	}
+
+	var found, saturated bool
+	aggregateFlow := key.flow(start)
+	add := func(b *hourBucket) {
+		found = true
+		if b.addTo(aggregateFlow) {
+			saturated = true
+		}
+	}
+
+	if end-start <= len(fl.buckets) {
+		for hour := start; hour < end; hour++ {
+			if b, ok := fl.buckets[hour]; ok {
+				add(b)
+			}
+		}
+	} else {
+		for hour, b := range fl.buckets {
+			if hour >= start && hour < end {
+				add(b)
+			}
+		}
+	}
+
+	// This timestamp was never found, return a nil flow value
+	if !found {
+		return nil, nil
+	}
+	if saturated {
+		return aggregateFlow, errOverflow
+	}
+	return aggregateFlow, nil
+}
+
+// purge removes the buckets of all hours older than the given hour and returns the number of
+// data points that had been folded into them
+func (fl *flowListBucket) purge(before int) int {
+	var removed int
+	for hour, b := range fl.buckets {
+		if hour < before {
+			removed += b.count
+			delete(fl.buckets, hour)
+		}
+	}
+	return removed
+}
+
+// take removes the buckets of all hours older than the given hour and returns their totals
+func (fl *flowListBucket) take(before int) []sealedPoint {
+	var points []sealedPoint
+	for hour, b := range fl.buckets {
+		if hour < before {
+			points = append(points, sealedPoint{bucket: hour, counters: b.counters, count: b.count})
+			delete(fl.buckets, hour)
+		}
+	}
+	return points
+}
+
+func (fl *flowListBucket) len() int {
+	var n int
+	for _, b := range fl.buckets {
+		n += b.count
+	}
+	return n
+}
+
+// dataPoints returns a data point per hour holding the hour's totals and the number of data points folded
+// into it, the individual data points are not kept
+func (fl *flowListBucket) dataPoints() []sealedPoint {
+	hours := make([]int, 0, len(fl.buckets))
+	for hour := range fl.buckets {
+		hours = append(hours, hour)
+	}
+	sort.Ints(hours)
+
+	points := make([]sealedPoint, 0, len(hours))
+	for _, hour := range hours {
+		b := fl.buckets[hour]
+		points = append(points, sealedPoint{bucket: hour, counters: b.counters, count: b.count})
+	}
+	return points
+}
+
+// restore folds a data point into the bucket for its hour along with the data points folded into it
+func (fl *flowListBucket) restore(p sealedPoint) (int, error) {
+	b, ok := fl.buckets[p.bucket]
+	if !ok {
+		b = &hourBucket{}
+		fl.buckets[p.bucket] = b
+	}
+	saturated := b.add(p.counters)
+	b.count += p.count
+	if saturated {
+		return p.count, errOverflow
+	}
+	return p.count, nil
+}
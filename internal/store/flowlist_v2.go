@@ -0,0 +1,101 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+)
+
+// flowListV2 keeps flow data points in chronological order so that aggregation for an hour
+// only visits the data points recorded for that hour.
+type flowListV2 struct {
+	// flows is sorted by Hour. Data points for the same hour are kept in arrival order.
+	flows []*Flow
+}
+
+func newFlowListV2() flowList {
+	return &flowListV2{}
+}
+
+// insert a new flow data point in chronological order.
+// Flows usually arrive in order and are appended, out-of-order arrivals are placed after
+// any existing data points for the same hour.
+func (fl *flowListV2) insert(flow *Flow) error {
+	n := len(fl.flows)
+	if n == 0 || fl.flows[n-1].Hour <= flow.Hour {
+		fl.flows = append(fl.flows, flow)
+		return nil
+	}
+
+	i := sort.Search(n, func(i int) bool { return fl.flows[i].Hour > flow.Hour })
+	fl.flows = append(fl.flows, nil)
+	copy(fl.flows[i+1:], fl.flows[i:])
+	fl.flows[i] = flow
+	return nil
+}
+
+// get returns an aggregated flow for a given tuple and range of hour timestamps
+func (fl *flowListV2) get(key FlowKey, start, end int) (*Flow, error) {
+	if start <= 0 {
+		return nil, fmt.Errorf("provided hour timestamp must be greater than 0")
+	}
+
+	// Binary search for the first data point of the range
+	i := sort.Search(len(fl.flows), func(i int) bool { return fl.flows[i].Hour >= start })
+	if i == len(fl.flows) || fl.flows[i].Hour >= end {
+		// This timestamp was never found, return a nil flow value
+		return nil, nil
+	}
+
+	var saturated bool
+	aggregateFlow := key.flow(start)
+	for ; i < len(fl.flows) && fl.flows[i].Hour < end; i++ {
+		if flowCounters(fl.flows[i]).addTo(aggregateFlow) {
+			saturated = true
+		}
+	}
+
+	if saturated {
+		return aggregateFlow, errOverflow
+	}
+	return aggregateFlow, nil
+}
+
+// purge removes all data points older than the given hour
+func (fl *flowListV2) purge(before int) int {
+	i := sort.Search(len(fl.flows), func(i int) bool { return fl.flows[i].Hour >= before })
+	// Clear the removed pointers so the purged flows can be garbage collected
+	for j := 0; j < i; j++ {
+		fl.flows[j] = nil
+	}
+	fl.flows = fl.flows[i:]
+	return i
+}
+
+// take removes all data points older than the given hour and returns them oldest first
+func (fl *flowListV2) take(before int) []sealedPoint {
+	i := sort.Search(len(fl.flows), func(i int) bool { return fl.flows[i].Hour >= before })
+	points := make([]sealedPoint, i)
+	for j, flow := range fl.flows[:i] {
+		points[j] = sealedPoint{bucket: flow.Hour, counters: flowCounters(flow), count: 1}
+		fl.flows[j] = nil
+	}
+	fl.flows = fl.flows[i:]
+	return points
+}
+
+func (fl *flowListV2) len() int {
+	return len(fl.flows)
+}
+
+func (fl *flowListV2) dataPoints() []sealedPoint {
+	points := make([]sealedPoint, len(fl.flows))
+	for i, flow := range fl.flows {
+		points[i] = sealedPoint{bucket: flow.Hour, counters: flowCounters(flow), count: 1}
+	}
+	return points
+}
+
+// restore adds the totals of a data point as a single data point
+func (fl *flowListV2) restore(p sealedPoint) (int, error) {
+	return 1, fl.insert(p.flow())
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// FlowStore stores flow data points and answers aggregate queries over them.
+// Implementations must be safe for concurrent use.
+type FlowStore interface {
+	// Insert adds flow data points to the store
+	Insert(flows []*Flow) error
+	// Get returns an aggregation of flow stats for all tuples for a given hour
+	Get(hour int) ([]*Flow, error)
+	// GetRange returns an aggregation of flow stats for all tuples over the hours from start, inclusive,
+	// to end, exclusive. The aggregated flows are reported at the start hour.
+	GetRange(start, end int) ([]*Flow, error)
+	// Query returns an aggregation of flow stats over the query's hours or time range for the tuples matching
+	// its filter, rolled up to its group by dimensions. The aggregated flows are reported at the start of the
+	// first bucket of the range.
+	Query(q Query) ([]*Flow, error)
+	// Top returns the n flows of a query ranked highest by the given rank, highest first
+	Top(q Query, n int, rank Rank) ([]*Flow, error)
+	// Run performs background maintenance of the store until the context is cancelled
+	Run(ctx context.Context) error
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// Snapshotter is implemented by flow stores that can write point-in-time snapshots of their contents
+type Snapshotter interface {
+	// Snapshot writes a snapshot of the store contents
+	Snapshot() (SnapshotInfo, error)
+	// Snapshots returns the snapshots on disk, oldest first
+	Snapshots() ([]SnapshotInfo, error)
+}
+
+// Backend selects the FlowStore implementation
+type Backend int
+
+const (
+	// BackendMemory keeps all flow data in memory, optionally backed by a write-ahead log and snapshots
+	BackendMemory Backend = iota + 1
+	// BackendBolt keeps flow data in an embedded on-disk bbolt database
+	BackendBolt
+)
+
+// String returns the name used to select a backend on the command line
+func (b Backend) String() string {
+	switch b {
+	case BackendMemory:
+		return "memory"
+	case BackendBolt:
+		return "bolt"
+	default:
+		return fmt.Sprintf("Backend(%d)", int(b))
+	}
+}
+
+// ParseBackend returns the backend for a name such as "memory" or "bolt"
+func ParseBackend(s string) (Backend, error) {
+	for _, b := range []Backend{BackendMemory, BackendBolt} {
+		if b.String() == s {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown backend %q", s)
+}
+
+// NewFlowStore creates the flow store implementation selected by the WithBackend option,
+// defaulting to the in-memory store.
+func NewFlowStore(reg prometheus.Registerer, ll *logrus.Logger, opts ...Option) (FlowStore, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	switch cfg.backend {
+	case BackendMemory:
+		return NewMemoryStore(reg, ll, opts...)
+	case BackendBolt:
+		return NewBoltStore(reg, ll, opts...)
+	default:
+		return nil, fmt.Errorf("unknown backend %d", int(cfg.backend))
+	}
+}
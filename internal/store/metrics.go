@@ -8,9 +8,45 @@ type Metrics struct {
 	// FlowKeyCount is the current # of flows in the flowstore
 	flows prometheus.Gauge
 	// TODO(sneha): add gauge indicating total # of data flow points in a flow map
+
+	// tuples is the current # of flow tuples with unsealed data points and tupleLimitRejected the total # of
+	// flows rejected because they would exceed the tuple limit
+	tuples             prometheus.Gauge
+	tupleLimitRejected prometheus.Counter
+
+	// purged is the total # of flow data points removed by retention purges
+	purged        prometheus.Counter
+	purgeDuration prometheus.Histogram
+	purgeLastRun  prometheus.Gauge
+
+	// blocks is the current # of sealed columnar blocks. blockRawBytes is the estimated size of the sealed
+	// flow datapoints before encoding and blockBytes their size once encoded into blocks.
+	blocks                prometheus.Gauge
+	blockRawBytes         prometheus.Gauge
+	blockBytes            prometheus.Gauge
+	blockCompressionRatio prometheus.Gauge
+	sealDuration          prometheus.Histogram
+
+	// counterOverflows is the total # of flow counter sums saturated at the maximum counter value
+	counterOverflows prometheus.Counter
+
+	// rollupEntries is the current # of flow tuple totals held by each rollup resolution
+	rollupEntries *prometheus.GaugeVec
+
+	// shardLockWait is the time spent waiting to acquire a shard lock
+	shardLockWait *prometheus.HistogramVec
+
+	// walBytes is the total # of bytes appended to the write-ahead log
+	walBytes        prometheus.Counter
+	walSyncDuration prometheus.Histogram
+
+	snapshotDuration    prometheus.Histogram
+	snapshotSize        prometheus.Gauge
+	snapshotLastSuccess prometheus.Gauge
+	snapshotFailures    prometheus.Counter
 }
 
-func NewMetrics(reg *prometheus.Registry) *Metrics {
+func NewMetrics(reg prometheus.Registerer) *Metrics {
 	metrics := &Metrics{
 		flows: prometheus.NewGauge(
 			prometheus.GaugeOpts{
@@ -19,9 +55,165 @@ func NewMetrics(reg *prometheus.Registry) *Metrics {
 				Help:      "Number of total flow datapoints in the flowstore",
 			},
 		),
+		tuples: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "flowd",
+				Name:      "flowstore_tuples",
+				Help:      "Number of flow tuples with unsealed datapoints in the flowstore",
+			},
+		),
+		tupleLimitRejected: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "flowd",
+				Name:      "flowstore_tuple_limit_rejected_total",
+				Help:      "Number of flow datapoints rejected because they would exceed the flowstore tuple limit",
+			},
+		),
+		purged: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "flowd",
+				Name:      "flowstore_purged_total",
+				Help:      "Number of flow datapoints removed from the flowstore by retention purges",
+			},
+		),
+		purgeDuration: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "flowd",
+				Name:      "flowstore_purge_duration_seconds",
+				Help:      "Duration of flowstore retention purges",
+			},
+		),
+		purgeLastRun: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "flowd",
+				Name:      "flowstore_purge_last_run_timestamp_seconds",
+				Help:      "Unix timestamp of the last flowstore retention purge",
+			},
+		),
+		blocks: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "flowd",
+				Name:      "flowstore_blocks",
+				Help:      "Number of sealed columnar blocks in the flowstore",
+			},
+		),
+		blockRawBytes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "flowd",
+				Name:      "flowstore_block_raw_bytes",
+				Help:      "Estimated size of the sealed flow datapoints before they were encoded into blocks",
+			},
+		),
+		blockBytes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "flowd",
+				Name:      "flowstore_block_bytes",
+				Help:      "Size of the sealed columnar blocks in the flowstore",
+			},
+		),
+		blockCompressionRatio: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "flowd",
+				Name:      "flowstore_block_compression_ratio",
+				Help:      "Ratio of the size of the sealed flow datapoints before and after they were encoded into blocks",
+			},
+		),
+		sealDuration: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "flowd",
+				Name:      "flowstore_seal_duration_seconds",
+				Help:      "Duration of sealing flowstore hours into columnar blocks",
+			},
+		),
+		counterOverflows: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "flowd",
+				Name:      "flowstore_counter_overflows_total",
+				Help:      "Number of flow counter sums saturated at the maximum counter value instead of overflowing",
+			},
+		),
+		rollupEntries: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "flowd",
+				Name:      "flowstore_rollup_entries",
+				Help:      "Number of flow tuple totals held by each flowstore rollup resolution",
+			},
+			[]string{"resolution"},
+		),
+		shardLockWait: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "flowd",
+				Name:      "flowstore_shard_lock_wait_seconds",
+				Help:      "Time spent waiting to acquire a flowstore shard lock",
+				// Uncontended locks are acquired in well under a millisecond
+				Buckets: prometheus.ExponentialBuckets(1e-6, 4, 10),
+			},
+			[]string{"shard", "lock"},
+		),
+		walBytes: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "flowd",
+				Name:      "wal_written_bytes_total",
+				Help:      "Number of bytes appended to the flowstore write-ahead log",
+			},
+		),
+		walSyncDuration: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "flowd",
+				Name:      "wal_sync_duration_seconds",
+				Help:      "Duration of flowstore write-ahead log fsyncs",
+			},
+		),
+		snapshotDuration: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "flowd",
+				Name:      "snapshot_duration_seconds",
+				Help:      "Duration of flowstore snapshots",
+			},
+		),
+		snapshotSize: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "flowd",
+				Name:      "snapshot_size_bytes",
+				Help:      "Size of the latest flowstore snapshot",
+			},
+		),
+		snapshotLastSuccess: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "flowd",
+				Name:      "snapshot_last_success_timestamp_seconds",
+				Help:      "Unix timestamp of the latest successful flowstore snapshot",
+			},
+		),
+		snapshotFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "flowd",
+				Name:      "snapshot_failures_total",
+				Help:      "Number of periodic flowstore snapshots that failed",
+			},
+		),
 	}
 
 	reg.MustRegister(metrics.flows)
+	reg.MustRegister(metrics.tuples)
+	reg.MustRegister(metrics.tupleLimitRejected)
+	reg.MustRegister(metrics.purged)
+	reg.MustRegister(metrics.purgeDuration)
+	reg.MustRegister(metrics.purgeLastRun)
+	reg.MustRegister(metrics.blocks)
+	reg.MustRegister(metrics.blockRawBytes)
+	reg.MustRegister(metrics.blockBytes)
+	reg.MustRegister(metrics.blockCompressionRatio)
+	reg.MustRegister(metrics.sealDuration)
+	reg.MustRegister(metrics.counterOverflows)
+	reg.MustRegister(metrics.rollupEntries)
+	reg.MustRegister(metrics.shardLockWait)
+	reg.MustRegister(metrics.walBytes)
+	reg.MustRegister(metrics.walSyncDuration)
+	reg.MustRegister(metrics.snapshotDuration)
+	reg.MustRegister(metrics.snapshotSize)
+	reg.MustRegister(metrics.snapshotLastSuccess)
+	reg.MustRegister(metrics.snapshotFailures)
 
 	return metrics
 }
@@ -0,0 +1,251 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// FlowListVersion selects the flowList implementation used to hold the data points of each flow tuple
+type FlowListVersion int
+
+const (
+	// FlowListV1 is an unordered linked list of flow data points
+	FlowListV1 FlowListVersion = iota + 1
+	// FlowListV2 is a chronologically ordered list of flow data points
+	FlowListV2
+	// FlowListBucket pre-aggregates flow data points into per-hour totals on insert
+	FlowListBucket
+)
+
+// String returns the name used to select a flow list version on the command line
+func (v FlowListVersion) String() string {
+	switch v {
+	case FlowListV1:
+		return "v1"
+	case FlowListV2:
+		return "v2"
+	case FlowListBucket:
+		return "bucket"
+	default:
+		return fmt.Sprintf("FlowListVersion(%d)", int(v))
+	}
+}
+
+// ParseFlowListVersion returns the flow list version for a name such as "v1", "v2" or "bucket"
+func ParseFlowListVersion(s string) (FlowListVersion, error) {
+	for _, v := range []FlowListVersion{FlowListV1, FlowListV2, FlowListBucket} {
+		if v.String() == s {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown flow list version %q", s)
+}
+
+// newFlowList returns a constructor for empty flow lists of the given version
+func (v FlowListVersion) newFlowList() (func() flowList, error) {
+	switch v {
+	case FlowListV1:
+		return newFlowListV1, nil
+	case FlowListV2:
+		return newFlowListV2, nil
+	case FlowListBucket:
+		return newFlowListBucket, nil
+	default:
+		return nil, fmt.Errorf("unknown flow list version %d", int(v))
+	}
+}
+
+// RetentionMode selects what a retention window is measured against
+type RetentionMode int
+
+const (
+	// RetentionNewestHour keeps the configured number of hours up to and including the newest hour inserted
+	RetentionNewestHour RetentionMode = iota + 1
+	// RetentionWallClock treats hours as hours since the unix epoch and keeps the configured number of
+	// hours up to and including the current wall-clock hour
+	RetentionWallClock
+)
+
+// String returns the name used to select a retention mode on the command line
+func (m RetentionMode) String() string {
+	switch m {
+	case RetentionNewestHour:
+		return "newest"
+	case RetentionWallClock:
+		return "wallclock"
+	default:
+		return fmt.Sprintf("RetentionMode(%d)", int(m))
+	}
+}
+
+// ParseRetentionMode returns the retention mode for a name such as "newest" or "wallclock"
+func ParseRetentionMode(s string) (RetentionMode, error) {
+	for _, m := range []RetentionMode{RetentionNewestHour, RetentionWallClock} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown retention mode %q", s)
+}
+
+// config holds the settings a flow store is constructed with
+type config struct {
+	backend Backend
+	// boltPath is the database file of the bolt backend
+	boltPath        string
+	flowListVersion FlowListVersion
+	// granularity is the width of the buckets flow data points are aggregated into
+	granularity time.Duration
+	// retentionHours is the number of hours of flow data kept, 0 keeps flow data forever
+	retentionHours int
+	retentionMode  RetentionMode
+	purgeInterval  time.Duration
+	// shards is the number of lock-striped partitions flow tuples are spread across
+	shards int
+	// maxTuples is the number of flow tuples the store may hold, 0 is unlimited
+	maxTuples int
+	// rollups maps the resolution of each rollup to the number of periods it keeps
+	rollups map[Resolution]int
+	// sealOpenHours is the number of most recent hours left unsealed, 0 disables sealing
+	sealOpenHours int
+	sealInterval  time.Duration
+	// walDir is the directory of the write-ahead log, the log is disabled when empty
+	walDir          string
+	walSyncMode     SyncMode
+	walSyncInterval time.Duration
+	// snapshotDir is the directory snapshots are written to, snapshots are disabled when empty
+	snapshotDir      string
+	snapshotInterval time.Duration
+	snapshotRetain   int
+}
+
+func defaultConfig() config {
+	return config{
+		backend:         BackendMemory,
+		boltPath:        "flows.db",
+		flowListVersion: FlowListV1,
+		granularity:     DefaultGranularity,
+		retentionMode:   RetentionNewestHour,
+		purgeInterval:   time.Minute,
+		sealInterval:    time.Minute,
+		shards:          16,
+		walSyncMode:     SyncAlways,
+		walSyncInterval: time.Second,
+	}
+}
+
+// Option configures a flow store
+type Option func(*config)
+
+// WithFlowListVersion selects the flowList implementation used for every flow tuple in the store
+func WithFlowListVersion(v FlowListVersion) Option {
+	return func(c *config) {
+		c.flowListVersion = v
+	}
+}
+
+// WithGranularity sets the width of the buckets flow data points are aggregated into and queried by, such as
+// 1m, 5m or 1h. The granularity must be a whole number of seconds evenly dividing an hour.
+func WithGranularity(d time.Duration) Option {
+	return func(c *config) {
+		c.granularity = d
+	}
+}
+
+// WithRetention purges flow data points older than the given number of hours, measured according to mode.
+// A retention of 0 hours keeps flow data forever.
+func WithRetention(hours int, mode RetentionMode) Option {
+	return func(c *config) {
+		c.retentionHours = hours
+		c.retentionMode = mode
+	}
+}
+
+// WithRetentionHours overrides the number of hours of flow data kept, measured according to the retention
+// mode set by WithRetention. A retention of 0 hours keeps flow data forever.
+func WithRetentionHours(hours int) Option {
+	return func(c *config) {
+		c.retentionHours = hours
+	}
+}
+
+// WithPurgeInterval sets how often FlowStore.Run purges expired flow data points
+func WithPurgeInterval(interval time.Duration) Option {
+	return func(c *config) {
+		c.purgeInterval = interval
+	}
+}
+
+// WithSealing seals every hour older than the given number of most recent hours, measured from the newest
+// hour inserted, into compressed columnar blocks every interval. 0 open hours disables sealing.
+func WithSealing(openHours int, interval time.Duration) Option {
+	return func(c *config) {
+		c.sealOpenHours = openHours
+		c.sealInterval = interval
+	}
+}
+
+// WithRollup keeps the totals of every flow tuple per period of the given resolution alongside the hourly
+// flow data, keeping the given number of most recent periods measured according to the retention mode.
+// 0 periods keeps the rollup forever. Range queries read whole periods from the coarsest rollup holding them.
+func WithRollup(res Resolution, periods int) Option {
+	return func(c *config) {
+		if c.rollups == nil {
+			c.rollups = map[Resolution]int{}
+		}
+		c.rollups[res] = periods
+	}
+}
+
+// WithShards sets the number of lock-striped partitions flow tuples are spread across.
+// More shards reduce lock contention between concurrent inserts and reads of different flow tuples.
+func WithShards(n int) Option {
+	return func(c *config) {
+		c.shards = n
+	}
+}
+
+// WithMaxTuples limits the number of flow tuples held by the store. Batches that would create tuples beyond
+// the limit are rejected with a *TupleLimitError. 0 removes the limit.
+// The limit is only supported by the memory backend, and not along with sealing.
+func WithMaxTuples(n int) Option {
+	return func(c *config) {
+		c.maxTuples = n
+	}
+}
+
+// WithWAL logs every inserted batch of flows to a write-ahead log in dir before it is applied, and replays
+// the log when the store is created. The sync mode decides when the log is flushed to stable storage,
+// the interval is only used by SyncInterval.
+func WithWAL(dir string, mode SyncMode, interval time.Duration) Option {
+	return func(c *config) {
+		c.walDir = dir
+		c.walSyncMode = mode
+		c.walSyncInterval = interval
+	}
+}
+
+// WithSnapshots writes snapshots of the store contents to dir every interval, keeping the most recent
+// retain snapshots. An interval of 0 only takes snapshots on demand. The latest valid snapshot is
+// restored when the store is created.
+func WithSnapshots(dir string, interval time.Duration, retain int) Option {
+	return func(c *config) {
+		c.snapshotDir = dir
+		c.snapshotInterval = interval
+		c.snapshotRetain = retain
+	}
+}
+
+// WithBackend selects the flow store implementation created by NewFlowStore
+func WithBackend(b Backend) Option {
+	return func(c *config) {
+		c.backend = b
+	}
+}
+
+// WithBoltPath sets the database file used by the bolt backend
+func WithBoltPath(path string) Option {
+	return func(c *config) {
+		c.boltPath = path
+	}
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// prefixTree is a path-compressed binary radix tree indexing flow tuples by an IP address, so the tuples
+// within a CIDR are found by walking down to the CIDR rather than matching every tuple. IPv4 and IPv6
+// addresses are held in separate trees.
+type prefixTree struct {
+	v4 *prefixNode
+	v6 *prefixNode
+}
+
+// prefixNode covers the addresses of its prefix. Nodes only exist where flow tuples are held or where the
+// addresses below them branch, so a tree holds fewer than two nodes per distinct address.
+type prefixNode struct {
+	prefix   netip.Prefix
+	children [2]*prefixNode
+	// keys are the flow tuples whose address is exactly the node's prefix
+	keys map[FlowKey]struct{}
+}
+
+func (t *prefixTree) root(p netip.Prefix) **prefixNode {
+	if p.Addr().Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// insert indexes a flow tuple under a prefix, usually a single address
+func (t *prefixTree) insert(p netip.Prefix, key FlowKey) {
+	p = p.Masked()
+	node := t.root(p)
+	for {
+		n := *node
+		if n == nil {
+			*node = &prefixNode{prefix: p, keys: map[FlowKey]struct{}{key: {}}}
+			return
+		}
+
+		// Split the node where the prefix branches off it
+		if common := commonPrefix(n.prefix, p); common.Bits() < n.prefix.Bits() {
+			parent := &prefixNode{prefix: common}
+			parent.children[addrBit(n.prefix.Addr(), common.Bits())] = n
+			*node = parent
+			n = parent
+		}
+		if n.prefix.Bits() == p.Bits() {
+			if n.keys == nil {
+				n.keys = map[FlowKey]struct{}{}
+			}
+			n.keys[key] = struct{}{}
+			return
+		}
+		node = &n.children[addrBit(p.Addr(), n.prefix.Bits())]
+	}
+}
+
+// remove drops a flow tuple indexed under a prefix, pruning the nodes left without a purpose
+func (t *prefixTree) remove(p netip.Prefix, key FlowKey) {
+	p = p.Masked()
+	node := t.root(p)
+	*node = (*node).remove(p, key)
+}
+
+func (n *prefixNode) remove(p netip.Prefix, key FlowKey) *prefixNode {
+	if n == nil || n.prefix.Bits() > p.Bits() || !n.prefix.Contains(p.Addr()) {
+		return n
+	}
+	if n.prefix.Bits() == p.Bits() {
+		delete(n.keys, key)
+	} else {
+		i := addrBit(p.Addr(), n.prefix.Bits())
+		n.children[i] = n.children[i].remove(p, key)
+	}
+
+	if len(n.keys) > 0 {
+		return n
+	}
+	switch {
+	case n.children[0] == nil:
+		return n.children[1]
+	case n.children[1] == nil:
+		return n.children[0]
+	default:
+		return n
+	}
+}
+
+// walk calls fn for every flow tuple indexed under a prefix within the CIDR
+func (t *prefixTree) walk(cidr netip.Prefix, fn func(key FlowKey)) {
+	cidr = cidr.Masked()
+	n := *t.root(cidr)
+	for n != nil {
+		if cidr.Bits() <= n.prefix.Bits() {
+			if cidr.Contains(n.prefix.Addr()) {
+				n.each(fn)
+			}
+			return
+		}
+		if !n.prefix.Contains(cidr.Addr()) {
+			return
+		}
+		n = n.children[addrBit(cidr.Addr(), n.prefix.Bits())]
+	}
+}
+
+func (n *prefixNode) each(fn func(key FlowKey)) {
+	if n == nil {
+		return
+	}
+	for key := range n.keys {
+		fn(key)
+	}
+	n.children[0].each(fn)
+	n.children[1].each(fn)
+}
+
+// commonPrefix returns the longest prefix holding both prefixes of the same address family
+func commonPrefix(a, b netip.Prefix) netip.Prefix {
+	bits := a.Bits()
+	if b.Bits() < bits {
+		bits = b.Bits()
+	}
+	x, y := a.Addr().AsSlice(), b.Addr().AsSlice()
+	for i := 0; i < bits; i++ {
+		if x[i/8]>>(7-i%8)&1 != y[i/8]>>(7-i%8)&1 {
+			bits = i
+			break
+		}
+	}
+	p, _ := a.Addr().Prefix(bits)
+	return p
+}
+
+// comparePrefix orders prefixes by address and then prefix length, invalid prefixes first
+func comparePrefix(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// addrBit returns the bit of an address at position i, counting from the most significant bit
+func addrBit(addr netip.Addr, i int) int {
+	b := addr.AsSlice()
+	return int(b[i/8] >> (7 - i%8) & 1)
+}
+
+// ParseCIDR parses an IPv4 or IPv6 CIDR such as "10.0.0.0/16". A single address is read as the CIDR
+// holding only that address. IPv4-mapped IPv6 addresses are read as IPv4.
+func ParseCIDR(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap().WithZone("")
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if addr := p.Addr(); addr.Is4In6() {
+		if p.Bits() < 96 {
+			return netip.Prefix{}, fmt.Errorf("prefix %s of an IPv4-mapped address is shorter than 96 bits", s)
+		}
+		p = netip.PrefixFrom(addr.Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+// formatCIDR returns a single address without a prefix length and any other prefix in CIDR notation,
+// the inverse of ParseCIDR. The zero prefix is returned empty.
+func formatCIDR(p netip.Prefix) string {
+	if !p.IsValid() {
+		return ""
+	}
+	if p.IsSingleIP() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
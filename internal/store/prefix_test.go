@@ -0,0 +1,258 @@
+package store
+
+import (
+	"math/rand"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func Test_PrefixTree(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	// Addresses are drawn from a few subnets so the tree branches at many depths
+	var keys []FlowKey
+	for i := 0; i < 500; i++ {
+		var addr netip.Addr
+		if i%2 == 0 {
+			addr = netip.AddrFrom4([4]byte{10, byte(r.Intn(4)), byte(r.Intn(8)), byte(r.Intn(256))})
+		} else {
+			b := [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: byte(r.Intn(256))}
+			b[5] = byte(r.Intn(4))
+			addr = netip.AddrFrom16(b)
+		}
+		keys = append(keys, FlowKey{SrcIP: netip.PrefixFrom(addr, addr.BitLen()), SrcPort: uint16(i)})
+	}
+
+	var tree prefixTree
+	for _, key := range keys {
+		tree.insert(key.SrcIP, key)
+	}
+	// Remove every third tuple to exercise pruning
+	held := map[FlowKey]bool{}
+	for i, key := range keys {
+		if i%3 == 0 {
+			tree.remove(key.SrcIP, key)
+			continue
+		}
+		held[key] = true
+	}
+
+	sortKeys := cmpopts.SortSlices(lessKey)
+	for _, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.2.3.0/24", "10.3.4.5", "11.0.0.0/8", "0.0.0.0/0", "2001:db8::/32", "2001:db8:0:100::/56", "::/0"} {
+		t.Run(s, func(t *testing.T) {
+			cidr, err := ParseCIDR(s)
+			if err != nil {
+				t.Fatalf("unexpected error parsing CIDR: %v", err)
+			}
+
+			var found []FlowKey
+			tree.walk(cidr, func(key FlowKey) {
+				found = append(found, key)
+			})
+			var expected []FlowKey
+			for key := range held {
+				if (Filter{SrcCIDR: []netip.Prefix{cidr}}).Match(key) {
+					expected = append(expected, key)
+				}
+			}
+			if diff := cmp.Diff(found, expected, sortKeys, cmpopts.EquateEmpty(), cmp.Comparer(func(a, b netip.Prefix) bool { return a == b })); diff != "" {
+				t.Fatalf("unexpected flow tuples within %s: %v", s, diff)
+			}
+		})
+	}
+
+	for _, key := range keys {
+		tree.remove(key.SrcIP, key)
+	}
+	if tree.v4 != nil || tree.v6 != nil {
+		t.Fatal("expected an empty tree after removing every flow tuple")
+	}
+}
+
+func Test_ParseCIDR(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+		err      bool
+	}{
+		{in: "10.0.0.0/16", expected: "10.0.0.0/16"},
+		{in: "10.0.1.2/16", expected: "10.0.0.0/16"},
+		{in: "10.0.1.2", expected: "10.0.1.2"},
+		{in: "2001:db8::1", expected: "2001:db8::1"},
+		{in: "2001:db8::/32", expected: "2001:db8::/32"},
+		{in: "::ffff:10.0.1.2", expected: "10.0.1.2"},
+		{in: "::ffff:10.0.0.0/112", expected: "10.0.0.0/16"},
+		{in: "::ffff:0:0/64", err: true},
+		{in: "10.0.0.0/33", err: true},
+		{in: "app-1", err: true},
+	}
+	for _, tt := range tests {
+		p, err := ParseCIDR(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Fatalf("expected an error parsing %q", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error parsing %q: %v", tt.in, err)
+		}
+		if s := formatCIDR(p); s != tt.expected {
+			t.Fatalf("expected %q to parse as %s, got %s", tt.in, tt.expected, s)
+		}
+	}
+}
+
+func Test_QueryCIDR(t *testing.T) {
+	insert := []*Flow{
+		{VpcID: "vpc-0", SrcIP: "10.0.1.5", DstIP: "10.1.0.7", SrcPort: 40001, DstPort: 443, Protocol: 6, BytesTx: 100, BytesRx: 300, Hour: 1},
+		{VpcID: "vpc-0", SrcIP: "10.0.1.9", DstIP: "10.1.0.7", SrcPort: 40002, DstPort: 443, Protocol: 6, BytesTx: 200, BytesRx: 600, Hour: 1},
+		{VpcID: "vpc-0", SrcIP: "10.0.2.1", DstIP: "10.1.0.8", SrcPort: 40003, DstPort: 80, Protocol: 6, BytesTx: 10, BytesRx: 20, Hour: 2},
+		{VpcID: "vpc-1", SrcIP: "192.168.0.1", DstIP: "10.1.0.7", SrcPort: 5353, DstPort: 53, Protocol: 17, BytesTx: 1, BytesRx: 2, Hour: 2},
+		{VpcID: "vpc-1", SrcIP: "2001:db8:0:1::5", DstIP: "2001:db8:1::7", SrcPort: 40004, DstPort: 443, Protocol: 6, BytesTx: 5, BytesRx: 5, Hour: 1},
+		{VpcID: "vpc-1", SrcIP: "2001:db8:0:2::5", DstIP: "2001:db8:1::7", SrcPort: 40005, DstPort: 443, Protocol: 6, BytesTx: 7, BytesRx: 9, Hour: 2},
+		{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 1000, BytesRx: 1000, Hour: 1},
+	}
+	cidrs := func(s ...string) []netip.Prefix {
+		var prefixes []netip.Prefix
+		for _, str := range s {
+			p, err := ParseCIDR(str)
+			if err != nil {
+				t.Fatalf("unexpected error parsing CIDR: %v", err)
+			}
+			prefixes = append(prefixes, p)
+		}
+		return prefixes
+	}
+
+	tests := []struct {
+		name     string
+		q        Query
+		expected []*Flow
+	}{
+		{
+			name: "source CIDR",
+			q:    Query{Filter: Filter{SrcCIDR: cidrs("10.0.0.0/16")}, GroupBy: []Dimension{DimensionSrcIP}},
+			expected: []*Flow{
+				{SrcIP: "10.0.1.5", BytesTx: 100, BytesRx: 300, Hour: 1},
+				{SrcIP: "10.0.1.9", BytesTx: 200, BytesRx: 600, Hour: 1},
+				{SrcIP: "10.0.2.1", BytesTx: 10, BytesRx: 20, Hour: 1},
+			},
+		},
+		{
+			name: "overlapping CIDRs",
+			q:    Query{Filter: Filter{SrcCIDR: cidrs("10.0.0.0/8", "10.0.1.0/24", "2001:db8::/32")}, GroupBy: []Dimension{DimensionVpcID}},
+			expected: []*Flow{
+				{VpcID: "vpc-0", BytesTx: 310, BytesRx: 920, Hour: 1},
+				{VpcID: "vpc-1", BytesTx: 12, BytesRx: 14, Hour: 1},
+			},
+		},
+		{
+			name: "source and destination CIDRs",
+			q:    Query{Filter: Filter{SrcCIDR: cidrs("10.0.0.0/8", "192.168.0.0/16"), DstCIDR: cidrs("10.1.0.7")}},
+			expected: []*Flow{
+				{VpcID: "vpc-0", SrcIP: "10.0.1.5", DstIP: "10.1.0.7", SrcPort: 40001, DstPort: 443, Protocol: 6, BytesTx: 100, BytesRx: 300, Hour: 1},
+				{VpcID: "vpc-0", SrcIP: "10.0.1.9", DstIP: "10.1.0.7", SrcPort: 40002, DstPort: 443, Protocol: 6, BytesTx: 200, BytesRx: 600, Hour: 1},
+				{VpcID: "vpc-1", SrcIP: "192.168.0.1", DstIP: "10.1.0.7", SrcPort: 5353, DstPort: 53, Protocol: 17, BytesTx: 1, BytesRx: 2, Hour: 1},
+			},
+		},
+		{
+			name: "rolled up to subnets",
+			q:    Query{GroupBy: []Dimension{DimensionSrcIP}, SrcPrefixLen: PrefixLen{V4: 24, V6: 64}},
+			expected: []*Flow{
+				{SrcIP: "10.0.1.0/24", BytesTx: 300, BytesRx: 900, Hour: 1},
+				{SrcIP: "10.0.2.0/24", BytesTx: 10, BytesRx: 20, Hour: 1},
+				{SrcIP: "192.168.0.0/24", BytesTx: 1, BytesRx: 2, Hour: 1},
+				{SrcIP: "2001:db8:0:1::/64", BytesTx: 5, BytesRx: 5, Hour: 1},
+				{SrcIP: "2001:db8:0:2::/64", BytesTx: 7, BytesRx: 9, Hour: 1},
+				{BytesTx: 1000, BytesRx: 1000, Hour: 1},
+			},
+		},
+		{
+			name: "destination subnet and port",
+			q:    Query{Filter: Filter{DstCIDR: cidrs("2001:db8::/16")}, GroupBy: []Dimension{DimensionDstIP, DimensionDstPort, DimensionProtocol}, DstPrefixLen: PrefixLen{V6: 48}},
+			expected: []*Flow{
+				{DstIP: "2001:db8:1::/48", DstPort: 443, Protocol: 6, BytesTx: 12, BytesRx: 14, Hour: 1},
+			},
+		},
+	}
+
+	stores := openQueryStores(t, insert)
+	for name, store := range stores {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				tt.q.Start, tt.q.End = 1, 3
+				flows, err := store.Query(tt.q)
+				if err != nil {
+					t.Fatalf("unexpected error retrieving flows: %v", err)
+				}
+				if diff := cmp.Diff(flows, reported(tt.expected), cmpopts.SortSlices(less)); diff != "" {
+					t.Fatalf("unexpected flows: %v", diff)
+				}
+			})
+		}
+	}
+
+	if _, err := stores["bolt"].Query(Query{Start: 1, End: 3, SrcPrefixLen: PrefixLen{V4: 33}}); err == nil {
+		t.Fatal("expected an error for a prefix length out of range")
+	}
+}
+
+func Test_IPFlowRestore(t *testing.T) {
+	dir := t.TempDir()
+	insert := []*Flow{
+		{VpcID: "vpc-0", SrcIP: "10.0.1.5", DstIP: "10.1.0.7", SrcPort: 40001, DstPort: 443, Protocol: 6, BytesTx: 100, BytesRx: 300, Hour: 1},
+		{VpcID: "vpc-1", SrcIP: "2001:db8::5", DstIP: "2001:db8:1::7", SrcPort: 40004, DstPort: 443, Protocol: 6, BytesTx: 5, BytesRx: 5, Hour: 1},
+		{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 1000, BytesRx: 1000, Hour: 1},
+		{VpcID: "vpc-1", SrcIP: "10.0.1.5", DstIP: "10.1.0.7", SrcPort: 40001, DstPort: 443, Protocol: 6, BytesTx: 7, BytesRx: 9, Hour: 2},
+	}
+
+	store := openSnapshotStore(t, dir)
+	// Invalid flows are skipped
+	if err := store.Insert([]*Flow{{SrcIP: "10.0.0.300", BytesTx: 1, Hour: 1}, {SrcIP: "10.0.0.1", SrcPort: 70000, Hour: 1}}); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if err := store.Insert(insert[:2]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if _, err := store.Snapshot(); err != nil {
+		t.Fatalf("unexpected error taking snapshot: %v", err)
+	}
+	// Flows inserted after the snapshot are replayed from the write-ahead log
+	if err := store.Insert(insert[2:]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("unexpected error closing flow store: %v", err)
+	}
+
+	restored := openSnapshotStore(t, dir)
+	defer restored.Close()
+	for _, hour := range []int{1, 2} {
+		var expected []*Flow
+		for _, flow := range insert {
+			if flow.Hour == hour {
+				expected = append(expected, flow)
+			}
+		}
+		flows, err := restored.Get(hour)
+		if err != nil {
+			t.Fatalf("unexpected error retrieving flows: %v", err)
+		}
+		if diff := cmp.Diff(flows, reported(expected), cmpopts.SortSlices(less)); diff != "" {
+			t.Fatalf("unexpected flows for hour %d after restore: %v", hour, diff)
+		}
+	}
+
+	// The prefix index is rebuilt on restore
+	flows, err := restored.Query(Query{Start: 1, End: 3, Filter: Filter{SrcCIDR: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}})
+	if err != nil {
+		t.Fatalf("unexpected error retrieving flows: %v", err)
+	}
+	if len(flows) != 2 {
+		t.Fatalf("expected 2 flow tuples within 10.0.0.0/8 after restore, got %d", len(flows))
+	}
+}
@@ -0,0 +1,300 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"path"
+	"time"
+)
+
+// ErrInvalidQuery is wrapped by the errors of queries that can never be answered, such as a time range ending
+// before it starts, as opposed to failures of the store
+var ErrInvalidQuery = errors.New("invalid query")
+
+// Query selects the flow data aggregated by FlowStore.Query
+type Query struct {
+	// Start is the first epoch hour aggregated and End the hour after the last, so a single hour is
+	// [hour, hour+1). They are ignored when From is set.
+	Start int
+	End   int
+	// From and To select the time range aggregated from From, inclusive, to To, exclusive. Every bucket of
+	// the store's granularity overlapping the range is aggregated.
+	From time.Time
+	To   time.Time
+	// Filter restricts the flow tuples aggregated, the zero value matches every tuple
+	Filter Filter
+	// GroupBy rolls the aggregated flows up to the listed dimensions, leaving the others empty.
+	// Without dimensions flows are grouped by the full flow tuple.
+	GroupBy []Dimension
+	// SrcPrefixLen and DstPrefixLen roll source and destination addresses up to subnets when grouping by
+	// DimensionSrcIP or DimensionDstIP. A zero length keeps whole addresses.
+	SrcPrefixLen PrefixLen
+	DstPrefixLen PrefixLen
+}
+
+// PrefixLen is a prefix length for IPv4 and for IPv6 addresses
+type PrefixLen struct {
+	V4 int
+	V6 int
+}
+
+func (l PrefixLen) validate() error {
+	if l.V4 < 0 || l.V4 > 32 {
+		return fmt.Errorf("IPv4 prefix length %d out of range", l.V4)
+	}
+	if l.V6 < 0 || l.V6 > 128 {
+		return fmt.Errorf("IPv6 prefix length %d out of range", l.V6)
+	}
+	return nil
+}
+
+// mask rolls an address up to the subnet of the prefix length of its address family
+func (l PrefixLen) mask(p netip.Prefix) netip.Prefix {
+	bits := l.V4
+	if p.Addr().Is6() {
+		bits = l.V6
+	}
+	if !p.IsValid() || bits == 0 || bits >= p.Bits() {
+		return p
+	}
+	masked, _ := p.Addr().Prefix(bits)
+	return masked
+}
+
+func (q Query) validate() error {
+	if !q.From.IsZero() || !q.To.IsZero() {
+		if q.From.IsZero() || q.To.IsZero() {
+			return errors.New("time range must have both a start and an end")
+		}
+		if !q.To.After(q.From) {
+			return fmt.Errorf("end time %v must be after start time %v", q.To, q.From)
+		}
+	} else {
+		if q.Start <= 0 {
+			return errors.New("timestamp must be greater than 0")
+		}
+		if q.End <= q.Start {
+			return fmt.Errorf("end hour %d must be greater than start hour %d", q.End, q.Start)
+		}
+	}
+	for _, d := range q.GroupBy {
+		if d < DimensionSrc || d > DimensionProtocol {
+			return fmt.Errorf("unknown dimension %d", int(d))
+		}
+	}
+	if err := q.SrcPrefixLen.validate(); err != nil {
+		return fmt.Errorf("invalid source prefix length: %w", err)
+	}
+	if err := q.DstPrefixLen.validate(); err != nil {
+		return fmt.Errorf("invalid destination prefix length: %w", err)
+	}
+	return nil
+}
+
+// group rolls flows aggregated per flow tuple up to the query's group by dimensions and returns the number of
+// group totals saturated
+func (q Query) group(flows []*Flow) ([]*Flow, int) {
+	if len(q.GroupBy) == 0 {
+		return flows, 0
+	}
+
+	by := q.dimensions()
+	var saturated int
+	grouped := []*Flow{}
+	groups := map[FlowKey]*Flow{}
+	for _, flow := range flows {
+		// Aggregated flows always hold a valid flow tuple
+		full, _ := flowKey(flow)
+		key := q.groupKey(full, by)
+
+		group, ok := groups[key]
+		if !ok {
+			group = key.flow(flow.Hour)
+			groups[key] = group
+			grouped = append(grouped, group)
+		}
+		if flowCounters(flow).addTo(group) {
+			saturated++
+		}
+	}
+	return grouped, saturated
+}
+
+// groupTotals rolls the totals of flow tuples, keyed by tuple, up to the query's group by dimensions,
+// returning the totals of each group keyed by group along with the number of saturated counters. Without
+// dimensions the totals are merged as they are.
+func (q Query) groupTotals(totals []map[FlowKey]*Flow, bucket int) (map[FlowKey]*Flow, int) {
+	by := q.dimensions()
+	var saturated int
+	groups := map[FlowKey]*Flow{}
+	for _, t := range totals {
+		for full, flow := range t {
+			if len(by) == 0 {
+				groups[full] = flow
+				continue
+			}
+			key := q.groupKey(full, by)
+			group, ok := groups[key]
+			if !ok {
+				group = key.flow(bucket)
+				groups[key] = group
+			}
+			if flowCounters(flow).addTo(group) {
+				saturated++
+			}
+		}
+	}
+	return groups, saturated
+}
+
+// dimensions returns the set of the query's group by dimensions
+func (q Query) dimensions() map[Dimension]bool {
+	by := map[Dimension]bool{}
+	for _, d := range q.GroupBy {
+		by[d] = true
+	}
+	return by
+}
+
+// groupKey returns the key of the group a flow tuple is rolled up to, holding only the grouped dimensions
+func (q Query) groupKey(full FlowKey, by map[Dimension]bool) FlowKey {
+	var key FlowKey
+	if by[DimensionSrc] {
+		key.Src = full.Src
+	}
+	if by[DimensionDst] {
+		key.Dst = full.Dst
+	}
+	if by[DimensionVpcID] {
+		key.VpcID = full.VpcID
+	}
+	if by[DimensionSrcIP] {
+		key.SrcIP = q.SrcPrefixLen.mask(full.SrcIP)
+	}
+	if by[DimensionDstIP] {
+		key.DstIP = q.DstPrefixLen.mask(full.DstIP)
+	}
+	if by[DimensionSrcPort] {
+		key.SrcPort = full.SrcPort
+	}
+	if by[DimensionDstPort] {
+		key.DstPort = full.DstPort
+	}
+	if by[DimensionProtocol] {
+		key.Protocol = full.Protocol
+	}
+	return key
+}
+
+// Dimension is a field of the flow tuple that flows can be grouped by
+type Dimension int
+
+const (
+	// DimensionSrc is the source application name
+	DimensionSrc Dimension = iota + 1
+	// DimensionDst is the destination application name
+	DimensionDst
+	// DimensionVpcID is the VPC ID
+	DimensionVpcID
+	// DimensionSrcIP is the source address of IP flows, or its subnet with a source prefix length
+	DimensionSrcIP
+	// DimensionDstIP is the destination address of IP flows, or its subnet with a destination prefix length
+	DimensionDstIP
+	// DimensionSrcPort is the source port of IP flows
+	DimensionSrcPort
+	// DimensionDstPort is the destination port of IP flows
+	DimensionDstPort
+	// DimensionProtocol is the protocol number of IP flows
+	DimensionProtocol
+)
+
+// String returns the name of the dimension, matching the JSON field of a Flow
+func (d Dimension) String() string {
+	switch d {
+	case DimensionSrc:
+		return "src_app"
+	case DimensionDst:
+		return "dest_app"
+	case DimensionVpcID:
+		return "vpc_id"
+	case DimensionSrcIP:
+		return "src_ip"
+	case DimensionDstIP:
+		return "dest_ip"
+	case DimensionSrcPort:
+		return "src_port"
+	case DimensionDstPort:
+		return "dest_port"
+	case DimensionProtocol:
+		return "protocol"
+	default:
+		return fmt.Sprintf("Dimension(%d)", int(d))
+	}
+}
+
+// ParseDimension returns the dimension for a name such as "src_app", "dest_app", "vpc_id" or "src_ip"
+func ParseDimension(s string) (Dimension, error) {
+	for d := DimensionSrc; d <= DimensionProtocol; d++ {
+		if d.String() == s {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown dimension %q", s)
+}
+
+// Filter restricts a query to the flow tuples matching each of its dimensions. A dimension matches when the
+// tuple's value is any of the listed values, a dimension without values matches every tuple.
+type Filter struct {
+	Src   []string
+	Dst   []string
+	VpcID []string
+	// VpcIDPatterns match tuples whose VPC ID matches any of the glob patterns, as understood by path.Match
+	VpcIDPatterns []string
+	// SrcCIDR and DstCIDR match IP flows whose source or destination address is within any of the CIDRs
+	SrcCIDR []netip.Prefix
+	DstCIDR []netip.Prefix
+}
+
+// Match reports whether a flow tuple passes the filter
+func (f Filter) Match(key FlowKey) bool {
+	return matchValue(f.Src, key.Src) && matchValue(f.Dst, key.Dst) && matchValue(f.VpcID, key.VpcID) &&
+		matchPattern(f.VpcIDPatterns, key.VpcID) && matchCIDR(f.SrcCIDR, key.SrcIP) && matchCIDR(f.DstCIDR, key.DstIP)
+}
+
+func matchPattern(patterns []string, v string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		// Patterns are validated by ParseVPCScope, so a malformed pattern simply matches nothing
+		if ok, _ := path.Match(pattern, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCIDR(cidrs []netip.Prefix, p netip.Prefix) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	for _, cidr := range cidrs {
+		if p.IsValid() && cidr.Bits() <= p.Bits() && cidr.Contains(p.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchValue(values []string, v string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// retentionPolicy describes how long flow data points are kept in the flow store
+type retentionPolicy struct {
+	// hours is the number of hours kept, 0 disables purging
+	hours    int
+	mode     RetentionMode
+	interval time.Duration
+	// timeline maps the retained hours and the wall clock onto buckets
+	timeline timeline
+}
+
+// cutoff returns the oldest bucket retained by the policy. Data points for earlier buckets are purged.
+// newestBucket is the most recent bucket inserted into the store.
+func (p retentionPolicy) cutoff(newestBucket int, now time.Time) int {
+	return p.latest(newestBucket, now) - p.timeline.hours(p.hours) + 1
+}
+
+// latest returns the bucket retention is measured from
+func (p retentionPolicy) latest(newestBucket int, now time.Time) int {
+	if p.mode == RetentionWallClock {
+		return p.timeline.bucket(now)
+	}
+	return newestBucket
+}
+
+// purges reports whether Purge has anything to remove, either hourly flow data or rollup periods
+func (fs *MemoryStore) purges() bool {
+	if fs.retention.hours > 0 {
+		return true
+	}
+	for _, t := range fs.rollups {
+		if t.retain > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Purge removes flow data points older than the retention period along with any flow tuples left
+// without data points, and the rollup periods older than the retention of their rollup.
+// It returns the number of data points removed.
+func (fs *MemoryStore) Purge() int {
+	if !fs.purges() {
+		return 0
+	}
+
+	start := fs.now()
+	// Every run is recorded, including runs that only purge rollups
+	defer func() {
+		fs.mm.purgeDuration.Observe(time.Since(start).Seconds())
+		fs.mm.purgeLastRun.Set(float64(start.Unix()))
+	}()
+
+	newest := int(atomic.LoadInt64(&fs.newestBucket))
+	rollups := fs.purgeRollups(fs.retention.latest(newest, start))
+	if rollups > 0 {
+		fs.ll.Debugf("purged %d expired rollup entries", rollups)
+	}
+
+	if fs.retention.hours <= 0 {
+		return 0
+	}
+
+	cutoff := fs.retention.cutoff(newest, start)
+	var removed int
+	for _, s := range fs.shards {
+		removed += s.purge(cutoff)
+	}
+
+	fs.observeBlocks()
+	fs.mm.flows.Sub(float64(removed))
+	fs.mm.purged.Add(float64(removed))
+
+	fs.ll.Debugf("purged %d flows older than %v", removed, fs.timeline.start(cutoff))
+	return removed
+}
+
+// purge removes data points and blocks older than the given bucket from the shard along with any flow
+// tuples left without data points
+func (s *shard) purge(before int) int {
+	s.lock()
+	defer s.unlock()
+
+	var removed int
+	for bucket, b := range s.blocks {
+		if bucket < before {
+			removed += b.points
+			delete(s.blocks, bucket)
+		}
+	}
+	for key, list := range s.flowMap {
+		removed += list.purge(before)
+		if list.len() == 0 {
+			s.remove(key)
+		}
+	}
+	return removed
+}
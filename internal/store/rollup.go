@@ -0,0 +1,224 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+)
+
+// Resolution is the number of hours in each period of a rollup
+type Resolution int
+
+const (
+	// ResolutionDay rolls flows up into days of 24 hours, counted from hour 0
+	ResolutionDay Resolution = 24
+	// ResolutionWeek rolls flows up into weeks of 168 hours, counted from hour 0
+	ResolutionWeek Resolution = 7 * 24
+)
+
+// String returns the name of the resolution used in metric labels
+func (r Resolution) String() string {
+	switch r {
+	case ResolutionDay:
+		return "day"
+	case ResolutionWeek:
+		return "week"
+	default:
+		return fmt.Sprintf("%dh", int(r))
+	}
+}
+
+// rollupTier describes a rollup kept alongside the hourly flow data
+type rollupTier struct {
+	resolution Resolution
+	// buckets is the number of buckets in each period
+	buckets int
+	// retain is the number of most recent periods kept, 0 keeps periods forever
+	retain int
+	// oldest is the oldest period kept after the latest purge, accessed atomically
+	oldest int64
+}
+
+// period returns the period of the rollup holding a bucket
+func (t *rollupTier) period(bucket int) int {
+	return floorDiv(bucket, t.buckets)
+}
+
+// rollupEntry is the totals of a flow tuple for a period of a rollup
+type rollupEntry struct {
+	key    FlowKey
+	period int
+	totals hourBucket
+}
+
+// rollup holds the totals of a shard's flow tuples for each period of a rollup tier
+type rollup map[int]map[FlowKey]*hourBucket
+
+// add folds the counters of a number of data points into the totals of their tuple for a period and reports
+// whether a new entry was created and whether a total saturated
+func (r rollup) add(period int, key FlowKey, c counters, count int) (created, saturated bool) {
+	totals, ok := r[period]
+	if !ok {
+		totals = map[FlowKey]*hourBucket{}
+		r[period] = totals
+	}
+	b, ok := totals[key]
+	if !ok {
+		b = &hourBucket{}
+		totals[key] = b
+	}
+	saturated = b.add(c)
+	b.count += count
+	return !ok, saturated
+}
+
+// purge removes the periods older than the given period and returns the number of entries removed
+func (r rollup) purge(before int) int {
+	var removed int
+	for period, totals := range r {
+		if period < before {
+			removed += len(totals)
+			delete(r, period)
+		}
+	}
+	return removed
+}
+
+// entries returns a copy of every entry of the rollup
+func (r rollup) entries() []rollupEntry {
+	var entries []rollupEntry
+	for period, totals := range r {
+		for key, b := range totals {
+			entries = append(entries, rollupEntry{key: key, period: period, totals: *b})
+		}
+	}
+	return entries
+}
+
+// span is a range of buckets from start, inclusive, to end, exclusive, answered by a rollup tier or, when
+// tier is -1, by the flow data
+type span struct {
+	tier       int
+	start, end int
+}
+
+// plan splits a range of buckets into spans answered by the coarsest rollup that holds them whole. Periods of
+// a rollup are used where they lie entirely within the range and have not been purged, the remaining buckets
+// at either end are answered by finer rollups and finally the flow data.
+func (fs *MemoryStore) plan(start, end int) []span {
+	return fs.planTiers(start, end, len(fs.rollups)-1)
+}
+
+func (fs *MemoryStore) planTiers(start, end, tier int) []span {
+	if start >= end {
+		return nil
+	}
+	if tier < 0 {
+		return []span{{tier: -1, start: start, end: end}}
+	}
+
+	t := fs.rollups[tier]
+	p := t.buckets
+	first := -floorDiv(-start, p)
+	if oldest := int(atomic.LoadInt64(&t.oldest)); first < oldest {
+		first = oldest
+	}
+	last := floorDiv(end, p)
+	if first >= last {
+		return fs.planTiers(start, end, tier-1)
+	}
+
+	spans := fs.planTiers(start, first*p, tier-1)
+	spans = append(spans, span{tier: tier, start: first * p, end: last * p})
+	return append(spans, fs.planTiers(last*p, end, tier-1)...)
+}
+
+// purgeRollups removes the rollup periods older than the retention of each tier, measured from the latest
+// bucket, and returns the number of entries removed
+func (fs *MemoryStore) purgeRollups(latest int) int {
+	var removed int
+	for i, t := range fs.rollups {
+		if t.retain <= 0 {
+			continue
+		}
+		before := t.period(latest) - t.retain + 1
+		atomic.StoreInt64(&t.oldest, int64(before))
+
+		var n int
+		for _, s := range fs.shards {
+			s.lock()
+			n += s.rollups[i].purge(before)
+			s.unlock()
+		}
+		fs.mm.rollupEntries.WithLabelValues(t.resolution.String()).Sub(float64(n))
+		removed += n
+	}
+	return removed
+}
+
+// rollupContents copies the entries of every rollup tier, one shard at a time
+func (fs *MemoryStore) rollupContents() map[Resolution][]rollupEntry {
+	contents := map[Resolution][]rollupEntry{}
+	for _, s := range fs.shards {
+		s.rlock()
+		for i, t := range fs.rollups {
+			contents[t.resolution] = append(contents[t.resolution], s.rollups[i].entries()...)
+		}
+		s.runlock()
+	}
+	return contents
+}
+
+// restoreRollups replaces the rollups of the configured tiers with the restored entries. Tiers missing from
+// the restored entries keep the rollups built from the restored hourly flow data.
+func (fs *MemoryStore) restoreRollups(contents map[Resolution][]rollupEntry) {
+	for i, t := range fs.rollups {
+		entries, ok := contents[t.resolution]
+		if !ok {
+			continue
+		}
+
+		for _, s := range fs.shards {
+			s.lock()
+			s.rollups[i] = rollup{}
+			s.unlock()
+		}
+		for _, e := range entries {
+			s := fs.shards[shardIndex(e.key, len(fs.shards))]
+			s.lock()
+			totals, ok := s.rollups[i][e.period]
+			if !ok {
+				totals = map[FlowKey]*hourBucket{}
+				s.rollups[i][e.period] = totals
+			}
+			b := e.totals
+			totals[e.key] = &b
+			s.unlock()
+		}
+		fs.mm.rollupEntries.WithLabelValues(t.resolution.String()).Set(float64(len(entries)))
+	}
+}
+
+// newRollupTiers returns the configured rollup tiers, finest first, with periods measured in the buckets of a
+// timeline
+func newRollupTiers(retain map[Resolution]int, tl timeline) ([]*rollupTier, error) {
+	var tiers []*rollupTier
+	for res, n := range retain {
+		if res <= 1 {
+			return nil, fmt.Errorf("rollup resolution must be more than 1 hour, got %d", int(res))
+		}
+		tiers = append(tiers, &rollupTier{resolution: res, buckets: tl.hours(int(res)), retain: n, oldest: math.MinInt64})
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].resolution < tiers[j].resolution })
+	return tiers, nil
+}
+
+// floorDiv divides rounding towards negative infinity
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,208 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+// rollupFlows returns data points for a handful of flow tuples every hour of the given number of weeks
+func rollupFlows(weeks int) []*Flow {
+	var flows []*Flow
+	for hour := 1; hour <= weeks*int(ResolutionWeek); hour++ {
+		for i := 0; i < 3; i++ {
+			flows = append(flows, &Flow{Src: fmt.Sprintf("app-%d", i), Dst: "db", VpcID: fmt.Sprintf("vpc-%d", hour%2), BytesTx: uint64(hour%7 + i), BytesRx: uint64(hour%5 + 2*i), Hour: hour})
+		}
+	}
+	return flows
+}
+
+func Test_RollupPlan(t *testing.T) {
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	store, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithRollup(ResolutionWeek, 0), WithRollup(ResolutionDay, 0))
+	if err != nil {
+		t.Fatalf("unexpected error creating flow store: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		start, end int
+		expected   []span
+	}{
+		{name: "within a day", start: 1, end: 5, expected: []span{{tier: -1, start: 1, end: 5}}},
+		{name: "single day", start: 24, end: 48, expected: []span{{tier: 0, start: 24, end: 48}}},
+		{name: "unaligned days", start: 20, end: 50, expected: []span{{tier: -1, start: 20, end: 24}, {tier: 0, start: 24, end: 48}, {tier: -1, start: 48, end: 50}}},
+		{name: "single week", start: 168, end: 336, expected: []span{{tier: 1, start: 168, end: 336}}},
+		{
+			name:     "weeks and days",
+			start:    150,
+			end:      400,
+			expected: []span{{tier: -1, start: 150, end: 168}, {tier: 1, start: 168, end: 336}, {tier: 0, start: 336, end: 384}, {tier: -1, start: 384, end: 400}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(store.plan(tt.start, tt.end), tt.expected, cmp.AllowUnexported(span{})); diff != "" {
+				t.Fatalf("unexpected plan: %v", diff)
+			}
+		})
+	}
+}
+
+func Test_RollupQuery(t *testing.T) {
+	insert := rollupFlows(3)
+	newest := 3 * int(ResolutionWeek)
+
+	ranges := []struct {
+		start, end int
+	}{
+		{start: 1, end: newest + 1},
+		{start: 24, end: 48},
+		{start: 30, end: 200},
+		{start: 168, end: 504},
+		{start: 100, end: 101},
+		// Only the periods held are read, however long the range
+		{start: 1, end: 1 << 40},
+	}
+
+	for _, version := range []FlowListVersion{FlowListV1, FlowListV2, FlowListBucket} {
+		t.Run(version.String(), func(t *testing.T) {
+			ll := logrus.New()
+			ll.SetOutput(io.Discard)
+
+			raw, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithFlowListVersion(version))
+			if err != nil {
+				t.Fatalf("unexpected error creating flow store: %v", err)
+			}
+			// Keep 2 days of hourly data, 14 days and every week
+			store, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithFlowListVersion(version), WithRetention(48, RetentionNewestHour),
+				WithRollup(ResolutionDay, 14), WithRollup(ResolutionWeek, 0))
+			if err != nil {
+				t.Fatalf("unexpected error creating flow store: %v", err)
+			}
+			for _, fs := range []*MemoryStore{raw, store} {
+				if err := fs.Insert(insert); err != nil {
+					t.Fatalf("unexpected error inserting flows: %v", err)
+				}
+			}
+
+			query := func(fs *MemoryStore, start, end int) []*Flow {
+				t.Helper()
+				flows, err := fs.Query(Query{Start: start, End: end, GroupBy: []Dimension{DimensionSrc, DimensionDst, DimensionVpcID}})
+				if err != nil {
+					t.Fatalf("unexpected error retrieving flows: %v", err)
+				}
+				return flows
+			}
+
+			// Before purging, rollups answer exactly what the hourly data would
+			for _, r := range ranges {
+				if diff := cmp.Diff(query(store, r.start, r.end), query(raw, r.start, r.end), cmpopts.SortSlices(less)); diff != "" {
+					t.Fatalf("unexpected flows for hours [%d, %d): %v", r.start, r.end, diff)
+				}
+			}
+
+			store.Purge()
+			if n := flowKeyCount(store); n == 0 {
+				t.Fatalf("expected the most recent hours to be kept")
+			}
+			if metricValue(t, store.mm.rollupEntries.WithLabelValues("day")) == 0 {
+				t.Fatalf("expected daily rollup entries after purging")
+			}
+
+			// Whole weeks outlive the hourly data and the daily rollup
+			if diff := cmp.Diff(query(store, 168, 336), query(raw, 168, 336), cmpopts.SortSlices(less)); diff != "" {
+				t.Fatalf("unexpected flows for purged week: %v", diff)
+			}
+			// Whole days are kept for the daily retention
+			if diff := cmp.Diff(query(store, 240, 264), query(raw, 240, 264), cmpopts.SortSlices(less)); diff != "" {
+				t.Fatalf("unexpected flows for purged day: %v", diff)
+			}
+			// Days older than the daily retention are gone
+			if flows := query(store, 24, 48); len(flows) != 0 {
+				t.Fatalf("expected no flows for a day past its retention, got %d", len(flows))
+			}
+			// Hours older than the hourly retention are gone
+			if flows := query(store, 240, 241); len(flows) != 0 {
+				t.Fatalf("expected no flows for an hour past its retention, got %d", len(flows))
+			}
+		})
+	}
+}
+
+func Test_RollupSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	insert := rollupFlows(2)
+	opts := []Option{WithRetention(24, RetentionNewestHour), WithRollup(ResolutionDay, 0)}
+
+	store := openSnapshotStore(t, dir, opts...)
+	if err := store.Insert(insert); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	store.Purge()
+
+	q := Query{Start: 24, End: 48}
+	expected, err := store.Query(q)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving flows: %v", err)
+	}
+	if len(expected) == 0 {
+		t.Fatalf("expected flows from the daily rollup")
+	}
+	if _, err := store.Snapshot(); err != nil {
+		t.Fatalf("unexpected error taking snapshot: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("unexpected error closing flow store: %v", err)
+	}
+
+	// The hourly data of the day was purged, so it is only restored from the snapshot's rollup
+	restored := openSnapshotStore(t, dir, opts...)
+	defer restored.Close()
+	flows, err := restored.Query(q)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving flows: %v", err)
+	}
+	if diff := cmp.Diff(flows, expected, cmpopts.SortSlices(less)); diff != "" {
+		t.Fatalf("unexpected flows after restore: %v", diff)
+	}
+}
+
+func Test_RollupPurgeMetrics(t *testing.T) {
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	// Only the daily rollup expires, the hourly data is kept forever
+	store, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithRollup(ResolutionDay, 1))
+	if err != nil {
+		t.Fatalf("unexpected error creating flow store: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	store.now = func() time.Time { return now }
+	if err := store.Insert(rollupFlows(1)); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if removed := store.Purge(); removed != 0 {
+		t.Fatalf("expected no flows purged, got %d", removed)
+	}
+
+	if lastRun := metricValue(t, store.mm.purgeLastRun); lastRun != float64(now.Unix()) {
+		t.Fatalf("expected the purge to be recorded at %d, got %v", now.Unix(), lastRun)
+	}
+	m := &dto.Metric{}
+	if err := store.mm.purgeDuration.Write(m); err != nil {
+		t.Fatalf("unable to read metric: %v", err)
+	}
+	if n := m.Histogram.GetSampleCount(); n != 1 {
+		t.Fatalf("expected 1 purge duration observed, got %d", n)
+	}
+}
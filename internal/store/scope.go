@@ -0,0 +1,96 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+// ErrOutOfScope is returned when inserting flows of a VPC outside the scope of a scoped flow store
+var ErrOutOfScope = errors.New("VPC is outside the scope of the flow store")
+
+// VPCScope is an allowlist of VPC IDs or glob patterns of VPC IDs, as understood by path.Match
+type VPCScope []string
+
+// ParseVPCScope returns the scope allowing the VPC IDs matching any of the patterns
+func ParseVPCScope(patterns []string) (VPCScope, error) {
+	if len(patterns) == 0 {
+		return nil, errors.New("VPC scope allows no VPCs")
+	}
+	for _, p := range patterns {
+		if p == "" {
+			return nil, errors.New("VPC scope has an empty pattern")
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("VPC scope pattern %q is malformed: %w", p, err)
+		}
+	}
+	return VPCScope(patterns), nil
+}
+
+// Allows reports whether the flows of a VPC are within the scope
+func (s VPCScope) Allows(vpcID string) bool {
+	return matchPattern(s, vpcID)
+}
+
+// scopedStore exposes only the flows of the VPCs within a scope of the flow store it wraps
+type scopedStore struct {
+	FlowStore
+	scope VPCScope
+}
+
+// Scoped returns a flow store exposing only the flows of the VPCs within scope. The flows of other VPCs are
+// filtered out before flows are aggregated, so they are not counted in the totals of any grouping or in top
+// flows, and inserting them fails with ErrOutOfScope.
+func Scoped(fs FlowStore, scope VPCScope) FlowStore {
+	return &scopedStore{FlowStore: fs, scope: scope}
+}
+
+// Insert adds flow data points to the store if every flow is within the scope
+func (ss *scopedStore) Insert(flows []*Flow) error {
+	for _, flow := range flows {
+		if !ss.scope.Allows(flow.VpcID) {
+			return fmt.Errorf("%w: %q", ErrOutOfScope, flow.VpcID)
+		}
+	}
+	return ss.FlowStore.Insert(flows)
+}
+
+// Get returns an aggregation of flow stats for the tuples within the scope for a given hour
+func (ss *scopedStore) Get(hour int) ([]*Flow, error) {
+	return ss.Query(Query{Start: hour, End: hour + 1})
+}
+
+// GetRange returns an aggregation of flow stats for the tuples within the scope over the hours from start,
+// inclusive, to end, exclusive
+func (ss *scopedStore) GetRange(start, end int) ([]*Flow, error) {
+	return ss.Query(Query{Start: start, End: end})
+}
+
+// Query returns an aggregation of the flow stats of the tuples within the scope matching the query
+func (ss *scopedStore) Query(q Query) ([]*Flow, error) {
+	q, err := ss.scoped(q)
+	if err != nil {
+		return nil, err
+	}
+	return ss.FlowStore.Query(q)
+}
+
+// Top returns the n flows within the scope of a query ranked highest by the given rank
+func (ss *scopedStore) Top(q Query, n int, rank Rank) ([]*Flow, error) {
+	q, err := ss.scoped(q)
+	if err != nil {
+		return nil, err
+	}
+	return ss.FlowStore.Top(q, n, rank)
+}
+
+// scoped restricts a query to the scope. Patterns of a query are alternatives, so a query already restricted
+// to patterns cannot be narrowed further and is refused rather than widened.
+func (ss *scopedStore) scoped(q Query) (Query, error) {
+	if len(q.Filter.VpcIDPatterns) > 0 {
+		return Query{}, fmt.Errorf("%w: query of a scoped flow store already has VPC ID patterns", ErrInvalidQuery)
+	}
+	q.Filter.VpcIDPatterns = ss.scope
+	return q, nil
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func Test_Scoped(t *testing.T) {
+	insert := []*Flow{
+		{Src: "foo", Dst: "bar", VpcID: "team-a-1", BytesTx: 1, BytesRx: 2, Hour: 1},
+		{Src: "foo", Dst: "bar", VpcID: "team-a-2", BytesTx: 10, BytesRx: 20, Hour: 1},
+		{Src: "foo", Dst: "bar", VpcID: "team-b-1", BytesTx: 100, BytesRx: 200, Hour: 1},
+		{Src: "baz", Dst: "bar", VpcID: "shared", BytesTx: 1000, BytesRx: 2000, Hour: 1},
+	}
+	scope, err := ParseVPCScope([]string{"team-a-*", "shared"})
+	if err != nil {
+		t.Fatalf("unexpected error parsing VPC scope: %v", err)
+	}
+
+	for name, store := range openQueryStores(t, insert) {
+		t.Run(name, func(t *testing.T) {
+			scoped := Scoped(store, scope)
+
+			flows, err := scoped.Get(1)
+			if err != nil {
+				t.Fatalf("unexpected error retrieving flows: %v", err)
+			}
+			expected := reported([]*Flow{insert[0], insert[1], insert[3]})
+			if diff := cmp.Diff(flows, expected, cmpopts.SortSlices(less)); diff != "" {
+				t.Fatalf("unexpected flows: %v", diff)
+			}
+
+			// Grouped totals only count the flows within the scope
+			flows, err = scoped.Query(Query{Start: 1, End: 2, GroupBy: []Dimension{DimensionDst}})
+			if err != nil {
+				t.Fatalf("unexpected error querying flows: %v", err)
+			}
+			expected = reported([]*Flow{{Dst: "bar", BytesTx: 1011, BytesRx: 2022, Hour: 1}})
+			if diff := cmp.Diff(flows, expected); diff != "" {
+				t.Fatalf("unexpected grouped flows: %v", diff)
+			}
+
+			flows, err = scoped.Top(Query{Start: 1, End: 2, Filter: Filter{Src: []string{"foo"}}}, 1, RankTotal)
+			if err != nil {
+				t.Fatalf("unexpected error retrieving top flows: %v", err)
+			}
+			expected = reported([]*Flow{insert[1]})
+			if diff := cmp.Diff(flows, expected); diff != "" {
+				t.Fatalf("unexpected top flows: %v", diff)
+			}
+
+			if _, err := scoped.Query(Query{Start: 1, End: 2, Filter: Filter{VpcIDPatterns: []string{"*"}}}); err == nil {
+				t.Fatal("expected an error widening the scope of a query")
+			}
+			if err := scoped.Insert([]*Flow{{Src: "foo", Dst: "bar", VpcID: "team-b-2", BytesTx: 1, Hour: 2}}); !errors.Is(err, ErrOutOfScope) {
+				t.Fatalf("expected an out of scope error, got %v", err)
+			}
+		})
+	}
+
+	for _, patterns := range [][]string{nil, {""}, {"team-["}} {
+		if _, err := ParseVPCScope(patterns); err == nil {
+			t.Fatalf("expected an error parsing VPC scope %q", patterns)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"hash/fnv"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// shard is a lock-striped partition of the flow store holding the flow tuples whose FlowKey hashes to it
+type shard struct {
+	mu sync.RWMutex
+	// a mapping of a uniquely identifying flow key to a generic flow list interface
+	flowMap map[FlowKey]flowList
+	// srcIndex and dstIndex index the flow tuples of IP flows in flowMap by source and destination address
+	srcIndex prefixTree
+	dstIndex prefixTree
+	// blocks holds the sealed data points of the shard's flow tuples, keyed by bucket
+	blocks map[int]*block
+	// rollups holds the shard's totals for each rollup tier of the store, in the same order
+	rollups []rollup
+	// readWait and writeWait observe how long callers waited to acquire mu
+	readWait  prometheus.Observer
+	writeWait prometheus.Observer
+	// tuples counts the flow tuples in flowMap across every shard of the store, accessed atomically
+	tuples      *int64
+	tuplesGauge prometheus.Gauge
+}
+
+func newShard(id int, tiers int, tuples *int64, mm *Metrics) *shard {
+	label := strconv.Itoa(id)
+	rollups := make([]rollup, tiers)
+	for i := range rollups {
+		rollups[i] = rollup{}
+	}
+	return &shard{
+		flowMap:     map[FlowKey]flowList{},
+		blocks:      map[int]*block{},
+		rollups:     rollups,
+		readWait:    mm.shardLockWait.WithLabelValues(label, "read"),
+		writeWait:   mm.shardLockWait.WithLabelValues(label, "write"),
+		tuples:      tuples,
+		tuplesGauge: mm.tuples,
+	}
+}
+
+// add adds the flow list of a new flow tuple to the shard
+func (s *shard) add(key FlowKey, list flowList) {
+	s.flowMap[key] = list
+	atomic.AddInt64(s.tuples, 1)
+	s.tuplesGauge.Inc()
+	if key.SrcIP.IsValid() {
+		s.srcIndex.insert(key.SrcIP, key)
+	}
+	if key.DstIP.IsValid() {
+		s.dstIndex.insert(key.DstIP, key)
+	}
+}
+
+// remove removes a flow tuple from the shard
+func (s *shard) remove(key FlowKey) {
+	delete(s.flowMap, key)
+	atomic.AddInt64(s.tuples, -1)
+	s.tuplesGauge.Dec()
+	if key.SrcIP.IsValid() {
+		s.srcIndex.remove(key.SrcIP, key)
+	}
+	if key.DstIP.IsValid() {
+		s.dstIndex.remove(key.DstIP, key)
+	}
+}
+
+// match calls fn for the flow list of every flow tuple passing the filter. Filters on source or
+// destination CIDRs only visit the tuples found in the prefix index.
+func (s *shard) match(filter Filter, fn func(key FlowKey, list flowList)) {
+	var index *prefixTree
+	var cidrs []netip.Prefix
+	switch {
+	case len(filter.SrcCIDR) > 0:
+		index, cidrs = &s.srcIndex, filter.SrcCIDR
+	case len(filter.DstCIDR) > 0:
+		index, cidrs = &s.dstIndex, filter.DstCIDR
+	default:
+		for key, list := range s.flowMap {
+			if filter.Match(key) {
+				fn(key, list)
+			}
+		}
+		return
+	}
+
+	// Overlapping CIDRs may find a tuple more than once
+	seen := map[FlowKey]bool{}
+	for _, cidr := range cidrs {
+		index.walk(cidr, func(key FlowKey) {
+			if seen[key] {
+				return
+			}
+			seen[key] = true
+			if filter.Match(key) {
+				fn(key, s.flowMap[key])
+			}
+		})
+	}
+}
+
+// lock acquires the shard for writing and records the time spent waiting
+func (s *shard) lock() {
+	start := time.Now()
+	s.mu.Lock()
+	s.writeWait.Observe(time.Since(start).Seconds())
+}
+
+func (s *shard) unlock() {
+	s.mu.Unlock()
+}
+
+// rlock acquires the shard for reading and records the time spent waiting
+func (s *shard) rlock() {
+	start := time.Now()
+	s.mu.RLock()
+	s.readWait.Observe(time.Since(start).Seconds())
+}
+
+func (s *shard) runlock() {
+	s.mu.RUnlock()
+}
+
+// shardIndex returns the shard a flow tuple belongs to out of n shards
+func shardIndex(key FlowKey, n int) int {
+	h := fnv.New64a()
+	// Separate the fields so that ("ab", "c") and ("a", "bc") hash differently
+	h.Write([]byte(key.Src))
+	h.Write([]byte{0})
+	h.Write([]byte(key.Dst))
+	h.Write([]byte{0})
+	h.Write([]byte(key.VpcID))
+	if key.hasIP() {
+		h.Write([]byte{0})
+		h.Write(appendIPTuple(nil, key))
+	}
+	return int(h.Sum64() % uint64(n))
+}
@@ -0,0 +1,440 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotMagic   = "FLOWSNAP"
+	snapshotVersion = 1
+	snapshotPrefix  = "snapshot-"
+	snapshotSuffix  = ".snap"
+)
+
+// ErrNoSnapshots is returned when snapshots are used but no snapshot directory is configured
+var ErrNoSnapshots = errors.New("snapshots are not configured")
+
+// SnapshotInfo describes a snapshot of the flow store on disk
+type SnapshotInfo struct {
+	// Name is the file name of the snapshot in the snapshot directory
+	Name string `json:"name"`
+	// WALSegment is the first write-ahead log segment not included in the snapshot.
+	// Snapshots taken without a write-ahead log are numbered in sequence instead.
+	WALSegment int       `json:"wal_segment"`
+	Size       int64     `json:"size_bytes"`
+	Created    time.Time `json:"created"`
+}
+
+// snapshotter writes point-in-time snapshots of the flow store contents to a directory.
+//
+// A snapshot file starts with a magic string, a format version, the first write-ahead log segment it does
+// not include and the granularity in seconds. The body is the number of flow tuples followed by, for each
+// tuple, its key, the number of data points and each data point's counters, bucket and the number of data
+// points folded into it as varints, and then the number of rollups followed by, for each rollup, its
+// resolution, the number of entries and each entry's key, period and totals. Keys are the tuple's strings and IP 5-tuple, and counters are the byte, packet,
+// connection, drop and retransmit counters. The file ends with a CRC-32C of everything before it.
+type snapshotter struct {
+	// mu serializes snapshots
+	mu       sync.Mutex
+	dir      string
+	interval time.Duration
+	// retain is the number of most recent snapshots kept on disk
+	retain int
+	// timeline is the granularity of the buckets of the data points written
+	timeline timeline
+}
+
+func snapshotPath(dir string, seg int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%016d%s", snapshotPrefix, seg, snapshotSuffix))
+}
+
+// list returns the snapshots in the directory, oldest first
+func (sn *snapshotter) list() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(sn.dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list snapshot directory: %w", err)
+	}
+
+	var snapshots []SnapshotInfo
+	for _, e := range entries {
+		name := e.Name()
+		seg, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix))
+		if err != nil || name != filepath.Base(snapshotPath(sn.dir, seg)) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, fmt.Errorf("unable to stat snapshot %s: %w", name, err)
+		}
+		snapshots = append(snapshots, SnapshotInfo{
+			Name:       name,
+			WALSegment: seg,
+			Size:       info.Size(),
+			Created:    info.ModTime(),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].WALSegment < snapshots[j].WALSegment })
+	return snapshots, nil
+}
+
+// write durably writes a snapshot of contents that includes every write-ahead log segment before seg.
+// The snapshot is written to a temporary file that is renamed into place once it has been synced.
+func (sn *snapshotter) write(seg int, contents map[FlowKey][]sealedPoint, rollups map[Resolution][]rollupEntry) (SnapshotInfo, error) {
+	path := snapshotPath(sn.dir, seg)
+	tmp, err := os.CreateTemp(sn.dir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("unable to create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	crc := crc32.New(crcTable)
+	w := bufio.NewWriter(io.MultiWriter(tmp, crc))
+	if err := encodeSnapshot(w, seg, sn.timeline, contents, rollups); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("unable to write snapshot: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("unable to write snapshot: %w", err)
+	}
+	if err := binary.Write(tmp, binary.LittleEndian, crc.Sum32()); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("unable to write snapshot checksum: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("unable to sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("unable to close snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("unable to rename snapshot into place: %w", err)
+	}
+	if err := syncDir(sn.dir); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("unable to stat snapshot: %w", err)
+	}
+	return SnapshotInfo{
+		Name:       filepath.Base(path),
+		WALSegment: seg,
+		Size:       info.Size(),
+		Created:    info.ModTime(),
+	}, nil
+}
+
+func encodeSnapshot(w io.Writer, seg int, tl timeline, contents map[FlowKey][]sealedPoint, rollups map[Resolution][]rollupEntry) error {
+	buf := []byte(snapshotMagic)
+	buf = appendUvarint(buf, snapshotVersion)
+	buf = appendUvarint(buf, uint64(seg))
+	buf = appendUvarint(buf, uint64(tl.width))
+	buf = appendUvarint(buf, uint64(len(contents)))
+	for key, points := range contents {
+		buf = appendKey(buf, key)
+		buf = appendUvarint(buf, uint64(len(points)))
+		for _, p := range points {
+			buf = appendCounters(buf, p.counters)
+			buf = appendVarint(buf, int64(p.bucket))
+			buf = appendUvarint(buf, uint64(p.count))
+		}
+		// Flush each tuple so the encoding buffer stays small
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		buf = buf[:0]
+	}
+
+	buf = appendUvarint(buf, uint64(len(rollups)))
+	for res, entries := range rollups {
+		buf = appendUvarint(buf, uint64(res))
+		buf = appendUvarint(buf, uint64(len(entries)))
+		for _, e := range entries {
+			buf = appendKey(buf, e.key)
+			buf = appendVarint(buf, int64(e.period))
+			buf = appendCounters(buf, e.totals.counters)
+			buf = appendUvarint(buf, uint64(e.totals.count))
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// read decodes and verifies a snapshot, returning the write-ahead log segment it was taken at, its contents
+// and its rollups. Data points are moved to the buckets of the snapshotter's timeline holding the start of
+// their bucket, so they can be restored into a store of another granularity.
+func (sn *snapshotter) read(name string) (int, map[FlowKey][]sealedPoint, map[Resolution][]rollupEntry, error) {
+	data, err := os.ReadFile(filepath.Join(sn.dir, name))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if len(data) < len(snapshotMagic)+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, nil, nil, errors.New("not a flow store snapshot")
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return 0, nil, nil, errors.New("snapshot checksum mismatch")
+	}
+
+	d := &decoder{buf: body[len(snapshotMagic):]}
+	if version := d.uvarint(); d.err == nil && version != snapshotVersion {
+		return 0, nil, nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	seg := int(d.uvarint())
+	tl := timeline{width: int64(d.uvarint())}
+	if d.err == nil && tl.width == 0 {
+		return 0, nil, nil, errors.New("snapshot granularity of 0 seconds")
+	}
+	keys := d.uvarint()
+
+	contents := map[FlowKey][]sealedPoint{}
+	for i := uint64(0); i < keys && d.err == nil; i++ {
+		key := d.key()
+		n := d.uvarint()
+		// Every data point takes at least 9 bytes, guard against allocating for a corrupt count
+		if n > uint64(len(d.buf)/9) {
+			return 0, nil, nil, fmt.Errorf("data point count %d exceeds snapshot size", n)
+		}
+		points := make([]sealedPoint, 0, n)
+		for j := uint64(0); j < n && d.err == nil; j++ {
+			p := sealedPoint{counters: d.counters()}
+			p.bucket = sn.timeline.bucket(tl.start(int(d.varint())))
+			p.count = int(d.uvarint())
+			points = append(points, p)
+		}
+		contents[key] = points
+	}
+	if d.err != nil {
+		return 0, nil, nil, d.err
+	}
+
+	rollups := map[Resolution][]rollupEntry{}
+	tiers := d.uvarint()
+	for i := uint64(0); i < tiers && d.err == nil; i++ {
+		res := Resolution(d.uvarint())
+		n := d.uvarint()
+		// Every entry takes at least 15 bytes, guard against allocating for a corrupt count
+		if n > uint64(len(d.buf)/15) {
+			return 0, nil, nil, fmt.Errorf("rollup entry count %d exceeds snapshot size", n)
+		}
+		entries := make([]rollupEntry, 0, n)
+		for j := uint64(0); j < n && d.err == nil; j++ {
+			e := rollupEntry{key: d.key()}
+			e.period = int(d.varint())
+			e.totals.counters = d.counters()
+			e.totals.count = int(d.uvarint())
+			entries = append(entries, e)
+		}
+		rollups[res] = entries
+	}
+	if d.err != nil {
+		return 0, nil, nil, d.err
+	}
+	return seg, contents, rollups, nil
+}
+
+// prune removes all but the most recent retained snapshots
+func (sn *snapshotter) prune() error {
+	snapshots, err := sn.list()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(snapshots)-sn.retain; i++ {
+		if err := os.Remove(filepath.Join(sn.dir, snapshots[i].Name)); err != nil {
+			return fmt.Errorf("unable to remove snapshot %s: %w", snapshots[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// syncDir fsyncs a directory so that renames and new files within it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("unable to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("unable to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// Snapshot writes a point-in-time snapshot of the flow store contents and truncates the write-ahead log
+// up to the snapshot. Writers are only blocked while the contents are copied in memory, not while the
+// snapshot is written to disk.
+func (fs *MemoryStore) Snapshot() (SnapshotInfo, error) {
+	if fs.snapshots == nil {
+		return SnapshotInfo{}, ErrNoSnapshots
+	}
+	fs.snapshots.mu.Lock()
+	defer fs.snapshots.mu.Unlock()
+
+	start := time.Now()
+
+	// Block inserts so the copied contents hold exactly the flows logged before the new segment
+	fs.commitMu.Lock()
+	seg, err := fs.nextSnapshotSegment()
+	if err != nil {
+		fs.commitMu.Unlock()
+		return SnapshotInfo{}, err
+	}
+	contents := fs.contents()
+	rollups := fs.rollupContents()
+	fs.commitMu.Unlock()
+
+	info, err := fs.snapshots.write(seg, contents, rollups)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	if fs.wal != nil {
+		if err := fs.wal.removeBefore(seg); err != nil {
+			return info, err
+		}
+	}
+	if err := fs.snapshots.prune(); err != nil {
+		return info, err
+	}
+
+	fs.mm.snapshotDuration.Observe(time.Since(start).Seconds())
+	fs.mm.snapshotSize.Set(float64(info.Size))
+	fs.mm.snapshotLastSuccess.Set(float64(info.Created.Unix()))
+	fs.ll.Infof("wrote snapshot %s (%d bytes) in %v", info.Name, info.Size, time.Since(start))
+	return info, nil
+}
+
+// nextSnapshotSegment returns the number a new snapshot is taken at. With a write-ahead log this rotates
+// the log and returns the new segment, otherwise it numbers the snapshot after the latest one on disk.
+func (fs *MemoryStore) nextSnapshotSegment() (int, error) {
+	if fs.wal != nil {
+		return fs.wal.rotate()
+	}
+
+	snapshots, err := fs.snapshots.list()
+	if err != nil {
+		return 0, err
+	}
+	if len(snapshots) == 0 {
+		return 1, nil
+	}
+	return snapshots[len(snapshots)-1].WALSegment + 1, nil
+}
+
+// Snapshots returns the snapshots on disk, oldest first
+func (fs *MemoryStore) Snapshots() ([]SnapshotInfo, error) {
+	if fs.snapshots == nil {
+		return nil, ErrNoSnapshots
+	}
+	return fs.snapshots.list()
+}
+
+// contents copies the data points of every flow tuple along with the number of data points folded into each,
+// one shard at a time. Sealed data points are decoded from their blocks and come before the data points of the
+// flow lists.
+func (fs *MemoryStore) contents() map[FlowKey][]sealedPoint {
+	contents := map[FlowKey][]sealedPoint{}
+	for _, s := range fs.shards {
+		s.rlock()
+		hours := make([]int, 0, len(s.blocks))
+		for hour := range s.blocks {
+			hours = append(hours, hour)
+		}
+		sort.Ints(hours)
+		for _, hour := range hours {
+			err := s.blocks[hour].each(func(key FlowKey, p sealedPoint) {
+				contents[key] = append(contents[key], p)
+			})
+			if err != nil {
+				fs.ll.Errorf("unable to copy sealed flows: %v", err)
+			}
+		}
+		for key, list := range s.flowMap {
+			contents[key] = append(contents[key], list.dataPoints()...)
+		}
+		s.runlock()
+	}
+	return contents
+}
+
+// restore loads the most recent valid snapshot into the store and returns the first write-ahead
+// log segment it does not include. Invalid snapshots are skipped in favour of older ones.
+func (fs *MemoryStore) restore() (int, error) {
+	snapshots, err := fs.snapshots.list()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		seg, contents, rollups, err := fs.snapshots.read(snapshots[i].Name)
+		if err != nil {
+			fs.ll.Errorf("skipping invalid snapshot %s: %v", snapshots[i].Name, err)
+			continue
+		}
+
+		var restored int
+		for key, points := range contents {
+			restored += fs.restorePoints(key, points)
+		}
+		// Rollups may hold periods whose hourly data was already purged, so the snapshot's rollups replace
+		// those rebuilt from the restored flows
+		fs.restoreRollups(rollups)
+		fs.ll.Infof("restored %d flows from snapshot %s", restored, snapshots[i].Name)
+		return seg, nil
+	}
+	return 0, nil
+}
+
+// restorePoints adds the data points of a flow tuple read from a snapshot to the store, along with the number
+// of data points folded into each, and returns the number of data points the store holds for them
+func (fs *MemoryStore) restorePoints(key FlowKey, points []sealedPoint) int {
+	s := fs.shards[shardIndex(key, len(fs.shards))]
+	s.lock()
+	defer s.unlock()
+
+	list, ok := s.flowMap[key]
+	if !ok {
+		list = fs.newFlowList()
+		s.add(key, list)
+	}
+	var restored int
+	for _, p := range points {
+		n, err := list.restore(p)
+		if errors.Is(err, errOverflow) {
+			fs.mm.counterOverflows.Inc()
+		} else if err != nil {
+			fs.ll.Errorf("unable to restore flow for %v: %v", key, err)
+			continue
+		}
+		restored += n
+		fs.mm.flows.Add(float64(n))
+		fs.observeBucket(p.bucket)
+
+		for i, t := range fs.rollups {
+			created, saturated := s.rollups[i].add(t.period(p.bucket), key, p.counters, p.count)
+			if created {
+				fs.mm.rollupEntries.WithLabelValues(t.resolution.String()).Inc()
+			}
+			if saturated {
+				fs.mm.counterOverflows.Inc()
+			}
+		}
+	}
+	return restored
+}
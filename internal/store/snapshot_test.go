@@ -0,0 +1,181 @@
+package store
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// openSnapshotStore creates a flow store with a write-ahead log and snapshots under dir
+func openSnapshotStore(t *testing.T, dir string, opts ...Option) *MemoryStore {
+	t.Helper()
+
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	opts = append([]Option{
+		WithWAL(filepath.Join(dir, "wal"), SyncAlways, 0),
+		WithSnapshots(filepath.Join(dir, "snapshots"), 0, 2),
+	}, opts...)
+	store, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, opts...)
+	if err != nil {
+		t.Fatalf("unexpected error creating flow store: %v", err)
+	}
+	return store
+}
+
+func Test_SnapshotRestore(t *testing.T) {
+	for _, version := range []FlowListVersion{FlowListV1, FlowListV2, FlowListBucket} {
+		t.Run(version.String(), func(t *testing.T) {
+			dir := t.TempDir()
+
+			store := openSnapshotStore(t, dir, WithFlowListVersion(version))
+			if err := store.Insert(walFlows[:2]); err != nil {
+				t.Fatalf("unexpected error inserting flows: %v", err)
+			}
+			info, err := store.Snapshot()
+			if err != nil {
+				t.Fatalf("unexpected error taking snapshot: %v", err)
+			}
+			if info.WALSegment != 2 {
+				t.Fatalf("expected snapshot at write-ahead log segment 2, got %d", info.WALSegment)
+			}
+			// Flows inserted after the snapshot are only in the write-ahead log tail
+			if err := store.Insert(walFlows[2:]); err != nil {
+				t.Fatalf("unexpected error inserting flows: %v", err)
+			}
+
+			var expected [][]*Flow
+			for _, hour := range []int{1, 2} {
+				flows, err := store.Get(hour)
+				if err != nil {
+					t.Fatalf("unexpected error retrieving flows: %v", err)
+				}
+				expected = append(expected, flows)
+			}
+			if err := store.Close(); err != nil {
+				t.Fatalf("unexpected error closing flow store: %v", err)
+			}
+
+			// The segment included in the snapshot has been truncated
+			segs, err := walSegments(filepath.Join(dir, "wal"))
+			if err != nil {
+				t.Fatalf("unable to list write-ahead log: %v", err)
+			}
+			if diff := cmp.Diff(segs, []int{2}); diff != "" {
+				t.Fatalf("unexpected write-ahead log segments: %v", diff)
+			}
+
+			restored := openSnapshotStore(t, dir, WithFlowListVersion(version))
+			defer restored.Close()
+			for i, hour := range []int{1, 2} {
+				flows, err := restored.Get(hour)
+				if err != nil {
+					t.Fatalf("unexpected error retrieving flows: %v", err)
+				}
+				if diff := cmp.Diff(flows, expected[i], cmpopts.SortSlices(less)); diff != "" {
+					t.Fatalf("unexpected flows for hour %d after restore: %v", hour, diff)
+				}
+			}
+		})
+	}
+}
+
+func Test_SnapshotFallback(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openSnapshotStore(t, dir)
+	if err := store.Insert(walFlows[:2]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if _, err := store.Snapshot(); err != nil {
+		t.Fatalf("unexpected error taking snapshot: %v", err)
+	}
+	if err := store.Insert(walFlows[2:]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if _, err := store.Snapshot(); err != nil {
+		t.Fatalf("unexpected error taking snapshot: %v", err)
+	}
+	// A third snapshot prunes the first as only two are retained
+	latest, err := store.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error taking snapshot: %v", err)
+	}
+
+	snapshots, err := store.Snapshots()
+	if err != nil {
+		t.Fatalf("unexpected error listing snapshots: %v", err)
+	}
+	if len(snapshots) != 2 || snapshots[1].Name != latest.Name {
+		t.Fatalf("expected the 2 latest snapshots, got %+v", snapshots)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("unexpected error closing flow store: %v", err)
+	}
+
+	// Corrupt the latest snapshot, the previous one holds the same contents
+	path := filepath.Join(dir, "snapshots", latest.Name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read snapshot: %v", err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("unable to write snapshot: %v", err)
+	}
+
+	restored := openSnapshotStore(t, dir)
+	defer restored.Close()
+	if size := metricValue(t, restored.mm.flows); size != float64(len(walFlows)) {
+		t.Fatalf("expected flowstore size %d after restore, got %v", len(walFlows), size)
+	}
+}
+
+func Test_SnapshotDataPointCounts(t *testing.T) {
+	for _, version := range []FlowListVersion{FlowListV1, FlowListV2, FlowListBucket} {
+		for _, sealed := range []bool{false, true} {
+			t.Run(version.String()+"/sealed="+strconv.FormatBool(sealed), func(t *testing.T) {
+				dir := t.TempDir()
+				opts := []Option{WithFlowListVersion(version), WithRetention(1, RetentionNewestHour)}
+				if sealed {
+					opts = append(opts, WithSealing(1, 0))
+				}
+
+				store := openSnapshotStore(t, dir, opts...)
+				if err := store.Insert(walFlows); err != nil {
+					t.Fatalf("unexpected error inserting flows: %v", err)
+				}
+				// Hour 1 holds two data points of a tuple, folded together by bucket lists and blocks
+				if sealed {
+					store.Seal()
+				}
+				if _, err := store.Snapshot(); err != nil {
+					t.Fatalf("unexpected error taking snapshot: %v", err)
+				}
+				if err := store.Close(); err != nil {
+					t.Fatalf("unexpected error closing flow store: %v", err)
+				}
+
+				restored := openSnapshotStore(t, dir, opts...)
+				defer restored.Close()
+				if size := metricValue(t, restored.mm.flows); size != float64(len(walFlows)) {
+					t.Fatalf("expected flowstore size %d after restore, got %v", len(walFlows), size)
+				}
+				if removed := restored.Purge(); removed != 3 {
+					t.Fatalf("expected 3 flows purged after restore, got %d", removed)
+				}
+				if size := metricValue(t, restored.mm.flows); size != 1 {
+					t.Fatalf("expected flowstore size 1 after purge, got %v", size)
+				}
+			})
+		}
+	}
+}
@@ -2,9 +2,15 @@ package store
 
 import (
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
+	"math"
+	"net/netip"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
@@ -16,11 +22,33 @@ type Flow struct {
 	// Src is the source application name
 	Src string `json:"src_app"`
 	// Dst is the destination application name
-	Dst     string `json:"dest_app"`
-	VpcID   string `json:"vpc_id"`
-	BytesTx int    `json:"bytes_tx"`
-	BytesRx int    `json:"bytes_rx"`
-	Hour    int    `json:"hour"`
+	Dst   string `json:"dest_app"`
+	VpcID string `json:"vpc_id"`
+	// SrcIP and DstIP are the source and destination addresses of an IP flow. Flows rolled up to a prefix
+	// length report the subnet in CIDR notation. The IP 5-tuple is optional and left empty by app flows.
+	SrcIP   string `json:"src_ip,omitempty"`
+	DstIP   string `json:"dest_ip,omitempty"`
+	SrcPort int    `json:"src_port,omitempty"`
+	DstPort int    `json:"dest_port,omitempty"`
+	// Protocol is the IANA protocol number, such as 6 for TCP
+	Protocol int `json:"protocol,omitempty"`
+	// Counters are unsigned, so negative counters are rejected when flows are decoded. Aggregated counters
+	// saturate at the maximum value rather than overflowing.
+	BytesTx uint64 `json:"bytes_tx"`
+	BytesRx uint64 `json:"bytes_rx"`
+	// The packet, connection, drop and retransmit counters are optional and omitted when zero
+	PacketsTx   uint64 `json:"packets_tx,omitempty"`
+	PacketsRx   uint64 `json:"packets_rx,omitempty"`
+	Connections uint64 `json:"connections,omitempty"`
+	// Dropped is the number of packets rejected or dropped
+	Dropped     uint64 `json:"dropped,omitempty"`
+	Retransmits uint64 `json:"retransmits,omitempty"`
+	// Timestamp is the time of a data point and takes precedence over Hour. Aggregated flows report the start
+	// of the first bucket they cover.
+	Timestamp Timestamp `json:"timestamp"`
+	// Hour is the legacy time of a data point in hours since the unix epoch, used when it has no Timestamp.
+	// Aggregated flows report the hour holding their Timestamp.
+	Hour int `json:"hour"`
 }
 
 // FlowKey represents a unique tuple of identifying flow characteristics
@@ -28,90 +56,624 @@ type FlowKey struct {
 	Src   string
 	Dst   string
 	VpcID string
+	// SrcIP and DstIP are single addresses, or subnets once rolled up, and invalid for app flows
+	SrcIP    netip.Prefix
+	DstIP    netip.Prefix
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
 }
 
-// Could use a sync map but wanted to try this instead
-// TOOD(sneha) Thread-safe but there can be lock contention
-// How to speed this up?
-// FlowStore is a mapping of a linked list of flow data - keyed by a unique flow tuple
-type FlowStore struct {
-	mu sync.RWMutex
-	// a mapping of a uniquely identifying flow key to a generic flow list interface
-	flowMap map[FlowKey]flowList
-	mm      *Metrics
-	ll      *logrus.Logger
+// hasIP reports whether the tuple is of an IP flow
+func (k FlowKey) hasIP() bool {
+	return k.SrcIP.IsValid() || k.DstIP.IsValid() || k.SrcPort != 0 || k.DstPort != 0 || k.Protocol != 0
 }
 
-// NewFlowStore creates and returns a new flow store
-func NewFlowStore(reg *prometheus.Registry, ll *logrus.Logger) *FlowStore {
-	return &FlowStore{
-		mu:      sync.RWMutex{},
-		flowMap: map[FlowKey]flowList{},
-		mm:      NewMetrics(reg),
-		ll:      ll,
+// flow returns an empty flow for the tuple reported at a bucket
+func (k FlowKey) flow(bucket int) *Flow {
+	return &Flow{
+		Src:      k.Src,
+		Dst:      k.Dst,
+		VpcID:    k.VpcID,
+		SrcIP:    formatCIDR(k.SrcIP),
+		DstIP:    formatCIDR(k.DstIP),
+		SrcPort:  int(k.SrcPort),
+		DstPort:  int(k.DstPort),
+		Protocol: int(k.Protocol),
+		Hour:     bucket,
 	}
 }
 
-// Insert adds a flow entry in chronological order for a flowList
-func (fs *FlowStore) Insert(flows []*Flow) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+// MemoryStore is an in-memory FlowStore mapping of a linked list of flow data - keyed by a unique flow tuple.
+// Flow tuples are partitioned into lock-striped shards by a hash of their FlowKey so that
+// writes to one shard do not block reads and writes of the others.
+//
+// Data points are held in buckets of the configured granularity. Inserted flows are copied with their Hour
+// set to the index of their bucket, so within the store a flow's Hour is its bucket.
+type MemoryStore struct {
+	shards []*shard
+	// newFlowList creates the flow list for a flow tuple seen for the first time
+	newFlowList func() flowList
+	timeline    timeline
+	// newestBucket is the most recent bucket of any flow data point inserted, accessed atomically
+	newestBucket int64
+	// tuples is the number of flow tuples held across the shards along with those reserved by inserts in
+	// flight, accessed atomically. maxTuples limits it, 0 is unlimited.
+	tuples    int64
+	maxTuples int
+	retention retentionPolicy
+	sealing   sealingPolicy
+	// rollups are the rollup tiers kept alongside the hourly flow data, finest first
+	rollups []*rollupTier
+	// commitMu is held for reading while a batch is logged and applied, and for writing while a
+	// snapshot rotates the write-ahead log and copies the store contents
+	commitMu sync.RWMutex
+	// wal logs inserted flows so they survive restarts, nil when the write-ahead log is disabled
+	wal             *wal
+	walSyncInterval time.Duration
+	// snapshots writes snapshots of the store contents, nil when snapshots are disabled
+	snapshots *snapshotter
+	mm        *Metrics
+	ll        *logrus.Logger
+	// now returns the current time, it is replaced in tests
+	now func() time.Time
+}
 
-	for _, flow := range flows {
-		key := FlowKey{
-			Src:   flow.Src,
-			Dst:   flow.Dst,
-			VpcID: flow.VpcID,
+// NewMemoryStore creates and returns a new in-memory flow store.
+// If snapshots are configured the latest valid snapshot is restored, and if a write-ahead log is
+// configured the flows logged since are replayed into the store.
+func NewMemoryStore(reg prometheus.Registerer, ll *logrus.Logger, opts ...Option) (*MemoryStore, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	newFlowList, err := cfg.flowListVersion.newFlowList()
+	if err != nil {
+		ll.Errorf("%v, falling back to flow list %v", err, FlowListV1)
+		newFlowList = newFlowListV1
+	}
+
+	if cfg.shards < 1 {
+		ll.Errorf("invalid shard count %d, falling back to a single shard", cfg.shards)
+		cfg.shards = 1
+	}
+
+	tl, err := newTimeline(cfg.granularity)
+	if err != nil {
+		return nil, err
+	}
+
+	rollups, err := newRollupTiers(cfg.rollups, tl)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.maxTuples < 0 {
+		return nil, fmt.Errorf("tuple limit %d is negative", cfg.maxTuples)
+	}
+	// Sealing moves flow tuples out of the flow lists, so sealed tuples would escape the limit
+	if cfg.maxTuples > 0 && cfg.sealOpenHours > 0 {
+		return nil, errors.New("a tuple limit cannot be combined with sealing")
+	}
+
+	mm := NewMetrics(reg)
+	fs := &MemoryStore{
+		shards:      make([]*shard, cfg.shards),
+		newFlowList: newFlowList,
+		timeline:    tl,
+		maxTuples:   cfg.maxTuples,
+		retention: retentionPolicy{
+			hours:    cfg.retentionHours,
+			mode:     cfg.retentionMode,
+			interval: cfg.purgeInterval,
+			timeline: tl,
+		},
+		rollups: rollups,
+		sealing: sealingPolicy{
+			openHours: cfg.sealOpenHours,
+			interval:  cfg.sealInterval,
+		},
+		walSyncInterval: cfg.walSyncInterval,
+		mm:              mm,
+		ll:              ll,
+		now:             time.Now,
+	}
+	for i := range fs.shards {
+		fs.shards[i] = newShard(i, len(rollups), &fs.tuples, mm)
+	}
+
+	// Restore the latest snapshot and replay the write-ahead log written since
+	walStart := 1
+	if cfg.snapshotDir != "" {
+		if cfg.snapshotRetain < 1 {
+			ll.Errorf("invalid snapshot retention %d, keeping only the latest snapshot", cfg.snapshotRetain)
+			cfg.snapshotRetain = 1
 		}
-		flowList, ok := fs.flowMap[key]
-		if !ok {
-			flowList = &flowListV1{l: list.New()}
-			fs.flowMap[key] = flowList
+		if err := os.MkdirAll(cfg.snapshotDir, 0o755); err != nil {
+			return nil, fmt.Errorf("unable to create snapshot directory: %w", err)
 		}
-		err := flowList.insert(flow)
+		fs.snapshots = &snapshotter{
+			dir:      cfg.snapshotDir,
+			interval: cfg.snapshotInterval,
+			retain:   cfg.snapshotRetain,
+			timeline: tl,
+		}
+		seg, err := fs.restore()
 		if err != nil {
-			fs.ll.Errorf("unable to insert flow for %v: %v", key, err)
-			continue
+			return nil, err
 		}
-		fs.mm.flows.Inc()
+		if seg > walStart {
+			walStart = seg
+		}
+	}
+
+	if cfg.walDir != "" {
+		var replayed int
+		fs.wal, err = openWAL(cfg.walDir, walStart, cfg.walSyncMode, mm, ll, func(flows []*Flow) {
+			fs.apply(flows)
+			replayed += len(flows)
+		})
+		if err != nil {
+			return nil, err
+		}
+		ll.Infof("replayed %d flows from write-ahead log %s", replayed, cfg.walDir)
+	}
+
+	return fs, nil
+}
+
+// Close flushes and closes the write-ahead log, if any
+func (fs *MemoryStore) Close() error {
+	if fs.wal == nil {
+		return nil
+	}
+	return fs.wal.close()
+}
+
+// Run performs background maintenance of the flow store until the context is cancelled: purging
+// expired flow data points on the purge interval, sealing hours into blocks on the seal interval,
+// syncing the write-ahead log on the sync interval and taking snapshots on the snapshot interval.
+// Run returns immediately if there is no maintenance to do.
+func (fs *MemoryStore) Run(ctx context.Context) error {
+	var purge, seal, sync, snapshot <-chan time.Time
+
+	if fs.purges() {
+		if fs.retention.interval <= 0 {
+			return fmt.Errorf("purge interval must be greater than 0, got %v", fs.retention.interval)
+		}
+		if fs.retention.hours > 0 {
+			fs.ll.Infof("purging flows older than %d hours (%v) every %v", fs.retention.hours, fs.retention.mode, fs.retention.interval)
+		}
+		for _, t := range fs.rollups {
+			if t.retain > 0 {
+				fs.ll.Infof("purging %v rollups older than %d periods (%v) every %v", t.resolution, t.retain, fs.retention.mode, fs.retention.interval)
+			}
+		}
+		ticker := time.NewTicker(fs.retention.interval)
+		defer ticker.Stop()
+		purge = ticker.C
+	}
+
+	if fs.sealing.openHours > 0 {
+		if fs.sealing.interval <= 0 {
+			return fmt.Errorf("seal interval must be greater than 0, got %v", fs.sealing.interval)
+		}
+		fs.ll.Infof("sealing flows older than the latest %d hours every %v", fs.sealing.openHours, fs.sealing.interval)
+		ticker := time.NewTicker(fs.sealing.interval)
+		defer ticker.Stop()
+		seal = ticker.C
 	}
+
+	if fs.wal != nil && fs.wal.mode == SyncInterval {
+		if fs.walSyncInterval <= 0 {
+			return fmt.Errorf("write-ahead log sync interval must be greater than 0, got %v", fs.walSyncInterval)
+		}
+		ticker := time.NewTicker(fs.walSyncInterval)
+		defer ticker.Stop()
+		sync = ticker.C
+	}
+
+	if fs.snapshots != nil && fs.snapshots.interval > 0 {
+		ticker := time.NewTicker(fs.snapshots.interval)
+		defer ticker.Stop()
+		snapshot = ticker.C
+	}
+
+	if purge == nil && seal == nil && sync == nil && snapshot == nil {
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-purge:
+			fs.Purge()
+		case <-seal:
+			fs.Seal()
+		case <-sync:
+			if err := fs.wal.sync(); err != nil {
+				fs.ll.Errorf("%v", err)
+			}
+		case <-snapshot:
+			if _, err := fs.Snapshot(); err != nil {
+				fs.mm.snapshotFailures.Inc()
+				fs.ll.Errorf("unable to take snapshot: %v", err)
+			}
+		}
+	}
+}
+
+// Insert adds a flow entry in chronological order for a flowList.
+// When a write-ahead log is configured the flows are logged before they are added to the store.
+// Only the shards holding the inserted flow tuples are locked. Flows failing ValidateFlow are logged and
+// skipped, so callers reporting rejected flows validate them first.
+//
+// If the store has a tuple limit, a batch reserves the flow tuples it creates before it is applied, and a batch
+// that would create flow tuples beyond the limit is rejected as a whole with a *TupleLimitError.
+func (fs *MemoryStore) Insert(flows []*Flow) error {
+	if fs.maxTuples > 0 {
+		n, err := fs.reserveTuples(flows)
+		if err != nil {
+			fs.mm.tupleLimitRejected.Add(float64(len(err.Indexes)))
+			return err
+		}
+		// The tuples created are counted as they are added, so the reservation is released once applied
+		defer atomic.AddInt64(&fs.tuples, -int64(n))
+	}
+
+	fs.commitMu.RLock()
+	defer fs.commitMu.RUnlock()
+
+	if fs.wal != nil && len(flows) > 0 {
+		if err := fs.wal.append(flows); err != nil {
+			return err
+		}
+	}
+
+	fs.apply(flows)
 	return nil
 }
 
-// Get returns an aggregation of flow stats for all tuples for a given hour
-func (fs *FlowStore) Get(hour int) ([]*Flow, error) {
-	fs.mu.RLock()
-	defer fs.mu.RUnlock()
+// apply adds copies of flows, holding the index of their bucket as their hour, to the shards holding their
+// flow tuples
+func (fs *MemoryStore) apply(flows []*Flow) {
+	// Group the flows by shard so each shard is locked once
+	byShard := make([][]keyedFlow, len(fs.shards))
+	for _, flow := range flows {
+		key, err := validKey(flow)
+		if err != nil {
+			fs.ll.Errorf("unable to insert flow: %v", err)
+			continue
+		}
+		point := *flow
+		point.Timestamp, point.Hour = Timestamp{}, fs.timeline.flowBucket(flow)
+		i := shardIndex(key, len(fs.shards))
+		byShard[i] = append(byShard[i], keyedFlow{key: key, flow: &point})
+	}
 
-	if hour <= 0 {
-		return nil, errors.New("timestamp must be greater than 0")
+	for i, flows := range byShard {
+		if len(flows) == 0 {
+			continue
+		}
+		fs.insertShard(fs.shards[i], flows)
 	}
+}
 
-	flows := []*Flow{}
-	for key, list := range fs.flowMap {
-		flow, err := list.get(key, hour)
+// reserveTuples reserves room within the tuple limit for the flow tuples a batch creates, returning the number
+// reserved, or a *TupleLimitError listing the flows that would create flow tuples beyond the limit if the whole
+// batch does not fit. Concurrent inserts reserve without blocking each other.
+func (fs *MemoryStore) reserveTuples(flows []*Flow) (int, *TupleLimitError) {
+	// created holds the order in which each flow tuple new to the store first appears in the batch
+	created := map[FlowKey]int{}
+	for _, flow := range flows {
+		key, err := validKey(flow)
 		if err != nil {
-			fs.ll.Errorf("unable to retrieve aggregate flow for %v: %v", key, err)
 			continue
 		}
-		// No data present
-		if flow == nil {
+		if _, seen := created[key]; !seen && !fs.hasTuple(key) {
+			created[key] = len(created)
+		}
+	}
+	if len(created) == 0 {
+		return 0, nil
+	}
+
+	for {
+		held := atomic.LoadInt64(&fs.tuples)
+		room := fs.maxTuples - int(held)
+		if len(created) <= room {
+			if atomic.CompareAndSwapInt64(&fs.tuples, held, held+int64(len(created))) {
+				return len(created), nil
+			}
 			continue
 		}
+
+		var beyond []int
+		for i, flow := range flows {
+			key, err := validKey(flow)
+			if err != nil {
+				continue
+			}
+			if order, ok := created[key]; ok && order >= room {
+				beyond = append(beyond, i)
+			}
+		}
+		return 0, &TupleLimitError{Limit: fs.maxTuples, Indexes: beyond}
+	}
+}
+
+// hasTuple reports whether the store holds a flow tuple
+func (fs *MemoryStore) hasTuple(key FlowKey) bool {
+	s := fs.shards[shardIndex(key, len(fs.shards))]
+	s.rlock()
+	defer s.runlock()
+	_, ok := s.flowMap[key]
+	return ok
+}
+
+// keyedFlow is a flow data point along with its parsed flow tuple
+type keyedFlow struct {
+	key  FlowKey
+	flow *Flow
+}
+
+func (fs *MemoryStore) insertShard(s *shard, flows []keyedFlow) {
+	s.lock()
+	defer s.unlock()
+
+	for _, kf := range flows {
+		key, flow := kf.key, kf.flow
+		flowList, ok := s.flowMap[key]
+		if !ok {
+			flowList = fs.newFlowList()
+			s.add(key, flowList)
+		}
+		err := flowList.insert(flow)
+		if errors.Is(err, errOverflow) {
+			fs.mm.counterOverflows.Inc()
+		} else if err != nil {
+			fs.ll.Errorf("unable to insert flow for %v: %v", key, err)
+			continue
+		}
+		fs.mm.flows.Inc()
+		fs.observeBucket(flow.Hour)
+
+		for i, t := range fs.rollups {
+			created, saturated := s.rollups[i].add(t.period(flow.Hour), key, flowCounters(flow), 1)
+			if created {
+				fs.mm.rollupEntries.WithLabelValues(t.resolution.String()).Inc()
+			}
+			if saturated {
+				fs.mm.counterOverflows.Inc()
+			}
+		}
+	}
+}
+
+// observeBucket records bucket as the newest bucket inserted if it is more recent than any seen so far
+func (fs *MemoryStore) observeBucket(bucket int) {
+	for {
+		newest := atomic.LoadInt64(&fs.newestBucket)
+		if int64(bucket) <= newest || atomic.CompareAndSwapInt64(&fs.newestBucket, newest, int64(bucket)) {
+			return
+		}
+	}
+}
+
+// Get returns an aggregation of flow stats for all tuples for a given hour.
+// Shards are read concurrently and their results merged.
+func (fs *MemoryStore) Get(hour int) ([]*Flow, error) {
+	return fs.Query(Query{Start: hour, End: hour + 1})
+}
+
+// GetRange returns an aggregation of flow stats for all tuples over the hours from start, inclusive,
+// to end, exclusive. Shards are read concurrently and their results merged.
+func (fs *MemoryStore) GetRange(start, end int) ([]*Flow, error) {
+	return fs.Query(Query{Start: start, End: end})
+}
+
+// Query returns an aggregation of flow stats over the query's hours or time range for the tuples matching its
+// filter, rolled up to its group by dimensions. Tuples not matching the filter are skipped before their data
+// points are aggregated.
+func (fs *MemoryStore) Query(q Query) ([]*Flow, error) {
+	totals, start, err := fs.aggregate(q)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, saturated := q.groupTotals(totals, start)
+	fs.mm.counterOverflows.Add(float64(saturated))
+	flows := make([]*Flow, 0, len(groups))
+	for _, flow := range groups {
 		flows = append(flows, flow)
 	}
+	fs.timeline.report(flows, start)
 	return flows, nil
 }
 
-// TODO(sneha): create a Purge function that runs on an interval and purges the flowstore of records older than a
-// configured retention period. The purge function will also decrement the flow count metric
+// Top returns the n flows of a query ranked highest by the given rank, highest first. The totals of each
+// shard are offered to a heap bounded to n flows as they are, or once grouped when the query groups flows,
+// so the full result of the query is never built.
+func (fs *MemoryStore) Top(q Query, n int, rank Rank) ([]*Flow, error) {
+	if err := validateTop(n, rank); err != nil {
+		return nil, err
+	}
+	totals, start, err := fs.aggregate(q)
+	if err != nil {
+		return nil, err
+	}
+
+	h := newFlowHeap(n, rank)
+	if len(q.GroupBy) == 0 {
+		// Shards hold disjoint tuples, so their totals are final
+		for _, t := range totals {
+			for key, flow := range t {
+				h.offer(key, flow)
+			}
+		}
+	} else {
+		groups, saturated := q.groupTotals(totals, start)
+		fs.mm.counterOverflows.Add(float64(saturated))
+		for key, flow := range groups {
+			h.offer(key, flow)
+		}
+	}
+
+	top := h.top()
+	fs.timeline.report(top, start)
+	return top, nil
+}
+
+// aggregate returns the totals of the tuples of each shard matching the query over its range, keyed by
+// tuple, along with the bucket the range starts at. Shards are read concurrently.
+func (fs *MemoryStore) aggregate(q Query) ([]map[FlowKey]*Flow, int, error) {
+	start, end, err := fs.timeline.buckets(q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Whole days and weeks are read from rollups where they are kept
+	spans := fs.plan(start, end)
+
+	totals := make([]map[FlowKey]*Flow, len(fs.shards))
+	var wg sync.WaitGroup
+	for i, s := range fs.shards {
+		wg.Add(1)
+		go func(i int, s *shard) {
+			defer wg.Done()
+			totals[i] = fs.getShard(s, q.Filter, start, spans)
+		}(i, s)
+	}
+	wg.Wait()
+	return totals, start, nil
+}
+
+// getShard aggregates the data points of the shard's tuples matching the filter over the spans, reported at
+// the start bucket, returning the totals of each tuple
+func (fs *MemoryStore) getShard(s *shard, filter Filter, start int, spans []span) map[FlowKey]*Flow {
+	s.rlock()
+	defer s.runlock()
+
+	totals := map[FlowKey]*Flow{}
+	add := func(key FlowKey, c counters) {
+		total, ok := totals[key]
+		if !ok {
+			total = key.flow(start)
+			totals[key] = total
+		}
+		if c.addTo(total) {
+			fs.mm.counterOverflows.Inc()
+		}
+	}
+
+	for _, sp := range spans {
+		if sp.tier >= 0 {
+			// The periods held are walked rather than every period of the span, which may be far longer
+			t := fs.rollups[sp.tier]
+			first, last := t.period(sp.start), t.period(sp.end)
+			for period, totals := range s.rollups[sp.tier] {
+				if period < first || period >= last {
+					continue
+				}
+				for key, b := range totals {
+					if filter.Match(key) {
+						add(key, b.counters)
+					}
+				}
+			}
+			continue
+		}
+
+		// Data points inserted after a bucket was sealed are merged with the block's totals
+		for bucket, b := range s.blocks {
+			if bucket < sp.start || bucket >= sp.end {
+				continue
+			}
+			sealed, err := b.aggregate(filter)
+			if errors.Is(err, errOverflow) {
+				fs.mm.counterOverflows.Inc()
+			} else if err != nil {
+				fs.ll.Errorf("unable to retrieve sealed flows: %v", err)
+				continue
+			}
+			for key, flow := range sealed {
+				add(key, flowCounters(flow))
+			}
+		}
+
+		s.match(filter, func(key FlowKey, list flowList) {
+			flow, err := list.get(key, sp.start, sp.end)
+			if errors.Is(err, errOverflow) {
+				fs.mm.counterOverflows.Inc()
+			} else if err != nil {
+				fs.ll.Errorf("unable to retrieve aggregate flow for %v: %v", key, err)
+				return
+			}
+			// No data present
+			if flow == nil {
+				return
+			}
+			add(key, flowCounters(flow))
+		})
+	}
+
+	return totals
+}
+
+// flowKey returns the unique tuple identifying a flow, or a *ValidationError if its IP 5-tuple is invalid
+func flowKey(flow *Flow) (FlowKey, error) {
+	key := FlowKey{
+		Src:   flow.Src,
+		Dst:   flow.Dst,
+		VpcID: flow.VpcID,
+	}
+
+	var err error
+	if flow.SrcIP != "" {
+		if key.SrcIP, err = ParseCIDR(flow.SrcIP); err != nil {
+			return FlowKey{}, invalid(InvalidIP, "invalid source IP: %w", err)
+		}
+	}
+	if flow.DstIP != "" {
+		if key.DstIP, err = ParseCIDR(flow.DstIP); err != nil {
+			return FlowKey{}, invalid(InvalidIP, "invalid destination IP: %w", err)
+		}
+	}
+	if flow.SrcPort < 0 || flow.SrcPort > math.MaxUint16 {
+		return FlowKey{}, invalid(InvalidPort, "source port %d out of range", flow.SrcPort)
+	}
+	if flow.DstPort < 0 || flow.DstPort > math.MaxUint16 {
+		return FlowKey{}, invalid(InvalidPort, "destination port %d out of range", flow.DstPort)
+	}
+	if flow.Protocol < 0 || flow.Protocol > math.MaxUint8 {
+		return FlowKey{}, invalid(InvalidProtocol, "protocol %d out of range", flow.Protocol)
+	}
+	key.SrcPort, key.DstPort, key.Protocol = uint16(flow.SrcPort), uint16(flow.DstPort), uint8(flow.Protocol)
+	return key, nil
+}
 
-// flowList is a generic interface that accepts flow data points
+// flowList is a generic interface that accepts flow data points, whose Hour holds the index of their bucket, and
 // returns aggregated flow data.
 // Implementations may vary in run-time complexity and efficiency.
 type flowList interface {
 	insert(flow *Flow) error
-	get(key FlowKey, hour int) (*Flow, error)
+	// get returns the aggregated flow over the buckets from start, inclusive, to end, exclusive, reported at
+	// the start bucket, or nil if there are no data points in the range. If a sum saturates the saturated
+	// aggregate is returned along with errOverflow.
+	get(key FlowKey, start, end int) (*Flow, error)
+	// purge removes all data points older than the given bucket and returns the number removed
+	purge(before int) int
+	// take removes all data points older than the given bucket and returns them to be sealed
+	take(before int) []sealedPoint
+	// len returns the number of data points held
+	len() int
+	// dataPoints returns the data points held, oldest first where the implementation keeps an order
+	dataPoints() []sealedPoint
+	// restore adds a data point of a snapshot, which may have several data points folded into it, and returns
+	// the number of data points the list holds for it
+	restore(p sealedPoint) (int, error)
 }
 
 // flowListV1 is the less optimized flow list that inserts in any order and does a brute-force
@@ -120,6 +682,10 @@ type flowListV1 struct {
 	l *list.List
 }
 
+func newFlowListV1() flowList {
+	return &flowListV1{l: list.New()}
+}
+
 // insert a new flow data point.
 // Note: The current iteration does not preserve chronological order, which makes insertion quite fast.
 // To improve aggregation speed in the future, chronological insertion or aggregation into a single flow on insert may be done.
@@ -129,21 +695,61 @@ func (fl *flowListV1) insert(flow *Flow) error {
 	return nil
 }
 
-// get returns an aggregated for for a given tuple and hour timestamp
-func (fl *flowListV1) get(key FlowKey, hour int) (*Flow, error) {
-	if hour <= 0 {
-		return nil, fmt.Errorf("provided hour timestamp must be greater than 0")
+// purge removes all data points older than the given hour
+func (fl *flowListV1) purge(before int) int {
+	var removed int
+	for e := fl.l.Front(); e != nil; {
+		next := e.Next()
+		if flow, ok := e.Value.(*Flow); ok && flow.Hour < before {
+			fl.l.Remove(e)
+			removed++
+		}
+		e = next
 	}
+	return removed
+}
 
-	var found bool
-	aggregateFlow := &Flow{
-		Src:     key.Src,
-		Dst:     key.Dst,
-		VpcID:   key.VpcID,
-		Hour:    hour,
-		BytesTx: 0,
-		BytesRx: 0,
+// take removes all data points older than the given hour and returns them
+func (fl *flowListV1) take(before int) []sealedPoint {
+	var points []sealedPoint
+	for e := fl.l.Front(); e != nil; {
+		next := e.Next()
+		if flow, ok := e.Value.(*Flow); ok && flow.Hour < before {
+			fl.l.Remove(e)
+			points = append(points, sealedPoint{bucket: flow.Hour, counters: flowCounters(flow), count: 1})
+		}
+		e = next
 	}
+	return points
+}
+
+func (fl *flowListV1) len() int {
+	return fl.l.Len()
+}
+
+func (fl *flowListV1) dataPoints() []sealedPoint {
+	points := make([]sealedPoint, 0, fl.l.Len())
+	for e := fl.l.Front(); e != nil; e = e.Next() {
+		if flow, ok := e.Value.(*Flow); ok {
+			points = append(points, sealedPoint{bucket: flow.Hour, counters: flowCounters(flow), count: 1})
+		}
+	}
+	return points
+}
+
+// restore adds the totals of a data point as a single data point
+func (fl *flowListV1) restore(p sealedPoint) (int, error) {
+	return 1, fl.insert(p.flow())
+}
+
+// get returns an aggregated flow for a given tuple and range of hour timestamps
+func (fl *flowListV1) get(key FlowKey, start, end int) (*Flow, error) {
+	if start <= 0 {
+		return nil, fmt.Errorf("provided hour timestamp must be greater than 0")
+	}
+
+	var found, saturated bool
+	aggregateFlow := key.flow(start)
 
 	for e := fl.l.Front(); e != nil; e = e.Next() {
 		flow, ok := e.Value.(*Flow)
@@ -152,10 +758,11 @@ func (fl *flowListV1) get(key FlowKey, hour int) (*Flow, error) {
 			continue
 		}
 
-		if flow.Hour == hour {
+		if flow.Hour >= start && flow.Hour < end {
 			found = true
-			aggregateFlow.BytesRx += flow.BytesRx
-			aggregateFlow.BytesTx += flow.BytesTx
+			if flowCounters(flow).addTo(aggregateFlow) {
+				saturated = true
+			}
 		}
 	}
 
@@ -163,6 +770,9 @@ func (fl *flowListV1) get(key FlowKey, hour int) (*Flow, error) {
 	if !found {
 		return nil, nil
 	}
+	if saturated {
+		return aggregateFlow, errOverflow
+	}
 
 	return aggregateFlow, nil
 }
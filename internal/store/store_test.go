@@ -1,15 +1,32 @@
 package store
 
 import (
+	"fmt"
 	"io"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sirupsen/logrus"
 )
 
+// reported returns copies of flows timestamped with the start of their hour, as they are reported by a
+// store of the default granularity
+func reported(flows []*Flow) []*Flow {
+	out := make([]*Flow, len(flows))
+	for i, flow := range flows {
+		f := *flow
+		f.Timestamp = Timestamp{time.Unix(int64(flow.Hour)*3600, 0)}
+		out[i] = &f
+	}
+	return out
+}
+
 // less if used for sorting Flow slices for testing
 func less(f1 *Flow, f2 *Flow) bool {
 	if f1.Src != f2.Src {
@@ -21,6 +38,21 @@ func less(f1 *Flow, f2 *Flow) bool {
 	if f1.VpcID != f2.VpcID {
 		return f1.VpcID < f2.VpcID
 	}
+	if f1.SrcIP != f2.SrcIP {
+		return f1.SrcIP < f2.SrcIP
+	}
+	if f1.DstIP != f2.DstIP {
+		return f1.DstIP < f2.DstIP
+	}
+	if f1.SrcPort != f2.SrcPort {
+		return f1.SrcPort < f2.SrcPort
+	}
+	if f1.DstPort != f2.DstPort {
+		return f1.DstPort < f2.DstPort
+	}
+	if f1.Protocol != f2.Protocol {
+		return f1.Protocol < f2.Protocol
+	}
 	if f1.BytesTx != f2.BytesTx {
 		return f1.BytesTx < f2.BytesTx
 	}
@@ -30,6 +62,29 @@ func less(f1 *Flow, f2 *Flow) bool {
 	return f1.Hour < f2.Hour
 }
 
+// metricValue returns the current value of a gauge or counter
+func metricValue(t *testing.T, c prometheus.Metric) float64 {
+	t.Helper()
+
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatalf("unable to read metric: %v", err)
+	}
+	if m.Gauge != nil {
+		return m.Gauge.GetValue()
+	}
+	return m.Counter.GetValue()
+}
+
+// flowKeyCount returns the number of flow tuples held across all shards of a store
+func flowKeyCount(fs *MemoryStore) int {
+	var n int
+	for _, s := range fs.shards {
+		n += len(s.flowMap)
+	}
+	return n
+}
+
 func Test_Flow(t *testing.T) {
 	// TODO(sneha): Add more extensive tests in table tests later
 	tests := []struct {
@@ -88,30 +143,526 @@ func Test_Flow(t *testing.T) {
 		},
 	}
 
+	for _, version := range []FlowListVersion{FlowListV1, FlowListV2, FlowListBucket} {
+		for _, tt := range tests {
+			t.Run(version.String()+"/"+tt.name, func(t *testing.T) {
+
+				ll := logrus.New()
+				ll.SetOutput(io.Discard)
+
+				reg := prometheus.NewPedanticRegistry()
+				store, err := NewMemoryStore(reg, ll, WithFlowListVersion(version))
+				if err != nil {
+					t.Fatalf("unexpected error creating flow store: %v", err)
+				}
+
+				if tt.insert != nil {
+					err := store.Insert(tt.insert)
+					if err != nil {
+						t.Fatalf("unexpected error inserting flows: %v", err)
+					}
+				}
+
+				flows, err := store.Get(tt.Hour)
+				if err != nil {
+					t.Fatalf("unexpected error retrieving flows: %v", err)
+				}
+
+				if diff := cmp.Diff(flows, reported(tt.expectedFlows), cmpopts.SortSlices(less)); diff != "" {
+					t.Fatalf("unexpected flows: %v", diff)
+				}
+			})
+		}
+	}
+}
+
+func Test_FlowListV2(t *testing.T) {
+	key := FlowKey{Src: "foo", Dst: "bar", VpcID: "vpc-0"}
+
+	// Out of order arrivals must still be kept sorted by hour
+	fl := &flowListV2{}
+	for _, hour := range []int{3, 1, 4, 1, 5, 2, 6, 5, 3} {
+		if err := fl.insert(&Flow{Src: key.Src, Dst: key.Dst, VpcID: key.VpcID, BytesTx: uint64(hour), BytesRx: uint64(10 * hour), Hour: hour}); err != nil {
+			t.Fatalf("unexpected error inserting flow: %v", err)
+		}
+	}
+
+	for i := 1; i < len(fl.flows); i++ {
+		if fl.flows[i-1].Hour > fl.flows[i].Hour {
+			t.Fatalf("flows out of order at index %d: hour %d before hour %d", i, fl.flows[i-1].Hour, fl.flows[i].Hour)
+		}
+	}
+
+	tests := []struct {
+		hour     int
+		expected *Flow
+	}{
+		{hour: 1, expected: &Flow{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 2, BytesRx: 20, Hour: 1}},
+		{hour: 2, expected: &Flow{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 2, BytesRx: 20, Hour: 2}},
+		{hour: 5, expected: &Flow{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 10, BytesRx: 100, Hour: 5}},
+		{hour: 6, expected: &Flow{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 6, BytesRx: 60, Hour: 6}},
+		{hour: 7, expected: nil},
+	}
+
 	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
+		flow, err := fl.get(key, tt.hour, tt.hour+1)
+		if err != nil {
+			t.Fatalf("unexpected error retrieving hour %d: %v", tt.hour, err)
+		}
+		if diff := cmp.Diff(flow, tt.expected); diff != "" {
+			t.Fatalf("unexpected flow for hour %d: %v", tt.hour, diff)
+		}
+	}
+}
 
-			ll := logrus.New()
-			ll.SetOutput(io.Discard)
+func Test_FlowListBucket(t *testing.T) {
+	key := FlowKey{Src: "foo", Dst: "bar", VpcID: "vpc-0"}
 
-			reg := prometheus.NewPedanticRegistry()
-			store := NewFlowStore(reg, ll)
+	fl := newFlowListBucket().(*flowListBucket)
+	for _, hour := range []int{3, 1, 4, 1, 5, 2, 6, 5, 3} {
+		if err := fl.insert(&Flow{Src: key.Src, Dst: key.Dst, VpcID: key.VpcID, BytesTx: uint64(hour), BytesRx: uint64(10 * hour), Hour: hour}); err != nil {
+			t.Fatalf("unexpected error inserting flow: %v", err)
+		}
+	}
 
-			if tt.insert != nil {
-				err := store.Insert(tt.insert)
+	// Data points are folded into one bucket per hour
+	if len(fl.buckets) != 6 {
+		t.Fatalf("expected 6 hour buckets, got %d", len(fl.buckets))
+	}
+	if diff := cmp.Diff(fl.buckets[5], &hourBucket{counters: counters{bytesTx: 10, bytesRx: 100}, count: 2}, cmp.AllowUnexported(hourBucket{}, counters{})); diff != "" {
+		t.Fatalf("unexpected bucket for hour 5: %v", diff)
+	}
+
+	flow, err := fl.get(key, 1, 2)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving hour 1: %v", err)
+	}
+	if diff := cmp.Diff(flow, &Flow{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 2, BytesRx: 20, Hour: 1}); diff != "" {
+		t.Fatalf("unexpected flow for hour 1: %v", diff)
+	}
+
+	flow, err = fl.get(key, 7, 8)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving hour 7: %v", err)
+	}
+	if flow != nil {
+		t.Fatalf("expected no flow for hour 7, got %+v", flow)
+	}
+}
+
+func Test_Purge(t *testing.T) {
+	insert := []*Flow{
+		{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 100, BytesRx: 300, Hour: 1},
+		{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 200, BytesRx: 600, Hour: 2},
+		{Src: "baz", Dst: "qux", VpcID: "vpc-0", BytesTx: 100, BytesRx: 500, Hour: 1},
+		{Src: "baz", Dst: "qux", VpcID: "vpc-1", BytesTx: 100, BytesRx: 500, Hour: 3},
+		{Src: "baz", Dst: "qux", VpcID: "vpc-1", BytesTx: 100, BytesRx: 500, Hour: 4},
+	}
+
+	tests := []struct {
+		name            string
+		retentionHours  int
+		mode            RetentionMode
+		now             time.Time
+		expectedRemoved int
+		expectedKeys    int
+	}{
+		{
+			name:            "retention disabled",
+			retentionHours:  0,
+			mode:            RetentionNewestHour,
+			expectedRemoved: 0,
+			expectedKeys:    3,
+		},
+		{
+			name:            "relative to newest hour",
+			retentionHours:  2,
+			mode:            RetentionNewestHour,
+			expectedRemoved: 3,
+			expectedKeys:    1,
+		},
+		{
+			name:            "newest hour covers everything",
+			retentionHours:  4,
+			mode:            RetentionNewestHour,
+			expectedRemoved: 0,
+			expectedKeys:    3,
+		},
+		{
+			name:            "relative to wall clock",
+			retentionHours:  2,
+			mode:            RetentionWallClock,
+			now:             time.Unix(3*3600+1800, 0),
+			expectedRemoved: 2,
+			expectedKeys:    2,
+		},
+		{
+			name:            "wall clock past all data",
+			retentionHours:  2,
+			mode:            RetentionWallClock,
+			now:             time.Unix(10*3600, 0),
+			expectedRemoved: 5,
+			expectedKeys:    0,
+		},
+	}
+
+	for _, version := range []FlowListVersion{FlowListV1, FlowListV2, FlowListBucket} {
+		for _, tt := range tests {
+			t.Run(version.String()+"/"+tt.name, func(t *testing.T) {
+				ll := logrus.New()
+				ll.SetOutput(io.Discard)
+
+				store, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithFlowListVersion(version), WithRetention(tt.retentionHours, tt.mode))
 				if err != nil {
+					t.Fatalf("unexpected error creating flow store: %v", err)
+				}
+				store.now = func() time.Time { return tt.now }
+
+				if err := store.Insert(insert); err != nil {
 					t.Fatalf("unexpected error inserting flows: %v", err)
 				}
+
+				if removed := store.Purge(); removed != tt.expectedRemoved {
+					t.Fatalf("expected %d flows purged, got %d", tt.expectedRemoved, removed)
+				}
+				if keys := flowKeyCount(store); keys != tt.expectedKeys {
+					t.Fatalf("expected %d flow keys after purge, got %d", tt.expectedKeys, keys)
+				}
+
+				if size := metricValue(t, store.mm.flows); size != float64(len(insert)-tt.expectedRemoved) {
+					t.Fatalf("expected flowstore size %d, got %v", len(insert)-tt.expectedRemoved, size)
+				}
+				if purged := metricValue(t, store.mm.purged); purged != float64(tt.expectedRemoved) {
+					t.Fatalf("expected %d purged flows metric, got %v", tt.expectedRemoved, purged)
+				}
+			})
+		}
+	}
+}
+
+func Test_Shards(t *testing.T) {
+	var insert []*Flow
+	for i := 0; i < 100; i++ {
+		for hour := 1; hour <= 3; hour++ {
+			insert = append(insert, &Flow{Src: fmt.Sprintf("app-%d", i), Dst: "bar", VpcID: fmt.Sprintf("vpc-%d", i%4), BytesTx: uint64(i), BytesRx: uint64(2 * i), Hour: hour})
+		}
+	}
+
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	// A single shard is the reference the sharded stores must agree with
+	reference, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithShards(1))
+	if err != nil {
+		t.Fatalf("unexpected error creating flow store: %v", err)
+	}
+	if err := reference.Insert(insert); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	expected, err := reference.Get(2)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving flows: %v", err)
+	}
+
+	for _, shards := range []int{2, 7, 64} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			store, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithShards(shards))
+			if err != nil {
+				t.Fatalf("unexpected error creating flow store: %v", err)
 			}
 
-			flows, err := store.Get(tt.Hour)
+			// Concurrent inserts and reads must not race
+			var wg sync.WaitGroup
+			for i := 0; i < len(insert); i += 30 {
+				wg.Add(2)
+				go func(flows []*Flow) {
+					defer wg.Done()
+					if err := store.Insert(flows); err != nil {
+						t.Errorf("unexpected error inserting flows: %v", err)
+					}
+				}(insert[i : i+30])
+				go func() {
+					defer wg.Done()
+					if _, err := store.Get(2); err != nil {
+						t.Errorf("unexpected error retrieving flows: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if keys := flowKeyCount(store); keys != 100 {
+				t.Fatalf("expected 100 flow keys, got %d", keys)
+			}
+
+			flows, err := store.Get(2)
 			if err != nil {
 				t.Fatalf("unexpected error retrieving flows: %v", err)
 			}
-
-			if diff := cmp.Diff(flows, tt.expectedFlows, cmpopts.SortSlices(less)); diff != "" {
+			if diff := cmp.Diff(flows, reported(expected), cmpopts.SortSlices(less)); diff != "" {
 				t.Fatalf("unexpected flows: %v", diff)
 			}
 		})
 	}
 }
+
+// openQueryStores returns every flow store implementation holding the inserted flows, the sealed stores
+// reading all but their latest two hours from blocks
+func openQueryStores(t *testing.T, insert []*Flow) map[string]FlowStore {
+	t.Helper()
+
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	stores := map[string]FlowStore{}
+	var sealed []*MemoryStore
+	for _, version := range []FlowListVersion{FlowListV1, FlowListV2, FlowListBucket} {
+		store, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithFlowListVersion(version))
+		if err != nil {
+			t.Fatalf("unexpected error creating flow store: %v", err)
+		}
+		stores[version.String()] = store
+
+		store, err = NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithFlowListVersion(version), WithSealing(2, 0))
+		if err != nil {
+			t.Fatalf("unexpected error creating flow store: %v", err)
+		}
+		stores[version.String()+"/sealed"] = store
+		sealed = append(sealed, store)
+	}
+	bolt, err := NewBoltStore(prometheus.NewPedanticRegistry(), ll, WithBoltPath(filepath.Join(t.TempDir(), "flows.db")))
+	if err != nil {
+		t.Fatalf("unexpected error creating flow store: %v", err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+	stores["bolt"] = bolt
+
+	for _, store := range stores {
+		if err := store.Insert(insert); err != nil {
+			t.Fatalf("unexpected error inserting flows: %v", err)
+		}
+	}
+	for _, store := range sealed {
+		store.Seal()
+	}
+
+	return stores
+}
+
+func Test_GetRange(t *testing.T) {
+	var insert []*Flow
+	for i := 0; i < 10; i++ {
+		for hour := 1; hour <= 5; hour++ {
+			if (i+hour)%3 == 0 {
+				continue
+			}
+			insert = append(insert, &Flow{Src: fmt.Sprintf("app-%d", i), Dst: "bar", VpcID: "vpc-0", BytesTx: uint64(i * hour), BytesRx: uint64(2 * i), Hour: hour})
+		}
+	}
+
+	stores := openQueryStores(t, insert)
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			for start := 1; start <= 6; start++ {
+				for end := start + 1; end <= 7; end++ {
+					// The range must agree with the single-hour totals summed per tuple
+					totals := map[FlowKey]*Flow{}
+					for hour := start; hour < end; hour++ {
+						flows, err := store.Get(hour)
+						if err != nil {
+							t.Fatalf("unexpected error retrieving flows: %v", err)
+						}
+						for _, flow := range flows {
+							key, err := flowKey(flow)
+							if err != nil {
+								t.Fatalf("unexpected invalid flow tuple: %v", err)
+							}
+							total, ok := totals[key]
+							if !ok {
+								total = key.flow(start)
+								totals[key] = total
+							}
+							total.BytesTx += flow.BytesTx
+							total.BytesRx += flow.BytesRx
+						}
+					}
+					expected := []*Flow{}
+					for _, total := range totals {
+						expected = append(expected, total)
+					}
+
+					flows, err := store.GetRange(start, end)
+					if err != nil {
+						t.Fatalf("unexpected error retrieving flows: %v", err)
+					}
+					if diff := cmp.Diff(flows, reported(expected), cmpopts.SortSlices(less)); diff != "" {
+						t.Fatalf("unexpected flows for hours [%d, %d): %v", start, end, diff)
+					}
+				}
+			}
+
+			for _, tt := range [][2]int{{0, 2}, {3, 3}, {4, 2}} {
+				if _, err := store.GetRange(tt[0], tt[1]); err == nil {
+					t.Fatalf("expected an error retrieving hours [%d, %d)", tt[0], tt[1])
+				}
+			}
+		})
+	}
+}
+
+func Test_QueryFilter(t *testing.T) {
+	var insert []*Flow
+	for i := 0; i < 12; i++ {
+		for hour := 1; hour <= 4; hour++ {
+			insert = append(insert, &Flow{Src: fmt.Sprintf("app-%d", i%4), Dst: fmt.Sprintf("app-%d", i%3), VpcID: fmt.Sprintf("vpc-%d", i%2), BytesTx: uint64(i), BytesRx: uint64(hour), Hour: hour})
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+	}{
+		{name: "no filter"},
+		{name: "single vpc", filter: Filter{VpcID: []string{"vpc-0"}}},
+		{name: "list of sources", filter: Filter{Src: []string{"app-1", "app-3"}}},
+		{name: "every dimension", filter: Filter{Src: []string{"app-0", "app-2"}, Dst: []string{"app-0"}, VpcID: []string{"vpc-0", "vpc-1"}}},
+		{name: "no match", filter: Filter{VpcID: []string{"vpc-9"}}},
+	}
+
+	stores := openQueryStores(t, insert)
+	for name, store := range stores {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				all, err := store.GetRange(1, 5)
+				if err != nil {
+					t.Fatalf("unexpected error retrieving flows: %v", err)
+				}
+				expected := []*Flow{}
+				for _, flow := range all {
+					if key, _ := flowKey(flow); tt.filter.Match(key) {
+						expected = append(expected, flow)
+					}
+				}
+
+				flows, err := store.Query(Query{Start: 1, End: 5, Filter: tt.filter})
+				if err != nil {
+					t.Fatalf("unexpected error retrieving flows: %v", err)
+				}
+				if diff := cmp.Diff(flows, expected, cmpopts.SortSlices(less)); diff != "" {
+					t.Fatalf("unexpected flows: %v", diff)
+				}
+			})
+		}
+	}
+}
+
+func Test_QueryGroupBy(t *testing.T) {
+	insert := []*Flow{
+		{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 100, BytesRx: 300, Hour: 1},
+		{Src: "foo", Dst: "bar", VpcID: "vpc-1", BytesTx: 200, BytesRx: 600, Hour: 1},
+		{Src: "foo", Dst: "qux", VpcID: "vpc-0", BytesTx: 10, BytesRx: 20, Hour: 2},
+		{Src: "baz", Dst: "bar", VpcID: "vpc-1", BytesTx: 1, BytesRx: 2, Hour: 2},
+		{Src: "baz", Dst: "qux", VpcID: "vpc-1", BytesTx: 5, BytesRx: 5, Hour: 5},
+	}
+
+	tests := []struct {
+		name     string
+		groupBy  []Dimension
+		filter   Filter
+		expected []*Flow
+	}{
+		{
+			name:    "per vpc",
+			groupBy: []Dimension{DimensionVpcID},
+			expected: []*Flow{
+				{VpcID: "vpc-0", BytesTx: 110, BytesRx: 320, Hour: 1},
+				{VpcID: "vpc-1", BytesTx: 201, BytesRx: 602, Hour: 1},
+			},
+		},
+		{
+			name:    "per source",
+			groupBy: []Dimension{DimensionSrc},
+			expected: []*Flow{
+				{Src: "foo", BytesTx: 310, BytesRx: 920, Hour: 1},
+				{Src: "baz", BytesTx: 1, BytesRx: 2, Hour: 1},
+			},
+		},
+		{
+			name:    "per source and destination",
+			groupBy: []Dimension{DimensionDst, DimensionSrc},
+			expected: []*Flow{
+				{Src: "foo", Dst: "bar", BytesTx: 300, BytesRx: 900, Hour: 1},
+				{Src: "foo", Dst: "qux", BytesTx: 10, BytesRx: 20, Hour: 1},
+				{Src: "baz", Dst: "bar", BytesTx: 1, BytesRx: 2, Hour: 1},
+			},
+		},
+		{
+			name:    "filtered per destination",
+			groupBy: []Dimension{DimensionDst},
+			filter:  Filter{VpcID: []string{"vpc-1"}},
+			expected: []*Flow{
+				{Dst: "bar", BytesTx: 201, BytesRx: 602, Hour: 1},
+			},
+		},
+		{
+			name:    "full tuple",
+			groupBy: []Dimension{DimensionSrc, DimensionDst, DimensionVpcID},
+			expected: []*Flow{
+				{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 100, BytesRx: 300, Hour: 1},
+				{Src: "foo", Dst: "bar", VpcID: "vpc-1", BytesTx: 200, BytesRx: 600, Hour: 1},
+				{Src: "foo", Dst: "qux", VpcID: "vpc-0", BytesTx: 10, BytesRx: 20, Hour: 1},
+				{Src: "baz", Dst: "bar", VpcID: "vpc-1", BytesTx: 1, BytesRx: 2, Hour: 1},
+			},
+		},
+	}
+
+	stores := openQueryStores(t, insert)
+	for name, store := range stores {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				flows, err := store.Query(Query{Start: 1, End: 3, Filter: tt.filter, GroupBy: tt.groupBy})
+				if err != nil {
+					t.Fatalf("unexpected error retrieving flows: %v", err)
+				}
+				if diff := cmp.Diff(flows, reported(tt.expected), cmpopts.SortSlices(less)); diff != "" {
+					t.Fatalf("unexpected flows: %v", diff)
+				}
+			})
+		}
+	}
+
+	if _, err := stores["bolt"].Query(Query{Start: 1, End: 3, GroupBy: []Dimension{0}}); err == nil {
+		t.Fatal("expected an error grouping by an unknown dimension")
+	}
+}
+
+func Benchmark_FlowStoreGet(b *testing.B) {
+	const hours = 1000
+
+	for _, version := range []FlowListVersion{FlowListV1, FlowListV2, FlowListBucket} {
+		b.Run(version.String(), func(b *testing.B) {
+			ll := logrus.New()
+			ll.SetOutput(io.Discard)
+
+			store, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithFlowListVersion(version))
+			if err != nil {
+				b.Fatalf("unexpected error creating flow store: %v", err)
+			}
+			flows := make([]*Flow, 0, hours*10)
+			for hour := 1; hour <= hours; hour++ {
+				for i := 0; i < 10; i++ {
+					flows = append(flows, &Flow{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 100, BytesRx: 300, Hour: hour})
+				}
+			}
+			if err := store.Insert(flows); err != nil {
+				b.Fatalf("unexpected error inserting flows: %v", err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := store.Get(i%hours + 1); err != nil {
+					b.Fatalf("unexpected error retrieving flows: %v", err)
+				}
+			}
+		})
+	}
+}
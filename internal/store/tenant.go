@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// DefaultTenant is the tenant holding every flow of a TenantStore created without tenants
+const DefaultTenant = "default"
+
+// tenantName matches the names of tenants, which are used in file names and metric labels
+var tenantName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// TenantStore isolates the flow data of tenants by holding a separate FlowStore per tenant, above the flow
+// tuples of each. A tenant's store is configured with the shared options followed by the tenant's own, so
+// tenants may have their own retention and tuple limits, and keeps its write-ahead log, snapshots or bolt
+// database apart from the other tenants'. The metrics of each tenant's store carry a tenant label.
+type TenantStore struct {
+	stores map[string]FlowStore
+	ll     *logrus.Logger
+}
+
+// NewTenantStore creates the flow store of every tenant, given by name along with the tenant's options.
+// Without tenants a single DefaultTenant store is created with the shared options alone, keeping the paths
+// of its write-ahead log, snapshots or bolt database unchanged. Otherwise each tenant's write-ahead log and
+// snapshots are kept in a directory named after the tenant, and its bolt database file name is suffixed with
+// the tenant.
+func NewTenantStore(reg prometheus.Registerer, ll *logrus.Logger, tenants map[string][]Option, opts ...Option) (*TenantStore, error) {
+	ts := &TenantStore{
+		stores: map[string]FlowStore{},
+		ll:     ll,
+	}
+
+	shared := len(tenants) == 0
+	if shared {
+		tenants = map[string][]Option{DefaultTenant: nil}
+	}
+	for name, tenantOpts := range tenants {
+		if !tenantName.MatchString(name) {
+			ts.Close()
+			return nil, fmt.Errorf("invalid tenant name %q", name)
+		}
+		all := append([]Option{}, opts...)
+		if !shared {
+			all = append(all, tenantPaths(name))
+		}
+		all = append(all, tenantOpts...)
+
+		fs, err := NewFlowStore(prometheus.WrapRegistererWith(prometheus.Labels{"tenant": name}, reg), ll, all...)
+		if err != nil {
+			ts.Close()
+			return nil, fmt.Errorf("unable to create flow store of tenant %s: %w", name, err)
+		}
+		ts.stores[name] = fs
+	}
+	return ts, nil
+}
+
+// tenantPaths moves the write-ahead log, snapshots and bolt database of a store to paths of the tenant
+func tenantPaths(name string) Option {
+	return func(c *config) {
+		if c.walDir != "" {
+			c.walDir = filepath.Join(c.walDir, name)
+		}
+		if c.snapshotDir != "" {
+			c.snapshotDir = filepath.Join(c.snapshotDir, name)
+		}
+		ext := filepath.Ext(c.boltPath)
+		c.boltPath = strings.TrimSuffix(c.boltPath, ext) + "-" + name + ext
+	}
+}
+
+// Tenant returns the flow store of a tenant, or false if the tenant does not exist
+func (ts *TenantStore) Tenant(name string) (FlowStore, bool) {
+	fs, ok := ts.stores[name]
+	return fs, ok
+}
+
+// Tenants returns the names of the tenants, sorted
+func (ts *TenantStore) Tenants() []string {
+	names := make([]string, 0, len(ts.stores))
+	for name := range ts.stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run performs the background maintenance of every tenant's store until the context is cancelled
+func (ts *TenantStore) Run(ctx context.Context) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	for name, fs := range ts.stores {
+		name, fs := name, fs
+		eg.Go(func() error {
+			if err := fs.Run(ctx); err != nil {
+				return fmt.Errorf("tenant %s: %w", name, err)
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// Close closes the store of every tenant, returning the first error
+func (ts *TenantStore) Close() error {
+	var first error
+	for name, fs := range ts.stores {
+		if err := fs.Close(); err != nil {
+			ts.ll.Errorf("unable to close flow store of tenant %s: %v", name, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
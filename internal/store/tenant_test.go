@@ -0,0 +1,208 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func Test_TupleLimit(t *testing.T) {
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	store, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithMaxTuples(2))
+	if err != nil {
+		t.Fatalf("unexpected error creating flow store: %v", err)
+	}
+	if err := store.Insert([]*Flow{
+		{Src: "foo", Dst: "bar", BytesTx: 1, Hour: 1},
+		{Src: "foo", Dst: "bar", BytesTx: 1, Hour: 2},
+	}); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+
+	// The batch is rejected as a whole, listing every flow of the tuples beyond the limit
+	err = store.Insert([]*Flow{
+		{Src: "foo", Dst: "bar", BytesTx: 1, Hour: 1},
+		{Src: "foo", Dst: "baz", BytesTx: 1, Hour: 1},
+		{Src: "foo", Dst: "qux", BytesTx: 1, Hour: 1},
+		{Src: "foo", Dst: "qux", BytesTx: 1, Hour: 2},
+	})
+	var le *TupleLimitError
+	if !errors.As(err, &le) {
+		t.Fatalf("expected a tuple limit error, got %v", err)
+	}
+	if diff := cmp.Diff(le.Indexes, []int{2, 3}); diff != "" {
+		t.Fatalf("unexpected flows beyond the limit: %v", diff)
+	}
+	if n := flowKeyCount(store); n != 1 {
+		t.Fatalf("expected 1 flow tuple after a rejected batch, got %d", n)
+	}
+	if rejected := metricValue(t, store.mm.tupleLimitRejected); rejected != 2 {
+		t.Fatalf("expected 2 flows rejected by the tuple limit, got %v", rejected)
+	}
+
+	// Tuples removed by retention free up room
+	if err := store.Insert([]*Flow{{Src: "foo", Dst: "baz", BytesTx: 1, Hour: 3}}); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	for _, s := range store.shards {
+		s.purge(3)
+	}
+	if err := store.Insert([]*Flow{{Src: "foo", Dst: "qux", BytesTx: 1, Hour: 3}}); err != nil {
+		t.Fatalf("unexpected error inserting flows after a purge: %v", err)
+	}
+	if tuples := metricValue(t, store.mm.tuples); tuples != 2 {
+		t.Fatalf("expected 2 flow tuples, got %v", tuples)
+	}
+
+	// Concurrent inserts never create tuples beyond the limit between them
+	store, err = NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithMaxTuples(10))
+	if err != nil {
+		t.Fatalf("unexpected error creating flow store: %v", err)
+	}
+	var inserted int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := store.Insert([]*Flow{{Src: "foo", Dst: strconv.Itoa(i), BytesTx: 1, Hour: 1}}); err == nil {
+				atomic.AddInt64(&inserted, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := flowKeyCount(store); inserted != 10 || n != 10 {
+		t.Fatalf("expected 10 flow tuples inserted concurrently, got %d inserts of %d tuples", inserted, n)
+	}
+
+	if _, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithMaxTuples(-1)); err == nil {
+		t.Fatal("expected an error creating a flow store with a negative tuple limit")
+	}
+	if _, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithMaxTuples(1), WithSealing(1, time.Minute)); err == nil {
+		t.Fatal("expected an error creating a flow store with a tuple limit and sealing")
+	}
+	if _, err := NewBoltStore(prometheus.NewPedanticRegistry(), ll, WithBoltPath(filepath.Join(t.TempDir(), "flows.db")), WithMaxTuples(1)); err == nil {
+		t.Fatal("expected an error creating a bolt flow store with a tuple limit")
+	}
+}
+
+func Test_TenantStore(t *testing.T) {
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+	dir := t.TempDir()
+
+	reg := prometheus.NewPedanticRegistry()
+	ts, err := NewTenantStore(reg, ll, map[string][]Option{
+		"payments": nil,
+		"search":   {WithMaxTuples(1)},
+	}, WithWAL(dir, SyncNever, 0))
+	if err != nil {
+		t.Fatalf("unexpected error creating tenant store: %v", err)
+	}
+	defer ts.Close()
+
+	if diff := cmp.Diff(ts.Tenants(), []string{"payments", "search"}); diff != "" {
+		t.Fatalf("unexpected tenants: %v", diff)
+	}
+	if _, ok := ts.Tenant("billing"); ok {
+		t.Fatal("expected no store for an unknown tenant")
+	}
+
+	payments, _ := ts.Tenant("payments")
+	search, _ := ts.Tenant("search")
+	if err := payments.Insert([]*Flow{
+		{Src: "foo", Dst: "bar", BytesTx: 1, Hour: 1},
+		{Src: "foo", Dst: "baz", BytesTx: 2, Hour: 1},
+	}); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if err := search.Insert([]*Flow{{Src: "foo", Dst: "bar", BytesTx: 10, Hour: 1}}); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+
+	// Each tenant only sees its own flows, and its own limits apply
+	flows, err := search.Get(1)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving flows: %v", err)
+	}
+	expected := reported([]*Flow{{Src: "foo", Dst: "bar", BytesTx: 10, Hour: 1}})
+	if diff := cmp.Diff(flows, expected, cmpopts.SortSlices(less)); diff != "" {
+		t.Fatalf("unexpected flows: %v", diff)
+	}
+	var le *TupleLimitError
+	if err := search.Insert([]*Flow{{Src: "foo", Dst: "baz", BytesTx: 1, Hour: 1}}); !errors.As(err, &le) {
+		t.Fatalf("expected a tuple limit error, got %v", err)
+	}
+
+	// Tenants log to their own write-ahead log directories
+	for _, name := range ts.Tenants() {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("expected a write-ahead log directory for tenant %s: %v", name, err)
+		}
+	}
+
+	// Metrics are labelled by tenant
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("unable to gather metrics: %v", err)
+	}
+	sizes := map[string]float64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "flowd_flowstore_size" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "tenant" {
+					sizes[l.GetValue()] = m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	if diff := cmp.Diff(sizes, map[string]float64{"payments": 2, "search": 1}); diff != "" {
+		t.Fatalf("unexpected flowstore sizes by tenant: %v", diff)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ts.Run(ctx); err != nil {
+		t.Fatalf("unexpected error running tenant store: %v", err)
+	}
+}
+
+func Test_TenantStoreDefault(t *testing.T) {
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+	dir := t.TempDir()
+
+	// Without tenants the default tenant keeps the configured paths
+	ts, err := NewTenantStore(prometheus.NewPedanticRegistry(), ll, nil, WithWAL(dir, SyncNever, 0))
+	if err != nil {
+		t.Fatalf("unexpected error creating tenant store: %v", err)
+	}
+	defer ts.Close()
+	if diff := cmp.Diff(ts.Tenants(), []string{DefaultTenant}); diff != "" {
+		t.Fatalf("unexpected tenants: %v", diff)
+	}
+	if _, err := os.Stat(filepath.Join(dir, DefaultTenant)); !os.IsNotExist(err) {
+		t.Fatalf("expected the default tenant to log to %s, got %v", dir, err)
+	}
+
+	if _, err := NewTenantStore(prometheus.NewPedanticRegistry(), ll, map[string][]Option{"../etc": nil}); err == nil {
+		t.Fatal("expected an error creating a tenant store with an invalid tenant name")
+	}
+}
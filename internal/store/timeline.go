@@ -0,0 +1,152 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// DefaultGranularity is the width of the buckets flow data points are aggregated into unless configured
+// with WithGranularity. It matches the legacy hour field, so a bucket is an hour since the unix epoch.
+const DefaultGranularity = time.Hour
+
+// Timestamp is the time of a flow data point. It is encoded in JSON as an RFC 3339 string and decoded from
+// either an RFC 3339 string or a number of seconds since the unix epoch.
+type Timestamp struct {
+	time.Time
+}
+
+// Equal reports whether both timestamps are the same instant
+func (t Timestamp) Equal(o Timestamp) bool {
+	return t.Time.Equal(o.Time)
+}
+
+// MarshalJSON encodes the timestamp as an RFC 3339 string in UTC, or null when it is not set
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.UTC().Format(time.RFC3339))
+}
+
+// UnmarshalJSON decodes an RFC 3339 string or a number of seconds since the unix epoch
+func (t *Timestamp) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*t = Timestamp{}
+		return nil
+	}
+	s := string(b)
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	}
+	parsed, err := ParseTimestamp(s)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
+
+// ParseTimestamp parses an RFC 3339 time or a number of seconds since the unix epoch, which may be fractional
+func ParseTimestamp(s string) (time.Time, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(secs) || math.IsInf(secs, 0) || math.Abs(secs) > math.MaxInt64/float64(time.Second) {
+			return time.Time{}, fmt.Errorf("epoch timestamp %s out of range", s)
+		}
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole), int64(frac*float64(time.Second))).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q, expected RFC 3339 or seconds since the unix epoch", s)
+	}
+	return t, nil
+}
+
+// timeline maps times onto the buckets flow data points are aggregated into. Buckets are numbered from the
+// unix epoch, so with the default granularity bucket n is the hour n of the legacy hour field.
+type timeline struct {
+	// width is the granularity in seconds, which evenly divides an hour
+	width int64
+}
+
+// newTimeline returns the timeline of a granularity, which must be a whole number of seconds evenly dividing
+// an hour such as 1m, 5m or 1h
+func newTimeline(granularity time.Duration) (timeline, error) {
+	if granularity < time.Second || granularity%time.Second != 0 || time.Hour%granularity != 0 {
+		return timeline{}, fmt.Errorf("granularity must be a whole number of seconds evenly dividing an hour, got %v", granularity)
+	}
+	return timeline{width: int64(granularity / time.Second)}, nil
+}
+
+// granularity returns the width of each bucket
+func (tl timeline) granularity() time.Duration {
+	return time.Duration(tl.width) * time.Second
+}
+
+// bucket returns the bucket holding a time
+func (tl timeline) bucket(t time.Time) int {
+	return int(floorDiv64(t.Unix(), tl.width))
+}
+
+// start returns the time a bucket starts at
+func (tl timeline) start(bucket int) time.Time {
+	return time.Unix(int64(bucket)*tl.width, 0).UTC()
+}
+
+// hours returns the number of buckets in a number of hours, which is also the first bucket of an epoch hour
+func (tl timeline) hours(n int) int {
+	return n * int(int64(time.Hour/time.Second)/tl.width)
+}
+
+// flowBucket returns the bucket of a flow data point from its timestamp, or from its legacy epoch hour when
+// it has no timestamp
+func (tl timeline) flowBucket(flow *Flow) int {
+	if !flow.Timestamp.IsZero() {
+		return tl.bucket(flow.Timestamp.Time)
+	}
+	return tl.hours(flow.Hour)
+}
+
+// buckets validates a query and returns the range of buckets it covers, from start, inclusive, to end,
+// exclusive. A time range covers every bucket it overlaps.
+func (tl timeline) buckets(q Query) (int, int, error) {
+	if err := q.validate(); err != nil {
+		return 0, 0, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	if q.From.IsZero() {
+		return tl.hours(q.Start), tl.hours(q.End), nil
+	}
+	start, end := tl.bucket(q.From), tl.bucket(q.To)
+	if !tl.start(end).Equal(q.To) {
+		end++
+	}
+	if start <= 0 {
+		return 0, 0, fmt.Errorf("%w: start time must be after the first bucket since the unix epoch", ErrInvalidQuery)
+	}
+	return start, end, nil
+}
+
+// report sets the time aggregated flows are reported at to the start of a bucket, as a timestamp and as the
+// legacy epoch hour holding it
+func (tl timeline) report(flows []*Flow, bucket int) {
+	t := tl.start(bucket)
+	hour := int(floorDiv64(t.Unix(), int64(time.Hour/time.Second)))
+	for _, flow := range flows {
+		flow.Timestamp = Timestamp{t}
+		flow.Hour = hour
+	}
+}
+
+// floorDiv64 divides rounding towards negative infinity
+func floorDiv64(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// base is the start of an hour used by the granularity tests, epoch hour 474552
+var base = time.Date(2024, 2, 20, 0, 0, 0, 0, time.UTC)
+
+func at(d time.Duration) Timestamp {
+	return Timestamp{base.Add(d)}
+}
+
+var timedFlows = []*Flow{
+	{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 1, BytesRx: 2, Timestamp: at(time.Minute)},
+	{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 10, BytesRx: 20, Timestamp: at(4*time.Minute + 59*time.Second)},
+	{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 100, BytesRx: 200, Timestamp: at(5 * time.Minute)},
+	{Src: "baz", Dst: "bar", VpcID: "vpc-0", BytesTx: 1000, BytesRx: 2000, Timestamp: at(17 * time.Minute)},
+	// Legacy flows are placed at the start of their epoch hour
+	{Src: "baz", Dst: "bar", VpcID: "vpc-0", BytesTx: 3, BytesRx: 4, Hour: 474552},
+}
+
+func Test_ParseTimestamp(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected time.Time
+		err      bool
+	}{
+		{in: "2024-02-20T00:01:00Z", expected: base.Add(time.Minute)},
+		{in: "2024-02-20T01:01:00+01:00", expected: base.Add(time.Minute)},
+		{in: "1708387260", expected: base.Add(time.Minute)},
+		{in: "1708387260.5", expected: base.Add(time.Minute + 500*time.Millisecond)},
+		{in: "2024-02-20", err: true},
+		{in: "NaN", err: true},
+		{in: "1e300", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			ts, err := ParseTimestamp(tt.in)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error parsing %s, got %v", tt.in, ts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error parsing %s: %v", tt.in, err)
+			}
+			if !ts.Equal(tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, ts)
+			}
+		})
+	}
+}
+
+func Test_TimestampJSON(t *testing.T) {
+	var flows []Flow
+	body := `[{"src_app":"foo","timestamp":"2024-02-20T00:01:00Z"},{"src_app":"foo","timestamp":1708387260},{"src_app":"foo","hour":474552}]`
+	if err := json.Unmarshal([]byte(body), &flows); err != nil {
+		t.Fatalf("unexpected error unmarshaling flows: %v", err)
+	}
+	expected := []Flow{
+		{Src: "foo", Timestamp: at(time.Minute)},
+		{Src: "foo", Timestamp: at(time.Minute)},
+		{Src: "foo", Hour: 474552},
+	}
+	if diff := cmp.Diff(flows, expected); diff != "" {
+		t.Fatalf("unexpected flows: %v", diff)
+	}
+
+	if err := json.Unmarshal([]byte(`{"timestamp":"yesterday"}`), &Flow{}); err == nil {
+		t.Fatal("expected an error unmarshaling an invalid timestamp")
+	}
+}
+
+func Test_Granularity(t *testing.T) {
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	stores := map[string]FlowStore{}
+	for _, version := range []FlowListVersion{FlowListV1, FlowListV2, FlowListBucket} {
+		store, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithFlowListVersion(version), WithGranularity(5*time.Minute))
+		if err != nil {
+			t.Fatalf("unexpected error creating flow store: %v", err)
+		}
+		stores[version.String()] = store
+	}
+	bolt, err := NewBoltStore(prometheus.NewPedanticRegistry(), ll, WithBoltPath(filepath.Join(t.TempDir(), "flows.db")), WithGranularity(5*time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error creating flow store: %v", err)
+	}
+	defer bolt.Close()
+	stores["bolt"] = bolt
+
+	tests := []struct {
+		name     string
+		q        Query
+		expected []*Flow
+	}{
+		{
+			name: "bucket",
+			q:    Query{From: base.Add(time.Minute), To: base.Add(2 * time.Minute)},
+			expected: []*Flow{
+				{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 11, BytesRx: 22, Timestamp: at(0), Hour: 474552},
+				{Src: "baz", Dst: "bar", VpcID: "vpc-0", BytesTx: 3, BytesRx: 4, Timestamp: at(0), Hour: 474552},
+			},
+		},
+		{
+			name: "range",
+			q:    Query{From: base.Add(5 * time.Minute), To: base.Add(20 * time.Minute)},
+			expected: []*Flow{
+				{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 100, BytesRx: 200, Timestamp: at(5 * time.Minute), Hour: 474552},
+				{Src: "baz", Dst: "bar", VpcID: "vpc-0", BytesTx: 1000, BytesRx: 2000, Timestamp: at(5 * time.Minute), Hour: 474552},
+			},
+		},
+		{
+			name: "legacy hour",
+			q:    Query{Start: 474552, End: 474553},
+			expected: []*Flow{
+				{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 111, BytesRx: 222, Timestamp: at(0), Hour: 474552},
+				{Src: "baz", Dst: "bar", VpcID: "vpc-0", BytesTx: 1003, BytesRx: 2004, Timestamp: at(0), Hour: 474552},
+			},
+		},
+		{
+			name:     "empty",
+			q:        Query{From: base.Add(20 * time.Minute), To: base.Add(time.Hour)},
+			expected: []*Flow{},
+		},
+	}
+
+	for name, store := range stores {
+		if err := store.Insert(timedFlows); err != nil {
+			t.Fatalf("unexpected error inserting flows: %v", err)
+		}
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				flows, err := store.Query(tt.q)
+				if err != nil {
+					t.Fatalf("unexpected error retrieving flows: %v", err)
+				}
+				if diff := cmp.Diff(flows, tt.expected, cmpopts.SortSlices(less)); diff != "" {
+					t.Fatalf("unexpected flows: %v", diff)
+				}
+			})
+		}
+
+		if _, err := store.Query(Query{From: base}); err == nil {
+			t.Fatalf("%s: expected an error querying a time range without an end", name)
+		}
+		if _, err := store.Query(Query{From: base, To: base}); err == nil {
+			t.Fatalf("%s: expected an error querying an empty time range", name)
+		}
+	}
+}
+
+func Test_GranularityOptions(t *testing.T) {
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	for _, d := range []time.Duration{0, 500 * time.Millisecond, 7 * time.Minute, 2 * time.Hour} {
+		if _, err := NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithGranularity(d)); err == nil {
+			t.Fatalf("expected an error creating a flow store with granularity %v", d)
+		}
+	}
+
+	// A bolt database keeps the granularity it was created with
+	path := filepath.Join(t.TempDir(), "flows.db")
+	bolt, err := NewBoltStore(prometheus.NewPedanticRegistry(), ll, WithBoltPath(path), WithGranularity(time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error creating flow store: %v", err)
+	}
+	if err := bolt.Close(); err != nil {
+		t.Fatalf("unexpected error closing flow store: %v", err)
+	}
+	if _, err := NewBoltStore(prometheus.NewPedanticRegistry(), ll, WithBoltPath(path)); err == nil {
+		t.Fatal("expected an error opening a bolt database with another granularity")
+	}
+}
+
+func Test_GranularityRestore(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openSnapshotStore(t, dir, WithGranularity(5*time.Minute))
+	if err := store.Insert(timedFlows[:2]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if _, err := store.Snapshot(); err != nil {
+		t.Fatalf("unexpected error taking snapshot: %v", err)
+	}
+	// Flows inserted after the snapshot are replayed from the write-ahead log
+	if err := store.Insert(timedFlows[2:]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	q := Query{From: base, To: base.Add(10 * time.Minute)}
+	expected, err := store.Query(q)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving flows: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("unexpected error closing flow store: %v", err)
+	}
+
+	restored := openSnapshotStore(t, dir, WithGranularity(5*time.Minute))
+	flows, err := restored.Query(q)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving flows: %v", err)
+	}
+	if diff := cmp.Diff(flows, expected, cmpopts.SortSlices(less)); diff != "" {
+		t.Fatalf("unexpected flows after restore: %v", diff)
+	}
+	if err := restored.Close(); err != nil {
+		t.Fatalf("unexpected error closing flow store: %v", err)
+	}
+
+	// Restoring into a coarser granularity folds the buckets into hours
+	hourly := openSnapshotStore(t, dir)
+	defer hourly.Close()
+	flows, err = hourly.Get(474552)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving flows: %v", err)
+	}
+	hour := []*Flow{
+		{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 111, BytesRx: 222, Hour: 474552},
+		{Src: "baz", Dst: "bar", VpcID: "vpc-0", BytesTx: 1003, BytesRx: 2004, Hour: 474552},
+	}
+	if diff := cmp.Diff(flows, reported(hour), cmpopts.SortSlices(less)); diff != "" {
+		t.Fatalf("unexpected flows after restore: %v", diff)
+	}
+}
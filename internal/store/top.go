@@ -0,0 +1,143 @@
+package store
+
+import (
+	"container/heap"
+	"fmt"
+)
+
+// Rank selects the counter flows are ranked by in top queries
+type Rank int
+
+const (
+	// RankBytesTx ranks flows by bytes transmitted
+	RankBytesTx Rank = iota + 1
+	// RankBytesRx ranks flows by bytes received
+	RankBytesRx
+	// RankTotal ranks flows by bytes transmitted and received
+	RankTotal
+)
+
+// String returns the name used to select a rank in queries
+func (r Rank) String() string {
+	switch r {
+	case RankBytesTx:
+		return "bytes_tx"
+	case RankBytesRx:
+		return "bytes_rx"
+	case RankTotal:
+		return "total"
+	default:
+		return fmt.Sprintf("Rank(%d)", int(r))
+	}
+}
+
+// ParseRank returns the rank for a name such as "bytes_tx", "bytes_rx" or "total"
+func ParseRank(s string) (Rank, error) {
+	for _, r := range []Rank{RankBytesTx, RankBytesRx, RankTotal} {
+		if r.String() == s {
+			return r, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rank %q", s)
+}
+
+func (r Rank) value(flow *Flow) uint64 {
+	switch r {
+	case RankBytesTx:
+		return flow.BytesTx
+	case RankBytesRx:
+		return flow.BytesRx
+	default:
+		// Totals past the counter range rank with the largest
+		total, _ := addCounter(flow.BytesTx, flow.BytesRx)
+		return total
+	}
+}
+
+func validateTop(n int, rank Rank) error {
+	if n <= 0 {
+		return fmt.Errorf("%w: number of flows must be greater than 0, got %d", ErrInvalidQuery, n)
+	}
+	if rank < RankBytesTx || rank > RankTotal {
+		return fmt.Errorf("%w: unknown rank %d", ErrInvalidQuery, int(rank))
+	}
+	return nil
+}
+
+// topFlows returns the n flows ranked highest, highest first. Each flow's tuple is parsed once as it is
+// offered to the bounded heap, rather than on every comparison.
+func topFlows(flows []*Flow, n int, rank Rank) []*Flow {
+	h := newFlowHeap(n, rank)
+	for _, flow := range flows {
+		// Ranked flows are aggregates and always hold a valid flow tuple
+		key, _ := flowKey(flow)
+		h.offer(key, flow)
+	}
+	return h.top()
+}
+
+// rankedFlow is a flow offered to a flowHeap along with its tuple and the value it is ranked by
+type rankedFlow struct {
+	key   FlowKey
+	value uint64
+	flow  *Flow
+}
+
+// below reports whether a ranks below b. Of equal flows the later tuple ranks lower so the earlier tuple is
+// kept.
+func (a rankedFlow) below(b rankedFlow) bool {
+	if a.value != b.value {
+		return a.value < b.value
+	}
+	return lessKey(b.key, a.key)
+}
+
+// flowHeap is a min-heap of the n flows ranked highest, the lowest ranked flow is at the root. Flows are
+// pushed through it so the full set of flows is never sorted.
+type flowHeap struct {
+	n     int
+	rank  Rank
+	flows []rankedFlow
+}
+
+func newFlowHeap(n int, rank Rank) *flowHeap {
+	return &flowHeap{n: n, rank: rank}
+}
+
+// offer adds a flow if it ranks among the n highest offered so far
+func (h *flowHeap) offer(key FlowKey, flow *Flow) {
+	rf := rankedFlow{key: key, value: h.rank.value(flow), flow: flow}
+	if len(h.flows) < h.n {
+		heap.Push(h, rf)
+		return
+	}
+	if h.flows[0].below(rf) {
+		h.flows[0] = rf
+		heap.Fix(h, 0)
+	}
+}
+
+// top returns the flows held, highest ranked first
+func (h *flowHeap) top() []*Flow {
+	top := make([]*Flow, h.Len())
+	for i := len(top) - 1; i >= 0; i-- {
+		top[i] = heap.Pop(h).(rankedFlow).flow
+	}
+	return top
+}
+
+func (h *flowHeap) Len() int           { return len(h.flows) }
+func (h *flowHeap) Less(i, j int) bool { return h.flows[i].below(h.flows[j]) }
+func (h *flowHeap) Swap(i, j int)      { h.flows[i], h.flows[j] = h.flows[j], h.flows[i] }
+
+func (h *flowHeap) Push(x interface{}) {
+	h.flows = append(h.flows, x.(rankedFlow))
+}
+
+func (h *flowHeap) Pop() interface{} {
+	n := len(h.flows)
+	rf := h.flows[n-1]
+	h.flows[n-1] = rankedFlow{}
+	h.flows = h.flows[:n-1]
+	return rf
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_Top(t *testing.T) {
+	var insert []*Flow
+	for i := 0; i < 40; i++ {
+		for hour := 1; hour <= 4; hour++ {
+			// Repeating counters produce ties
+			insert = append(insert, &Flow{Src: fmt.Sprintf("app-%d", i), Dst: fmt.Sprintf("app-%d", i%5), VpcID: fmt.Sprintf("vpc-%d", i%3), BytesTx: uint64((i * 37) % 11), BytesRx: uint64((i * 13) % 17), Hour: hour})
+		}
+	}
+
+	tests := []struct {
+		name string
+		q    Query
+		n    int
+		rank Rank
+	}{
+		{name: "single hour by total", q: Query{Start: 2, End: 3}, n: 5, rank: RankTotal},
+		{name: "range by bytes tx", q: Query{Start: 1, End: 5}, n: 7, rank: RankBytesTx},
+		{name: "filtered by bytes rx", q: Query{Start: 1, End: 3, Filter: Filter{VpcID: []string{"vpc-1"}}}, n: 3, rank: RankBytesRx},
+		{name: "grouped", q: Query{Start: 1, End: 5, GroupBy: []Dimension{DimensionDst}}, n: 2, rank: RankTotal},
+		{name: "more than available", q: Query{Start: 1, End: 5, GroupBy: []Dimension{DimensionVpcID}}, n: 10, rank: RankTotal},
+	}
+
+	stores := openQueryStores(t, insert)
+	for name, store := range stores {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				// The heap must agree with fully sorting the query result
+				expected, err := store.Query(tt.q)
+				if err != nil {
+					t.Fatalf("unexpected error retrieving flows: %v", err)
+				}
+				ranked := func(flow *Flow) rankedFlow {
+					key, _ := flowKey(flow)
+					return rankedFlow{key: key, value: tt.rank.value(flow), flow: flow}
+				}
+				sort.Slice(expected, func(i, j int) bool { return ranked(expected[j]).below(ranked(expected[i])) })
+				if len(expected) > tt.n {
+					expected = expected[:tt.n]
+				}
+
+				flows, err := store.Top(tt.q, tt.n, tt.rank)
+				if err != nil {
+					t.Fatalf("unexpected error retrieving top flows: %v", err)
+				}
+				if diff := cmp.Diff(flows, expected); diff != "" {
+					t.Fatalf("unexpected top flows: %v", diff)
+				}
+			})
+		}
+	}
+
+	for _, tt := range []struct {
+		n    int
+		rank Rank
+	}{{n: 0, rank: RankTotal}, {n: 1, rank: 0}} {
+		if _, err := stores["bolt"].Top(Query{Start: 1, End: 2}, tt.n, tt.rank); err == nil {
+			t.Fatalf("expected an error for %d flows ranked by %v", tt.n, tt.rank)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package store
+
+import "fmt"
+
+// InvalidReason is the reason a flow is rejected by ValidateFlow
+type InvalidReason string
+
+const (
+	// InvalidRecord is a record that does not decode into a flow, such as null, a value of the wrong type or a
+	// negative counter
+	InvalidRecord InvalidReason = "malformed"
+	// InvalidApp is a flow without both app names that does not carry an IP 5-tuple instead
+	InvalidApp InvalidReason = "missing_app"
+	// InvalidTime is a flow without a timestamp or hour after the unix epoch
+	InvalidTime InvalidReason = "invalid_time"
+	// InvalidIP is a flow whose source or destination address does not parse
+	InvalidIP InvalidReason = "invalid_ip"
+	// InvalidPort is a flow with a port out of range
+	InvalidPort InvalidReason = "invalid_port"
+	// InvalidProtocol is a flow with a protocol number out of range
+	InvalidProtocol InvalidReason = "invalid_protocol"
+)
+
+// ValidationError describes why a flow was rejected
+type ValidationError struct {
+	Reason InvalidReason
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// invalid returns a *ValidationError for a reason with a formatted message
+func invalid(reason InvalidReason, format string, args ...interface{}) error {
+	return &ValidationError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// ValidateFlow checks that a flow can be stored, returning a *ValidationError if it cannot. Flows must name
+// both apps unless they carry an IP 5-tuple, must be timestamped after the unix epoch and must hold a valid
+// IP 5-tuple if any. Counters are unsigned, so negative counters are rejected when flows are decoded.
+func ValidateFlow(flow *Flow) error {
+	_, err := validKey(flow)
+	return err
+}
+
+// validKey validates a flow and returns its flow tuple
+func validKey(flow *Flow) (FlowKey, error) {
+	if flow == nil {
+		return FlowKey{}, invalid(InvalidRecord, "flow is null")
+	}
+	if flow.Timestamp.IsZero() {
+		if flow.Hour <= 0 {
+			return FlowKey{}, invalid(InvalidTime, "flow has no timestamp and hour %d is not greater than 0", flow.Hour)
+		}
+	} else if flow.Timestamp.Unix() <= 0 {
+		return FlowKey{}, invalid(InvalidTime, "timestamp %v is not after the unix epoch", flow.Timestamp.Time)
+	}
+
+	key, err := flowKey(flow)
+	if err != nil {
+		return FlowKey{}, err
+	}
+	if !key.hasIP() && (key.Src == "" || key.Dst == "") {
+		return FlowKey{}, invalid(InvalidApp, "flow without an IP 5-tuple must have both src_app and dest_app")
+	}
+	return key, nil
+}
+
+// TupleLimitError is returned by Insert when a batch would create flow tuples beyond the store's tuple limit.
+// No flows of the batch are inserted.
+type TupleLimitError struct {
+	Limit int
+	// Indexes are the positions in the batch of the flows that would exceed the limit
+	Indexes []int
+}
+
+func (e *TupleLimitError) Error() string {
+	return fmt.Sprintf("%d flows would exceed the limit of %d flow tuples", len(e.Indexes), e.Limit)
+}
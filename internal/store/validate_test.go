@@ -0,0 +1,47 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_ValidateFlow(t *testing.T) {
+	tests := []struct {
+		name   string
+		flow   *Flow
+		reason InvalidReason
+	}{
+		{name: "app flow", flow: &Flow{Src: "foo", Dst: "bar", VpcID: "vpc-0", Hour: 1}},
+		{name: "timestamped", flow: &Flow{Src: "foo", Dst: "bar", Timestamp: Timestamp{time.Unix(3600, 0)}}},
+		{name: "ip flow without apps", flow: &Flow{SrcIP: "10.0.0.1", DstIP: "10.0.0.2", Protocol: 6, Hour: 1}},
+		{name: "null", flow: nil, reason: InvalidRecord},
+		{name: "missing src", flow: &Flow{Dst: "bar", Hour: 1}, reason: InvalidApp},
+		{name: "missing dst", flow: &Flow{Src: "foo", Hour: 1}, reason: InvalidApp},
+		{name: "missing time", flow: &Flow{Src: "foo", Dst: "bar"}, reason: InvalidTime},
+		{name: "negative hour", flow: &Flow{Src: "foo", Dst: "bar", Hour: -1}, reason: InvalidTime},
+		{name: "timestamp before epoch", flow: &Flow{Src: "foo", Dst: "bar", Timestamp: Timestamp{time.Unix(-60, 0)}}, reason: InvalidTime},
+		{name: "invalid ip", flow: &Flow{Src: "foo", Dst: "bar", SrcIP: "10.0.0", Hour: 1}, reason: InvalidIP},
+		{name: "invalid port", flow: &Flow{SrcIP: "10.0.0.1", DstPort: 70000, Hour: 1}, reason: InvalidPort},
+		{name: "invalid protocol", flow: &Flow{SrcIP: "10.0.0.1", Protocol: 256, Hour: 1}, reason: InvalidProtocol},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateFlow(tt.flow)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("unexpected error validating flow: %v", err)
+				}
+				return
+			}
+			var ve *ValidationError
+			if !errors.As(err, &ve) {
+				t.Fatalf("expected a validation error, got %v", err)
+			}
+			if ve.Reason != tt.reason {
+				t.Fatalf("expected reason %s, got %s: %v", tt.reason, ve.Reason, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SyncMode selects when the write-ahead log is flushed to stable storage
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs the write-ahead log after every batch before the batch is acknowledged
+	SyncAlways SyncMode = iota + 1
+	// SyncInterval fsyncs the write-ahead log on an interval, a crash may lose the batches written since the last sync
+	SyncInterval
+	// SyncNever leaves flushing the write-ahead log to the operating system
+	SyncNever
+)
+
+// String returns the name used to select a sync mode on the command line
+func (m SyncMode) String() string {
+	switch m {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	default:
+		return fmt.Sprintf("SyncMode(%d)", int(m))
+	}
+}
+
+// ParseSyncMode returns the sync mode for a name such as "always", "interval" or "never"
+func ParseSyncMode(s string) (SyncMode, error) {
+	for _, m := range []SyncMode{SyncAlways, SyncInterval, SyncNever} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync mode %q", s)
+}
+
+const (
+	// walHeaderSize is the size of a record header: the payload length and its checksum
+	walHeaderSize = 8
+	// walMaxRecordSize bounds the payload length read from a record header
+	walMaxRecordSize = 1 << 30
+	walSuffix        = ".wal"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptRecord is returned when a record that is followed by more data fails its checksum
+var errCorruptRecord = errors.New("corrupt write-ahead log record")
+
+// wal is an append-only write-ahead log of inserted flow batches.
+// The log is a directory of numbered segment files. Each record in a segment is a header holding the
+// payload length and a CRC-32C of the payload, followed by the payload: a batch of flows encoded by appendFlows.
+type wal struct {
+	mu  sync.Mutex
+	dir string
+	f   segmentFile
+	// seg is the number of the segment being appended to and size its length in bytes
+	seg  int
+	size int64
+	// broken is set when a failed append could not be undone, leaving a torn or unacknowledged record in the
+	// segment that further records must not follow
+	broken error
+	mode   SyncMode
+	// dirty is set when records have been written since the last sync
+	dirty bool
+	mm    *Metrics
+}
+
+// openWAL opens the write-ahead log in dir, creating the directory if needed, and calls replay with
+// every batch of flows logged from segment from onwards. Earlier segments are already part of a snapshot.
+// A torn record at the end of the last segment, left behind by a crash part way through a write, is truncated.
+func openWAL(dir string, from int, mode SyncMode, mm *Metrics, ll *logrus.Logger, replay func(flows []*Flow)) (*wal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create write-ahead log directory: %w", err)
+	}
+
+	all, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []int
+	for _, seg := range all {
+		if seg >= from {
+			segs = append(segs, seg)
+		}
+	}
+	if len(segs) == 0 {
+		segs = []int{from}
+		if from < 1 {
+			segs = []int{1}
+		}
+	}
+	if segs[0] > from && from > 0 {
+		ll.Errorf("write-ahead log segments %d to %d are missing, flows logged in them are lost", from, segs[0]-1)
+	}
+
+	for i, seg := range segs {
+		last := i == len(segs)-1
+		if err := replaySegment(segmentPath(dir, seg), last, replay); err != nil {
+			return nil, fmt.Errorf("unable to replay write-ahead log segment %d: %w", seg, err)
+		}
+	}
+
+	seg := segs[len(segs)-1]
+	f, err := os.OpenFile(segmentPath(dir, seg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open write-ahead log segment %d: %w", seg, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to stat write-ahead log segment %d: %w", seg, err)
+	}
+
+	return &wal{
+		dir:  dir,
+		f:    f,
+		seg:  seg,
+		size: fi.Size(),
+		mode: mode,
+		mm:   mm,
+	}, nil
+}
+
+// segmentFile is the open segment of a write-ahead log
+type segmentFile interface {
+	io.Writer
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// walSegments returns the numbers of the segments in dir in ascending order
+func walSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list write-ahead log directory: %w", err)
+	}
+
+	var segs []int
+	for _, e := range entries {
+		seg, err := strconv.Atoi(strings.TrimSuffix(e.Name(), walSuffix))
+		if err != nil || e.Name() != filepath.Base(segmentPath(dir, seg)) {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	sort.Ints(segs)
+	return segs, nil
+}
+
+func segmentPath(dir string, seg int) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", seg, walSuffix))
+}
+
+// replaySegment reads every record of a segment. If last is set a torn record at the end of the
+// segment is truncated, anywhere else it is an error.
+func replaySegment(path string, last bool, replay func(flows []*Flow)) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	var offset int
+	for offset < len(data) {
+		flows, n, err := readRecord(data[offset:])
+		if err != nil {
+			if !last || errors.Is(err, errCorruptRecord) {
+				return fmt.Errorf("offset %d: %w", offset, err)
+			}
+			// A crash part way through appending the final record leaves it torn, drop it
+			if err := f.Truncate(int64(offset)); err != nil {
+				return fmt.Errorf("unable to truncate torn record at offset %d: %w", offset, err)
+			}
+			return f.Sync()
+		}
+		replay(flows)
+		offset += n
+	}
+	return nil
+}
+
+// readRecord decodes the record at the start of data and returns its flows and encoded size.
+// An incomplete record, or a record failing its checksum that runs to the end of data, is reported as
+// io.ErrUnexpectedEOF. A record failing its checksum that is followed by more data is errCorruptRecord.
+func readRecord(data []byte) ([]*Flow, int, error) {
+	if len(data) < walHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	length := binary.LittleEndian.Uint32(data[0:4])
+	sum := binary.LittleEndian.Uint32(data[4:8])
+	if length > walMaxRecordSize || int(length) > len(data)-walHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	size := walHeaderSize + int(length)
+	payload := data[walHeaderSize:size]
+	if crc32.Checksum(payload, crcTable) != sum {
+		if size == len(data) {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return nil, 0, errCorruptRecord
+	}
+
+	flows, err := decodeFlows(payload)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errCorruptRecord, err)
+	}
+	return flows, size, nil
+}
+
+// append writes a batch of flows to the log, syncing it to stable storage when the sync mode is SyncAlways
+func (w *wal) append(flows []*Flow) error {
+	payload := appendFlows(nil, flows)
+	record := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	record = append(record, payload...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.broken != nil {
+		return w.broken
+	}
+	if _, err := w.f.Write(record); err != nil {
+		// Replay only tolerates a torn record at the end of the log, so a record written in part is cut off
+		// before another follows it
+		w.cut()
+		return fmt.Errorf("unable to write write-ahead log record: %w", err)
+	}
+	w.dirty = true
+
+	if w.mode == SyncAlways {
+		if err := w.syncLocked(); err != nil {
+			// The batch is reported as failed, so the record is cut off rather than replayed after a restart
+			w.cut()
+			return err
+		}
+	}
+	w.size += int64(len(record))
+	w.mm.walBytes.Add(float64(len(record)))
+	return nil
+}
+
+// cut truncates the segment back to the records appended before a failed append, marking the log broken if
+// the segment cannot be truncated
+func (w *wal) cut() {
+	if err := w.f.Truncate(w.size); err != nil {
+		w.broken = fmt.Errorf("write-ahead log segment %d holds a failed record: %w", w.seg, err)
+	}
+}
+
+// rotate syncs and closes the current segment and starts appending to a new one.
+// It returns the number of the new segment, every record logged before rotate is in an earlier segment.
+func (w *wal) rotate() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.syncLocked(); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(segmentPath(w.dir, w.seg+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create write-ahead log segment %d: %w", w.seg+1, err)
+	}
+	if err := w.f.Close(); err != nil {
+		f.Close()
+		return 0, fmt.Errorf("unable to close write-ahead log segment %d: %w", w.seg, err)
+	}
+
+	w.f = f
+	w.seg++
+	w.size = 0
+	return w.seg, nil
+}
+
+// removeBefore deletes every segment older than seg
+func (w *wal) removeBefore(seg int) error {
+	segs, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segs {
+		if s >= seg {
+			break
+		}
+		if err := os.Remove(segmentPath(w.dir, s)); err != nil {
+			return fmt.Errorf("unable to remove write-ahead log segment %d: %w", s, err)
+		}
+	}
+	return nil
+}
+
+// sync flushes any records written since the last sync to stable storage
+func (w *wal) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncLocked()
+}
+
+func (w *wal) syncLocked() error {
+	if !w.dirty {
+		return nil
+	}
+
+	start := time.Now()
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("unable to sync write-ahead log: %w", err)
+	}
+	w.mm.walSyncDuration.Observe(time.Since(start).Seconds())
+	w.dirty = false
+	return nil
+}
+
+// close syncs and closes the log
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.syncLocked(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
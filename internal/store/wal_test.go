@@ -0,0 +1,291 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var walFlows = []*Flow{
+	{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 100, BytesRx: 300, Hour: 1},
+	{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 200, BytesRx: 600, Hour: 1},
+	{Src: "baz", Dst: "qux", VpcID: "vpc-0", BytesTx: 100, BytesRx: 500, Hour: 1},
+	{Src: "baz", Dst: "qux", VpcID: "vpc-1", BytesTx: 100, BytesRx: 500, Hour: 2},
+}
+
+// openWALStore creates a flow store logging to a write-ahead log in dir
+func openWALStore(t *testing.T, dir string) (*MemoryStore, error) {
+	t.Helper()
+
+	ll := logrus.New()
+	ll.SetOutput(io.Discard)
+
+	return NewMemoryStore(prometheus.NewPedanticRegistry(), ll, WithWAL(dir, SyncAlways, 0))
+}
+
+func Test_WALReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := openWALStore(t, dir)
+	if err != nil {
+		t.Fatalf("unexpected error creating flow store: %v", err)
+	}
+	// Insert in two batches so replay covers multiple records
+	if err := store.Insert(walFlows[:2]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	if err := store.Insert(walFlows[2:]); err != nil {
+		t.Fatalf("unexpected error inserting flows: %v", err)
+	}
+	expected, err := store.Get(1)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving flows: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("unexpected error closing flow store: %v", err)
+	}
+
+	restored, err := openWALStore(t, dir)
+	if err != nil {
+		t.Fatalf("unexpected error replaying flow store: %v", err)
+	}
+	defer restored.Close()
+
+	flows, err := restored.Get(1)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving flows: %v", err)
+	}
+	if diff := cmp.Diff(flows, expected, cmpopts.SortSlices(less)); diff != "" {
+		t.Fatalf("unexpected flows after replay: %v", diff)
+	}
+	if size := metricValue(t, restored.mm.flows); size != float64(len(walFlows)) {
+		t.Fatalf("expected flowstore size %d after replay, got %v", len(walFlows), size)
+	}
+}
+
+func Test_WALTornRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte, last int) []byte
+		// intact is set when both logged records survive the corruption
+		intact      bool
+		expectedErr bool
+	}{
+		{
+			name: "torn header",
+			corrupt: func(data []byte, last int) []byte {
+				return append(data, 1, 2, 3)
+			},
+			intact: true,
+		},
+		{
+			name: "torn payload",
+			corrupt: func(data []byte, last int) []byte {
+				return data[:len(data)-3]
+			},
+		},
+		{
+			name: "final record checksum mismatch",
+			corrupt: func(data []byte, last int) []byte {
+				data[len(data)-1] ^= 0xff
+				return data
+			},
+		},
+		{
+			name: "corrupt record followed by data",
+			corrupt: func(data []byte, last int) []byte {
+				data[last-1] ^= 0xff
+				return data
+			},
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			store, err := openWALStore(t, dir)
+			if err != nil {
+				t.Fatalf("unexpected error creating flow store: %v", err)
+			}
+			if err := store.Insert(walFlows[:2]); err != nil {
+				t.Fatalf("unexpected error inserting flows: %v", err)
+			}
+			info, err := os.Stat(segmentPath(dir, 1))
+			if err != nil {
+				t.Fatalf("unable to stat write-ahead log: %v", err)
+			}
+			// last is the size of the log holding only the first record
+			last := int(info.Size())
+			if err := store.Insert(walFlows[2:]); err != nil {
+				t.Fatalf("unexpected error inserting flows: %v", err)
+			}
+			if err := store.Close(); err != nil {
+				t.Fatalf("unexpected error closing flow store: %v", err)
+			}
+
+			data, err := os.ReadFile(segmentPath(dir, 1))
+			if err != nil {
+				t.Fatalf("unable to read write-ahead log: %v", err)
+			}
+			expectedLen, expectedFlows := last, 2
+			if tt.intact {
+				expectedLen, expectedFlows = len(data), len(walFlows)
+			}
+			if err := os.WriteFile(segmentPath(dir, 1), tt.corrupt(data, last), 0o644); err != nil {
+				t.Fatalf("unable to write write-ahead log: %v", err)
+			}
+
+			restored, err := openWALStore(t, dir)
+			if tt.expectedErr {
+				if err == nil {
+					t.Fatal("expected error replaying corrupt write-ahead log")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error replaying flow store: %v", err)
+			}
+			defer restored.Close()
+
+			// Only complete records survive and the torn tail is truncated
+			info, err = os.Stat(segmentPath(dir, 1))
+			if err != nil {
+				t.Fatalf("unable to stat write-ahead log: %v", err)
+			}
+			if int(info.Size()) != expectedLen {
+				t.Fatalf("expected write-ahead log truncated to %d bytes, got %d", expectedLen, info.Size())
+			}
+			if size := metricValue(t, restored.mm.flows); size != float64(expectedFlows) {
+				t.Fatalf("expected flowstore size %d after replay, got %v", expectedFlows, size)
+			}
+
+			// The log is appended to after the truncation point
+			if err := restored.Insert(walFlows[2:]); err != nil {
+				t.Fatalf("unexpected error inserting flows: %v", err)
+			}
+			expectedFlows += len(walFlows[2:])
+			if err := restored.Close(); err != nil {
+				t.Fatalf("unexpected error closing flow store: %v", err)
+			}
+			reopened, err := openWALStore(t, dir)
+			if err != nil {
+				t.Fatalf("unexpected error replaying flow store: %v", err)
+			}
+			defer reopened.Close()
+			if size := metricValue(t, reopened.mm.flows); size != float64(expectedFlows) {
+				t.Fatalf("expected flowstore size %d after replay, got %v", expectedFlows, size)
+			}
+		})
+	}
+}
+
+// tornFile is a write-ahead log segment whose writes fail part way through while fail is set, whose syncs
+// fail while failSync is set and whose truncation fails while truncateErr is set
+type tornFile struct {
+	*os.File
+	fail        bool
+	failSync    bool
+	truncateErr error
+}
+
+func (f *tornFile) Write(b []byte) (int, error) {
+	if !f.fail {
+		return f.File.Write(b)
+	}
+	n, _ := f.File.Write(b[:len(b)/2])
+	return n, errors.New("disk full")
+}
+
+func (f *tornFile) Sync() error {
+	if f.failSync {
+		return errors.New("input/output error")
+	}
+	return f.File.Sync()
+}
+
+func (f *tornFile) Truncate(size int64) error {
+	if f.truncateErr != nil {
+		return f.truncateErr
+	}
+	return f.File.Truncate(size)
+}
+
+func Test_WALFailedAppend(t *testing.T) {
+	tests := []struct {
+		name string
+		// failSync fails the sync of a complete record rather than the write of the record
+		failSync    bool
+		truncateErr error
+	}{
+		{name: "torn write"},
+		{name: "torn write left behind", truncateErr: errors.New("read-only file system")},
+		{name: "failed sync", failSync: true},
+		{name: "failed sync left behind", failSync: true, truncateErr: errors.New("read-only file system")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			store, err := openWALStore(t, dir)
+			if err != nil {
+				t.Fatalf("unexpected error creating flow store: %v", err)
+			}
+			if err := store.Insert(walFlows[:1]); err != nil {
+				t.Fatalf("unexpected error inserting flows: %v", err)
+			}
+
+			f := &tornFile{File: store.wal.f.(*os.File), fail: !tt.failSync, failSync: tt.failSync, truncateErr: tt.truncateErr}
+			store.wal.f = f
+			if err := store.Insert(walFlows[1:2]); err == nil {
+				t.Fatal("expected an error inserting flows into a failing write-ahead log")
+			}
+
+			// Once the log recovers, records follow the ones logged before the failed append, unless the
+			// failed record could not be cut off
+			f.fail, f.failSync = false, false
+			err = store.Insert(walFlows[2:])
+			if tt.truncateErr != nil {
+				if err == nil {
+					t.Fatal("expected an error appending after a failed record")
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error inserting flows: %v", err)
+			}
+			if err := store.Close(); err != nil {
+				t.Fatalf("unexpected error closing flow store: %v", err)
+			}
+
+			// The log replays without the failed batch, which was reported as failed to its caller, unless it
+			// was a complete record that could not be cut off
+			restored, err := openWALStore(t, dir)
+			if err != nil {
+				t.Fatalf("unexpected error replaying flow store: %v", err)
+			}
+			defer restored.Close()
+			expected := []*Flow{walFlows[0], walFlows[2]}
+			switch {
+			case tt.truncateErr != nil && tt.failSync:
+				// The failed batch is of the tuple of the first
+				expected = []*Flow{{Src: "foo", Dst: "bar", VpcID: "vpc-0", BytesTx: 300, BytesRx: 900, Hour: 1}}
+			case tt.truncateErr != nil:
+				expected = walFlows[:1]
+			}
+			flows, err := restored.Get(1)
+			if err != nil {
+				t.Fatalf("unexpected error retrieving flows: %v", err)
+			}
+			if diff := cmp.Diff(flows, reported(expected), cmpopts.SortSlices(less)); diff != "" {
+				t.Fatalf("unexpected flows after replay: %v", diff)
+			}
+		})
+	}
+}